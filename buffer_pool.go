@@ -0,0 +1,125 @@
+package dxfuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+const (
+	// Without an explicit budget, write buffers may use a quarter of
+	// the physical memory, and no less than this.
+	minWriteBufferMemory = 256 * MiB
+
+	// How long a writer waits for memory before getting an error
+	writeBufferWaitTime = FileWriteInactivityThresh
+)
+
+// A pool of write buffers, with a limit on the total memory they use. Buffers
+// are kept by size class, which is their capacity. Part sizes grow in a fixed
+// sequence, so the same sizes are requested over and over again, and a
+// returned buffer can usually be handed out again without allocating.
+//
+// Free buffers count against the budget. If a buffer of the requested class
+// is not available, free buffers of other classes are released until the new
+// one fits. If it still does not fit, the caller waits for buffers in use to
+// be returned.
+type BufferPool struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond // signaled when a buffer is returned
+	budget    int64
+	waitTime  time.Duration // how long Get waits for memory
+	used      int64 // bytes in buffers handed out
+	freeBytes int64 // bytes in free buffers
+	free      map[int][][]byte
+}
+
+// Budget for write buffers, when the user did not set one
+func DefaultWriteBufferMemory() int64 {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return minWriteBufferMemory
+	}
+	return MaxInt64(int64(vm.Total/4), minWriteBufferMemory)
+}
+
+func NewBufferPool(budget int64) *BufferPool {
+	bp := &BufferPool{
+		budget:   budget,
+		waitTime: writeBufferWaitTime,
+		free:     make(map[int][][]byte),
+	}
+	bp.cond = sync.NewCond(&bp.mutex)
+	return bp
+}
+
+// The largest buffer the pool can hand out
+func (bp *BufferPool) Budget() int64 {
+	return bp.budget
+}
+
+// Get an empty buffer with the requested capacity. Waits while the budget
+// is exhausted, and returns an error if no memory is freed for too long.
+func (bp *BufferPool) Get(size int) ([]byte, error) {
+	if int64(size) > bp.budget {
+		return nil, fmt.Errorf("a write buffer of %d bytes is larger than the budget of %d bytes",
+			size, bp.budget)
+	}
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	deadline := time.Now().Add(bp.waitTime)
+	timer := time.AfterFunc(bp.waitTime, func() {
+		bp.mutex.Lock()
+		bp.cond.Broadcast()
+		bp.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		// reuse a free buffer of the same size
+		if bufs := bp.free[size]; len(bufs) > 0 {
+			buf := bufs[len(bufs)-1]
+			bp.free[size] = bufs[:len(bufs)-1]
+			bp.freeBytes -= int64(size)
+			bp.used += int64(size)
+			return buf[:0], nil
+		}
+
+		// release free buffers of other sizes, until there is room
+		for class, bufs := range bp.free {
+			if bp.used+bp.freeBytes+int64(size) <= bp.budget {
+				break
+			}
+			bp.freeBytes -= int64(class * len(bufs))
+			delete(bp.free, class)
+		}
+		if bp.used+bp.freeBytes+int64(size) <= bp.budget {
+			bp.used += int64(size)
+			return make([]byte, 0, size), nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("waited %s for %d bytes of write buffer memory, %d of %d bytes are in use",
+				bp.waitTime.String(), size, bp.used, bp.budget)
+		}
+		bp.cond.Wait()
+	}
+}
+
+// Return a buffer to the pool
+func (bp *BufferPool) Put(buf []byte) {
+	if buf == nil {
+		return
+	}
+	size := cap(buf)
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	bp.used -= int64(size)
+	bp.free[size] = append(bp.free[size], buf[:0])
+	bp.freeBytes += int64(size)
+	bp.cond.Broadcast()
+}
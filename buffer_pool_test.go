@@ -0,0 +1,89 @@
+package dxfuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferPoolReuse(t *testing.T) {
+	bp := NewBufferPool(10 * MiB)
+	buf, err := bp.Get(4 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, 1, 2, 3)
+	bp.Put(buf)
+
+	again, err := bp.Get(4 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 0 || cap(again) != 4*MiB {
+		t.Errorf("expected an empty buffer of %d bytes, got len=%d cap=%d", 4*MiB, len(again), cap(again))
+	}
+	if &again[:1][0] != &buf[0] {
+		t.Errorf("the free buffer of the same size was not reused")
+	}
+}
+
+func TestBufferPoolEvictsOtherSizes(t *testing.T) {
+	bp := NewBufferPool(10 * MiB)
+	small, err := bp.Get(3 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	medium, err := bp.Get(4 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.Put(small)
+	bp.Put(medium)
+
+	// only fits if the free buffers are released
+	large, err := bp.Get(8 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(large) != 8*MiB {
+		t.Errorf("expected a buffer of %d bytes, got %d", 8*MiB, cap(large))
+	}
+	if bp.used != 8*MiB || bp.used+bp.freeBytes > bp.budget {
+		t.Errorf("used=%d free=%d exceed the budget of %d", bp.used, bp.freeBytes, bp.budget)
+	}
+}
+
+func TestBufferPoolTimeout(t *testing.T) {
+	bp := NewBufferPool(10 * MiB)
+	bp.waitTime = 50 * time.Millisecond
+	if _, err := bp.Get(8 * MiB); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := bp.Get(4 * MiB); err == nil {
+		t.Fatalf("expected an error when the budget is exhausted")
+	}
+	if elapsed := time.Since(start); elapsed < bp.waitTime {
+		t.Errorf("gave up after %v, expected to wait %v", elapsed, bp.waitTime)
+	}
+
+	if _, err := bp.Get(11 * MiB); err == nil {
+		t.Errorf("expected an error for a buffer larger than the budget")
+	}
+}
+
+func TestBufferPoolWaitsForPut(t *testing.T) {
+	bp := NewBufferPool(10 * MiB)
+	bp.waitTime = 5 * time.Second
+	buf, err := bp.Get(8 * MiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		bp.Put(buf)
+	}()
+	if _, err := bp.Get(4 * MiB); err != nil {
+		t.Errorf("expected the buffer to fit once memory is returned: %s", err.Error())
+	}
+}
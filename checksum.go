@@ -0,0 +1,265 @@
+package dxfuse
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The checksum of a file being written: the md5 of all the data, and the
+// size and md5 of each part uploaded. Once the file is closed, the parts
+// are compared with what the platform has, to catch data lost or changed
+// on the way.
+type UploadChecksum struct {
+	// The data is hashed by the writer, under the file handle lock
+	whole hash.Hash
+
+	// Parts are recorded by the upload workers
+	mutex sync.Mutex
+	parts map[int]JournalPart
+}
+
+// A file that did not reach the platform as it was written
+type checksumFailure struct {
+	fileId string
+	err    error
+}
+
+func NewUploadChecksum() *UploadChecksum {
+	return &UploadChecksum{
+		whole: md5.New(),
+		parts: make(map[int]JournalPart),
+	}
+}
+
+func (uc *UploadChecksum) Write(data []byte) {
+	uc.whole.Write(data)
+}
+
+// The md5 of the data written so far, in hex
+func (uc *UploadChecksum) Md5() string {
+	return hex.EncodeToString(uc.whole.Sum(nil))
+}
+
+func (uc *UploadChecksum) addPart(part JournalPart) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	uc.parts[part.PartId] = part
+}
+
+// Compare the size and parts of a closed file with what was uploaded
+func (uc *UploadChecksum) compare(desc *DxFileParts, size int64) error {
+	if desc.Size != size {
+		return fmt.Errorf("the platform has %d bytes, %d were written", desc.Size, size)
+	}
+
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	if len(desc.Parts) != len(uc.parts) {
+		return fmt.Errorf("the platform has %d parts, %d were uploaded", len(desc.Parts), len(uc.parts))
+	}
+	for partId, part := range uc.parts {
+		dxPart, ok := desc.Parts[strconv.Itoa(partId)]
+		if !ok {
+			return fmt.Errorf("part %d is missing on the platform", partId)
+		}
+		if dxPart.Size != part.Size || dxPart.Md5 != part.Md5 {
+			return fmt.Errorf("part %d has size %d and md5 %s on the platform, %d bytes with md5 %s were uploaded",
+				partId, dxPart.Size, dxPart.Md5, part.Size, part.Md5)
+		}
+	}
+	return nil
+}
+
+// Compare a file that was just closed with what was written. A mismatch is
+// logged, and the file is reported as a failed upload. If the platform cannot
+// be asked, the file is assumed to be good.
+func (fsys *Filesys) verifyUpload(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	inode int64,
+	fileId string,
+	size int64,
+	sum *UploadChecksum) error {
+	if sum == nil {
+		return nil
+	}
+	desc, err := DxDescribeFileParts(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, fileId)
+	if err != nil {
+		fsys.log("Could not verify the upload of %s: %s", fileId, err.Error())
+		return nil
+	}
+	if err := sum.compare(desc, size); err != nil {
+		err = fmt.Errorf("checksum mismatch for %s, %s", fileId, err.Error())
+		fsys.log("ERROR: %s", err.Error())
+
+		fsys.mutex.Lock()
+		fsys.checksumFailures[inode] = checksumFailure{fileId: fileId, err: err}
+		fsys.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// With the -md5Property flag, record the md5 of a file that was fully
+// written in a property. This is done before the file is closed, so the
+// closed file always has it.
+func (fsys *Filesys) setMd5Property(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	fileId string,
+	sum *UploadChecksum) error {
+	if !fsys.options.Md5Property || sum == nil {
+		return nil
+	}
+	md5Hex := sum.Md5()
+	return fsys.ops.DxSetProperties(ctx, httpClient, projId, fileId,
+		map[string](*string){Md5Property: &md5Hex})
+}
+
+// Show the md5 property of a closed file in the metadata database too
+//
+// Note: the global lock must be held
+func (fsys *Filesys) recordMd5Property(ctx context.Context, oph *OpHandle, inode int64, sum *UploadChecksum) error {
+	if !fsys.options.Md5Property || sum == nil {
+		return nil
+	}
+	file, _, err := fsys.lookupFileByInode(ctx, oph, inode)
+	if err != nil {
+		return err
+	}
+	if file.Properties == nil {
+		file.Properties = make(map[string]string)
+	}
+	file.Properties[Md5Property] = sum.Md5()
+	return fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file)
+}
+
+// The md5 of a file read sequentially, from the first byte to the last.
+// Reads that skip, or go back, stop the computation; reading again from
+// the beginning restarts it.
+type ReadChecksum struct {
+	mutex  sync.Mutex
+	whole  hash.Hash
+	next   int64 // offset of the next sequential read
+	broken bool  // the file is not read sequentially, or was fully read
+
+	// the md5 the platform records for the file, if any
+	projId   string
+	expected string
+}
+
+// The outcome of reading a file to the end
+type readChecksumResult struct {
+	fileId   string
+	md5      string
+	expected string
+}
+
+func NewReadChecksum(projId string, expected string) *ReadChecksum {
+	return &ReadChecksum{
+		whole:    md5.New(),
+		projId:   projId,
+		expected: expected,
+	}
+}
+
+// Add the data of a read. Returns the md5 of the file, once the last byte
+// was read sequentially.
+func (rc *ReadChecksum) Update(offset int64, data []byte, size int64) (string, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if offset == 0 {
+		rc.whole.Reset()
+		rc.next = 0
+		rc.broken = false
+	}
+	if rc.broken {
+		return "", false
+	}
+	if offset != rc.next {
+		rc.broken = true
+		return "", false
+	}
+	rc.whole.Write(data)
+	rc.next += int64(len(data))
+	if rc.next < size {
+		return "", false
+	}
+	rc.broken = true
+	return hex.EncodeToString(rc.whole.Sum(nil)), true
+}
+
+// The value of the base.checksum attribute
+func (r readChecksumResult) String() string {
+	switch {
+	case r.expected == "":
+		return r.md5 + " unverified"
+	case r.expected == r.md5:
+		return r.md5 + " verified"
+	default:
+		return fmt.Sprintf("%s mismatch, expected %s", r.md5, r.expected)
+	}
+}
+
+// The md5 the platform has for a file. This is the md5 property, and if it
+// is missing, the md5 of the only part of a single part file.
+func (fsys *Filesys) platformMd5(ctx context.Context, fh *FileHandle) string {
+	if fh.readChecksum.expected != "" {
+		return fh.readChecksum.expected
+	}
+	httpClient := <-fsys.httpClientPool
+	desc, err := DxDescribeFileParts(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, fh.readChecksum.projId, fh.Id)
+	fsys.httpClientPool <- httpClient
+	if err != nil {
+		fsys.log("Could not describe the parts of %s: %s", fh.Id, err.Error())
+		return ""
+	}
+	if len(desc.Parts) != 1 {
+		return ""
+	}
+	for _, part := range desc.Parts {
+		return part.Md5
+	}
+	return ""
+}
+
+// Check the md5 of a file read sequentially to the end. A mismatch is
+// logged, and reported by the base.checksum attribute. With the
+// -strictChecksum flag, the last read fails with EIO.
+func (fsys *Filesys) verifyRead(ctx context.Context, fh *FileHandle, offset int64, data []byte) error {
+	if fh.readChecksum == nil {
+		return nil
+	}
+	md5Hex, done := fh.readChecksum.Update(offset, data, fh.size)
+	if !done {
+		return nil
+	}
+	result := readChecksumResult{
+		fileId:   fh.Id,
+		md5:      md5Hex,
+		expected: fsys.platformMd5(ctx, fh),
+	}
+	fsys.mutex.Lock()
+	fsys.readChecksums[fh.inode] = result
+	fsys.mutex.Unlock()
+
+	if result.expected == "" || result.expected == result.md5 {
+		return nil
+	}
+	fsys.log("ERROR: checksum mismatch reading %s (inode=%d), the md5 is %s, the platform has %s",
+		fh.Id, fh.inode, result.md5, result.expected)
+	if fsys.options.StrictChecksum {
+		return fuse.EIO
+	}
+	return nil
+}
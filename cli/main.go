@@ -33,10 +33,51 @@ type Config struct {
 
 var progName = filepath.Base(os.Args[0])
 
+// Write buffers need room for a few parts of the initial size
+const minWriteBufferMemoryMiB = 64
+
+// A flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func stringListFlag(name string, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+// Commands sent to a running filesystem
+type clientCommand struct {
+	name  string
+	args  string
+	descr string
+}
+
+var clientCommands = []clientCommand{
+	{"cp", "SRC DST", "Clone a file or folder into a different project, without copying data"},
+	{"trash", "list|restore|purge PATH [BATCH|DAYS]", "List, restore, or purge the trash of the project containing PATH"},
+	{"wait", "", "Wait until the files that are being closed in the background are closed"},
+	{"syncAll", "PATH", "Wait until every file under directory PATH is closed on the platform, and list those that are not"},
+	{"orphans", "list|close|remove [FILE-ID|all]", "List, close, or remove the files left open by a previous mount"},
+	{"status", "[retry FILE-ID|all]", "List the uploads that are not closed, with their state, attempts, and last error, or retry the closes that failed"},
+	{"set", "[LIMIT VALUE]", "Show the transfer limits, or change one of uploadConcurrency, uploadBandwidth, downloadConcurrency, downloadBandwidth (MiB/s)"},
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage:\n")
 	fmt.Fprintf(os.Stderr, "    %s [options] MOUNTPOINT PROJECT1 PROJECT2 ...\n", progName)
 	fmt.Fprintf(os.Stderr, "    %s [options] MOUNTPOINT manifest.json\n", progName)
+	for _, c := range clientCommands {
+		fmt.Fprintf(os.Stderr, "    %s %s %s\n", progName, c.name, c.args)
+	}
 	fmt.Fprintf(os.Stderr, "options:\n")
 	// Hide experimental options
 	flag.VisitAll(func(f *flag.Flag) {
@@ -49,19 +90,108 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "A project can be specified by its ID or name. The manifest is a JSON\n")
 	fmt.Fprintf(os.Stderr, "file describing the initial filesystem structure.\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "commands, sent to a mounted filesystem:\n")
+	for _, c := range clientCommands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n\t%s\n", c.name, c.args, c.descr)
+	}
+}
+
+// A command name is a mount point if there is a directory by that name
+func isClientCommand(name string) bool {
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return false
+	}
+	for _, c := range clientCommands {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a command to the running filesystem, and print the reply
+func runClientCommand(args []string) {
+	switch args[0] {
+	case "trash":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		p, err := filepath.Abs(args[2])
+		if err != nil {
+			fmt.Printf("error resolving path %s (%s)\n", args[2], err.Error())
+			os.Exit(1)
+		}
+		args[2] = p
+	case "syncAll":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		p, err := filepath.Abs(args[1])
+		if err != nil {
+			fmt.Printf("error resolving path %s (%s)\n", args[1], err.Error())
+			os.Exit(1)
+		}
+		args[1] = p
+	case "cp":
+		if len(args) != 3 {
+			usage()
+			os.Exit(2)
+		}
+		// the server does not know our working directory
+		for i := 1; i < len(args); i++ {
+			p, err := filepath.Abs(args[i])
+			if err != nil {
+				fmt.Printf("error resolving path %s (%s)\n", args[i], err.Error())
+				os.Exit(1)
+			}
+			args[i] = p
+		}
+	}
+
+	cmdClient := dxfuse.NewCmdClient()
+	reply, err := cmdClient.Command(args)
+	if err != nil {
+		fmt.Printf("%s error: %s\n", args[0], err.Error())
+		os.Exit(1)
+	}
+	if reply != "" {
+		fmt.Println(reply)
+	}
 }
 
 var (
 	debugFuseFlag = flag.Bool("debugFuse", false, "Tap into FUSE debugging information")
 	daemon        = flag.Bool("daemon", false, "An internal flag, do not use it")
 	// fsSync        = flag.Bool("sync", false, "Sychronize the filesystem and exit")
-	help         = flag.Bool("help", false, "display program options")
-	readOnly     = flag.Bool("readOnly", true, "DEPRECATED, now the default behavior. Mount the filesystem in read-only mode")
-	limitedWrite = flag.Bool("limitedWrite", false, "Allow removing files and folders, creating files and appending to them. (Experimental, not recommended), default is read-only")
-	uid          = flag.Int("uid", -1, "User id (uid)")
-	gid          = flag.Int("gid", -1, "User group id (gid)")
-	verbose      = flag.Int("verbose", 0, "Enable verbose debugging")
-	version      = flag.Bool("version", false, "Print the version and exit")
+	help          = flag.Bool("help", false, "display program options")
+	asyncClose    = flag.Bool("asyncClose", false, "In limitedWrite mode, return from close once a file is uploaded, and close it on the platform in the background")
+	keepReplaced  = flag.Bool("keepReplaced", false, "When an existing file is rewritten in limitedWrite mode, keep the old version on the platform")
+	trash         = flag.Bool("trash", false, "In limitedWrite mode, move removed files and folders to a trash folder in their project, instead of deleting them")
+	removeOrphans = flag.Bool("removeOrphans", false, "In limitedWrite mode, remove the files left open on the platform by a previous mount that did not shut down cleanly")
+	readOnly      = flag.Bool("readOnly", true, "DEPRECATED, now the default behavior. Mount the filesystem in read-only mode")
+	limitedWrite  = flag.Bool("limitedWrite", false, "Allow removing files and folders, creating files and appending to them. (Experimental, not recommended), default is read-only")
+	posixMeta     = flag.Bool("posixMetadata", false, "Store mode and mtime changes in properties of the files, and apply them when the files are read")
+	md5Prop       = flag.Bool("md5Property", false, "In limitedWrite mode, store the md5 checksum of written files in the dxfuse.md5 property")
+	dedup         = flag.Bool("dedup", false, "In limitedWrite mode, replace written files with links to files with the same md5 in their project, or clones of such files in other mounted projects. Implies -md5Property")
+	verifyReads   = flag.Bool("verifyReads", false, "Compare the md5 checksum of files read from beginning to end with the platform")
+	strictSum     = flag.Bool("strictChecksum", false, "Fail the last read of a file read from beginning to end with EIO, if its md5 checksum does not match the platform. Implies -verifyReads")
+	tags          = stringListFlag("tag", "In limitedWrite mode, a tag to add to new files. May be repeated, and may contain the templates {jobId}, {hostname}, {mountTime}, {project}")
+	properties    = stringListFlag("property", "In limitedWrite mode, a property KEY=VALUE to set on new files. May be repeated, and the value may contain templates, as in -tag")
+	types         = stringListFlag("type", "In limitedWrite mode, a type to add to new files. May be repeated, and may contain templates, as in -tag")
+	mediaType     = flag.Bool("mediaType", false, "In limitedWrite mode, set the media type of new files from the extension of their name")
+	uid           = flag.Int("uid", -1, "User id (uid)")
+	gid           = flag.Int("gid", -1, "User group id (gid)")
+	verbose       = flag.Int("verbose", 0, "Enable verbose debugging")
+	writeBufMem   = flag.Int("writeBufferMemory", 0, "Memory for write buffers, in MiB. Writers wait when it is used up. The default is a quarter of the physical memory")
+	uploadConc    = flag.Int("uploadConcurrency", 0, "Number of parts uploaded concurrently, the default is 4")
+	uploadBw      = flag.Int("uploadBandwidth", 0, "Limit on the upload bandwidth, in MiB per second")
+	downloadConc  = flag.Int("downloadConcurrency", 0, "Limit on the number of concurrent prefetch downloads, the default is the number of prefetch threads")
+	downloadBw    = flag.Int("downloadBandwidth", 0, "Limit on the download bandwidth, in MiB per second")
+	retryTimeout  = flag.Int("retryTimeout", 0, "Seconds that reads and metadata operations wait for the platform to recover from an outage before failing, the default is 120. Other operations are held up meanwhile")
+	version       = flag.Bool("version", false, "Print the version and exit")
 )
 
 func lookupProject(dxEnv *dxda.DXEnvironment, projectIdOrName string) (string, error) {
@@ -279,6 +409,31 @@ func parseCmdLineArgs() Config {
 		usage()
 		os.Exit(2)
 	}
+	if *writeBufMem != 0 && *writeBufMem < minWriteBufferMemoryMiB {
+		fmt.Printf("-writeBufferMemory must be at least %d MiB\n", minWriteBufferMemoryMiB)
+		os.Exit(2)
+	}
+	if *uploadConc < 0 || *uploadConc > dxfuse.MaxUploadConcurrency {
+		fmt.Printf("-uploadConcurrency must be between 1 and %d\n", dxfuse.MaxUploadConcurrency)
+		os.Exit(2)
+	}
+	if *uploadBw < 0 || *downloadConc < 0 || *downloadBw < 0 {
+		fmt.Printf("Transfer limits cannot be negative\n")
+		os.Exit(2)
+	}
+	if *uploadBw > dxfuse.MaxBandwidthMiB || *downloadBw > dxfuse.MaxBandwidthMiB {
+		fmt.Printf("Bandwidth limits are at most %d MiB/s\n", dxfuse.MaxBandwidthMiB)
+		os.Exit(2)
+	}
+	if *retryTimeout < 0 {
+		fmt.Printf("-retryTimeout cannot be negative\n")
+		os.Exit(2)
+	}
+	defaultProps, err := dxfuse.ParseDefaultProperties(*properties)
+	if err != nil {
+		fmt.Printf("-property: %s\n", err.Error())
+		os.Exit(2)
+	}
 
 	numArgs := flag.NArg()
 	if numArgs < 2 {
@@ -286,6 +441,11 @@ func parseCmdLineArgs() Config {
 		os.Exit(2)
 	}
 	mountpoint := flag.Arg(0)
+	absMountpoint, err := filepath.Abs(mountpoint)
+	if err != nil {
+		fmt.Printf("error resolving mountpoint %s (%s)\n", mountpoint, err.Error())
+		os.Exit(1)
+	}
 
 	uid, gid := initUidGid()
 	options := dxfuse.Options{
@@ -294,6 +454,27 @@ func parseCmdLineArgs() Config {
 		VerboseLevel: *verbose,
 		Uid:          uid,
 		Gid:          gid,
+
+		KeepReplacedFiles:   *keepReplaced,
+		PosixMetadata:       *posixMeta,
+		Md5Property:         *md5Prop || *dedup,
+		Dedup:               *dedup,
+		VerifyReads:         *verifyReads || *strictSum,
+		StrictChecksum:      *strictSum,
+		DefaultTags:         *tags,
+		DefaultProperties:   defaultProps,
+		DefaultTypes:        *types,
+		MediaType:           *mediaType,
+		AsyncClose:          *asyncClose,
+		RemoveOrphans:       *removeOrphans,
+		WriteBufferMemory:   int64(*writeBufMem) * dxfuse.MiB,
+		UploadConcurrency:   *uploadConc,
+		UploadBandwidth:     int64(*uploadBw) * dxfuse.MiB,
+		DownloadConcurrency: *downloadConc,
+		DownloadBandwidth:   int64(*downloadBw) * dxfuse.MiB,
+		RetryTimeout:        time.Duration(*retryTimeout) * time.Second,
+		Trash:               *trash,
+		MountPoint:          absMountpoint,
 	}
 
 	dxEnv, _, err := dxda.GetDxEnvironment()
@@ -400,9 +581,70 @@ func buildDaemonCommandLine(cfg Config, fullManifestPath string) []string {
 		args := []string{"-gid", strconv.FormatInt(int64(*gid), 10)}
 		daemonArgs = append(daemonArgs, args...)
 	}
+	if *keepReplaced {
+		daemonArgs = append(daemonArgs, "-keepReplaced")
+	}
 	if *limitedWrite {
 		daemonArgs = append(daemonArgs, "-limitedWrite")
 	}
+	if *posixMeta {
+		daemonArgs = append(daemonArgs, "-posixMetadata")
+	}
+	if *md5Prop {
+		daemonArgs = append(daemonArgs, "-md5Property")
+	}
+	if *dedup {
+		daemonArgs = append(daemonArgs, "-dedup")
+	}
+	if *verifyReads {
+		daemonArgs = append(daemonArgs, "-verifyReads")
+	}
+	if *strictSum {
+		daemonArgs = append(daemonArgs, "-strictChecksum")
+	}
+	for _, tag := range *tags {
+		daemonArgs = append(daemonArgs, "-tag", tag)
+	}
+	for _, prop := range *properties {
+		daemonArgs = append(daemonArgs, "-property", prop)
+	}
+	for _, t := range *types {
+		daemonArgs = append(daemonArgs, "-type", t)
+	}
+	if *mediaType {
+		daemonArgs = append(daemonArgs, "-mediaType")
+	}
+	if *trash {
+		daemonArgs = append(daemonArgs, "-trash")
+	}
+	if *asyncClose {
+		daemonArgs = append(daemonArgs, "-asyncClose")
+	}
+	if *removeOrphans {
+		daemonArgs = append(daemonArgs, "-removeOrphans")
+	}
+	if *writeBufMem != 0 {
+		args := []string{"-writeBufferMemory", strconv.Itoa(*writeBufMem)}
+		daemonArgs = append(daemonArgs, args...)
+	}
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"-uploadConcurrency", *uploadConc},
+		{"-uploadBandwidth", *uploadBw},
+		{"-downloadConcurrency", *downloadConc},
+		{"-downloadBandwidth", *downloadBw},
+	}
+	for _, l := range limits {
+		if l.value != 0 {
+			daemonArgs = append(daemonArgs, l.name, strconv.Itoa(l.value))
+		}
+	}
+	if *retryTimeout != 0 {
+		args := []string{"-retryTimeout", strconv.Itoa(*retryTimeout)}
+		daemonArgs = append(daemonArgs, args...)
+	}
 	if *uid != -1 {
 		args := []string{"-uid", strconv.FormatInt(int64(*uid), 10)}
 		daemonArgs = append(daemonArgs, args...)
@@ -489,6 +731,10 @@ func main() {
 	// parse command line options
 	flag.Usage = usage
 	flag.Parse()
+	if flag.NArg() > 0 && isClientCommand(flag.Arg(0)) {
+		runClientCommand(flag.Args())
+		os.Exit(0)
+	}
 	cfg := parseCmdLineArgs()
 	validateConfig(cfg)
 	logFile := filepath.Join(dxfuse.MakeFSBaseDir(), dxfuse.LogFile)
@@ -0,0 +1,201 @@
+package dxfuse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dnanexus/dxda"
+)
+
+const (
+	// Close up to 8 files concurrently. Most of the time is spent waiting
+	// for the platform to finalize the files.
+	maxCloseRoutines = 8
+)
+
+// The upload state of a file, reported by the base.uploadState xattr
+const (
+	UploadStateUploading = "uploading"
+	UploadStateQueued    = "queued"
+	UploadStateClosing   = "closing"
+	UploadStateClosed    = "closed"
+	UploadStateFailed    = "failed"
+)
+
+type CloseRequest struct {
+	inode  int64
+	fileId string
+
+	// an older version of the file, to be removed once this one is closed
+	replacedId string
+
+	// what was written, to verify the closed file
+	size     int64
+	checksum *UploadChecksum
+}
+
+type closeStatus struct {
+	fileId string
+	state  string
+	err    error
+}
+
+// Closes files on the platform in the background. When a file has been
+// fully uploaded, the application's close returns, and the file is queued
+// here. The file keeps the queued, closing, or failed state until the
+// platform reports it as closed.
+type Closer struct {
+	fsys *Filesys
+
+	mutex   sync.Mutex
+	cond    *sync.Cond // signaled when the queue, or the status of a file, changes
+	queue   []CloseRequest
+	status  map[int64]*closeStatus
+	pending int
+	stopped bool
+
+	wg sync.WaitGroup
+}
+
+func NewCloser(fsys *Filesys) *Closer {
+	cl := &Closer{
+		fsys:   fsys,
+		status: make(map[int64]*closeStatus),
+	}
+	cl.cond = sync.NewCond(&cl.mutex)
+
+	cl.wg.Add(maxCloseRoutines)
+	for i := 0; i < maxCloseRoutines; i++ {
+		go cl.closeWorker()
+	}
+	return cl
+}
+
+// write a log message, and add a header
+func (cl *Closer) log(a string, args ...interface{}) {
+	LogMsg("closer", a, args...)
+}
+
+// Close all the queued files, and stop
+func (cl *Closer) Shutdown() {
+	cl.mutex.Lock()
+	cl.stopped = true
+	cl.cond.Broadcast()
+	cl.mutex.Unlock()
+	cl.wg.Wait()
+}
+
+func (cl *Closer) closeWorker() {
+	defer cl.wg.Done()
+
+	// reuse this http client
+	httpClient := dxda.NewHttpClient()
+	for {
+		cl.mutex.Lock()
+		for len(cl.queue) == 0 && !cl.stopped {
+			cl.cond.Wait()
+		}
+		if len(cl.queue) == 0 {
+			cl.mutex.Unlock()
+			return
+		}
+		req := cl.queue[0]
+		cl.queue = cl.queue[1:]
+		cl.status[req.inode].state = UploadStateClosing
+		cl.mutex.Unlock()
+
+		err := cl.fsys.closeQueuedFile(context.TODO(), httpClient, req)
+
+		cl.mutex.Lock()
+		if err != nil {
+			cl.log("Error closing %s, %s", req.fileId, err.Error())
+			cl.status[req.inode].state = UploadStateFailed
+			cl.status[req.inode].err = err
+		} else {
+			delete(cl.status, req.inode)
+		}
+		cl.pending--
+		cl.cond.Broadcast()
+		cl.mutex.Unlock()
+	}
+}
+
+// Queue a file to be closed
+func (cl *Closer) Enqueue(req CloseRequest) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.status[req.inode] = &closeStatus{
+		fileId: req.fileId,
+		state:  UploadStateQueued,
+	}
+	cl.queue = append(cl.queue, req)
+	cl.pending++
+	cl.cond.Broadcast()
+}
+
+// The state of a file that has not been closed yet. Returns false if the
+// file is not tracked here.
+func (cl *Closer) Status(inode int64, fileId string) (string, bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	st, ok := cl.status[inode]
+	if !ok || st.fileId != fileId {
+		return "", false
+	}
+	return st.state, true
+}
+
+// The error of a file that failed to close, or nil
+func (cl *Closer) Error(inode int64, fileId string) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	st, ok := cl.status[inode]
+	if !ok || st.fileId != fileId {
+		return nil
+	}
+	return st.err
+}
+
+// Wait until none of the files is queued, or being closed.
+func (cl *Closer) WaitFor(inodes map[int64]bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	for {
+		busy := false
+		for inode, st := range cl.status {
+			if inodes[inode] && st.state != UploadStateFailed {
+				busy = true
+				break
+			}
+		}
+		if !busy {
+			return
+		}
+		cl.cond.Wait()
+	}
+}
+
+// Wait until all the queued files have been closed, or have failed. Returns
+// an error listing the files that failed.
+func (cl *Closer) Wait() error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	for cl.pending > 0 {
+		cl.cond.Wait()
+	}
+
+	var failed []string
+	for _, st := range cl.status {
+		if st.state == UploadStateFailed {
+			failed = append(failed, fmt.Sprintf("%s (%s)", st.fileId, st.err.Error()))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("%d files failed to close: %s", len(failed), strings.Join(failed, ", "))
+}
@@ -2,8 +2,11 @@ package dxfuse
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type CmdClient struct {
@@ -15,8 +18,19 @@ func NewCmdClient() *CmdClient {
 	return &CmdClient{}
 }
 
+// Connect to the command server of the running filesystem. Its
+// port is recorded in the dxfuse directory.
+func (client *CmdClient) dial() (*rpc.Client, error) {
+	data, err := ioutil.ReadFile(filepath.Join(MakeFSBaseDir(), CmdPortFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not find the dxfuse server, is the filesystem mounted? (%s)", err.Error())
+	}
+	port := strings.TrimSpace(string(data))
+	return rpc.Dial("tcp", fmt.Sprintf("localhost:%s", port))
+}
+
 func (client *CmdClient) Sync() {
-	rpcClient, err := rpc.Dial("tcp", fmt.Sprintf(":%d", CmdPort))
+	rpcClient, err := client.dial()
 	if err != nil {
 		fmt.Printf("could not connect to the dxfuse server: %s", err.Error())
 		os.Exit(1)
@@ -31,3 +45,18 @@ func (client *CmdClient) Sync() {
 		os.Exit(1)
 	}
 }
+
+// Send a command to the server, and wait for the reply
+func (client *CmdClient) Command(args []string) (string, error) {
+	rpcClient, err := client.dial()
+	if err != nil {
+		return "", err
+	}
+	defer rpcClient.Close()
+
+	var reply string
+	if err := rpcClient.Call("CmdServerBox.Command", args, &reply); err != nil {
+		return "", err
+	}
+	return reply, nil
+}
@@ -1,15 +1,21 @@
-/* Accept commands from the dxfuse_tools program. The only command
-* right now is sync, but this is the place to implement additional
+/* Accept commands from the dxfuse command line tool, for
+* example, sync and cp. This is the place to implement additional
 * ones to come in the future.
  */
 package dxfuse
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
-	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"golang.org/x/sync/semaphore"
 )
@@ -20,6 +26,7 @@ var CmdPort = GetFreePort()
 type CmdServer struct {
 	options Options
 	sybx    *SyncDbDx
+	fsys    *Filesys
 	inbound *net.TCPListener
 }
 
@@ -28,10 +35,11 @@ type CmdServerBox struct {
 	cmdSrv *CmdServer
 }
 
-func NewCmdServer(options Options, sybx *SyncDbDx) *CmdServer {
+func NewCmdServer(options Options, sybx *SyncDbDx, fsys *Filesys) *CmdServer {
 	cmdServer := &CmdServer{
 		options: options,
 		sybx:    sybx,
+		fsys:    fsys,
 		inbound: nil,
 	}
 	return cmdServer
@@ -56,6 +64,8 @@ func GetFreePort() (int) {
         return l.Addr().(*net.TCPAddr).Port
 }
 
+// The port is chosen by the daemon, it is recorded in the dxfuse
+// directory, where clients can find it.
 func (cmdSrv *CmdServer) Init() {
 	addy, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", CmdPort))
 	if err != nil {
@@ -68,6 +78,11 @@ func (cmdSrv *CmdServer) Init() {
 	}
 	cmdSrv.inbound = inbound
 
+	portFile := filepath.Join(MakeFSBaseDir(), CmdPortFile)
+	if err := ioutil.WriteFile(portFile, []byte(strconv.Itoa(CmdPort)), 0600); err != nil {
+		log.Fatal(err)
+	}
+
 	cmdSrvBox := &CmdServerBox{
 		cmdSrv: cmdSrv,
 	}
@@ -79,6 +94,7 @@ func (cmdSrv *CmdServer) Init() {
 
 func (cmdSrv *CmdServer) Close() {
 	cmdSrv.inbound.Close()
+	os.Remove(filepath.Join(MakeFSBaseDir(), CmdPortFile))
 }
 
 // Only allow one sync operation at a time
@@ -91,6 +107,9 @@ func (box *CmdServerBox) GetLine(arg string, reply *bool) error {
 	cmdSrv.log("Received line %s", arg)
 	switch arg {
 	case "sync":
+		if cmdSrv.sybx == nil {
+			return errors.New("the sync daemon is not running")
+		}
 		// Error out if another sync operation has been run by the cmd client
 		// https://stackoverflow.com/questions/45208536/good-way-to-return-on-locked-mutex-in-go
 		if !sem.TryAcquire(1) {
@@ -106,3 +125,104 @@ func (box *CmdServerBox) GetLine(arg string, reply *bool) error {
 	*reply = true
 	return nil
 }
+
+// Convert an absolute path on the local machine, to a path relative to
+// the root of the filesystem.
+func (cmdSrv *CmdServer) mountPath(localPath string) (string, error) {
+	rel, err := filepath.Rel(cmdSrv.options.MountPoint, localPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not under the mount point %s", localPath, cmdSrv.options.MountPoint)
+	}
+	return filepath.Join("/", rel), nil
+}
+
+// Execute a command with arguments. The first argument is the
+// command name. The reply is displayed to the user.
+func (box *CmdServerBox) Command(args []string, reply *string) error {
+	cmdSrv := box.cmdSrv
+	cmdSrv.log("Received command %v", args)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	switch args[0] {
+	case "cp":
+		if len(args) != 3 {
+			return errors.New("cp requires a source and a destination")
+		}
+		srcPath, err := cmdSrv.mountPath(args[1])
+		if err != nil {
+			return err
+		}
+		dstPath, err := cmdSrv.mountPath(args[2])
+		if err != nil {
+			return err
+		}
+		if err := cmdSrv.fsys.CmdClone(context.TODO(), srcPath, dstPath); err != nil {
+			cmdSrv.log("cp %s %s failed: %s", srcPath, dstPath, err.Error())
+			return err
+		}
+	case "trash":
+		if len(args) < 3 {
+			return errors.New("trash requires a sub-command and a path")
+		}
+		path, err := cmdSrv.mountPath(args[2])
+		if err != nil {
+			return err
+		}
+		msg, err := cmdSrv.fsys.CmdTrash(context.TODO(), args[1], path, args[3:])
+		if err != nil {
+			cmdSrv.log("trash %s %s failed: %s", args[1], path, err.Error())
+			return err
+		}
+		*reply = msg
+	case "syncAll":
+		if len(args) != 2 {
+			return errors.New("syncAll requires a path")
+		}
+		path, err := cmdSrv.mountPath(args[1])
+		if err != nil {
+			return err
+		}
+		msg, err := cmdSrv.fsys.CmdSyncAll(context.TODO(), path)
+		if err != nil {
+			cmdSrv.log("syncAll %s failed: %s", path, err.Error())
+			return err
+		}
+		*reply = msg
+	case "orphans":
+		if len(args) < 2 {
+			return errors.New("orphans requires a sub-command")
+		}
+		msg, err := cmdSrv.fsys.CmdOrphans(context.TODO(), args[1], args[2:])
+		if err != nil {
+			cmdSrv.log("orphans %s failed: %s", args[1], err.Error())
+			return err
+		}
+		*reply = msg
+	case "status":
+		msg, err := cmdSrv.fsys.CmdStatus(context.TODO(), args[1:])
+		if err != nil {
+			cmdSrv.log("status %v failed: %s", args[1:], err.Error())
+			return err
+		}
+		*reply = msg
+	case "set":
+		msg, err := cmdSrv.fsys.CmdSet(args[1:])
+		if err != nil {
+			cmdSrv.log("set %v failed: %s", args[1:], err.Error())
+			return err
+		}
+		*reply = msg
+	case "wait":
+		if err := cmdSrv.fsys.CmdWait(); err != nil {
+			cmdSrv.log("wait failed: %s", err.Error())
+			return err
+		}
+		*reply = "all files are closed"
+	default:
+		cmdSrv.log("Unknown command %s", args[0])
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package dxfuse
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const (
+	// Smaller files fit in a single part. Searching for them costs about
+	// as much as the upload saves.
+	minDedupFileSize = InitialUploadPartSize
+
+	// How many files with the same md5 are considered
+	maxDedupCandidates = 10
+)
+
+// With the -dedup flag, a file that was fully written is looked up by its md5
+// and size, first in its own project, and then in the other mounted projects.
+// The md5 of a file is known from its dxfuse.md5 property, so only files
+// written with -md5Property, or -dedup, can be found.
+//
+// A DNAnexus object lives in a single folder of a project, so a duplicate in
+// the same project cannot be placed in a second folder. The new file becomes
+// a hard link to it instead, in the mount only, and the upload is removed
+// instead of being closed. A duplicate in another project is cloned into the
+// folder of the new file, under the same name, and the upload is removed.
+//
+// The property can be set by anyone, so it only points to candidates. A
+// candidate is used only if its parts have the same sizes and md5s as the
+// parts uploaded, or if it has a single part with the md5 of the file.
+//
+// Returns the id of the file the new file now refers to, or an empty string
+// if the file should be closed normally.
+func (fsys *Filesys) dedupFile(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	size int64,
+	sum *UploadChecksum) string {
+	if !fsys.options.Dedup || sum == nil || size < minDedupFileSize {
+		return ""
+	}
+
+	// The new version of a rewritten file takes the place of the old one
+	// when it is closed, it cannot be a link.
+	fsys.mutex.Lock()
+	rewrite := fsys.rewrites[file.Inode].fileId == file.Id
+	fsys.mutex.Unlock()
+	if !rewrite {
+		for _, dup := range fsys.findDuplicates(ctx, httpClient, file.ProjId, file, size, sum) {
+			if err := fsys.linkToDuplicate(ctx, httpClient, file, dup); err != nil {
+				fsys.log("Could not replace %s with a link to %s, %s", file.Id, dup.Id, err.Error())
+				continue
+			}
+			fsys.log("File %s is a duplicate of %s, replaced it with a link", file.Id, dup.Id)
+			return dup.Id
+		}
+	}
+
+	var projIds []string
+	for projId, _ := range fsys.projId2Desc {
+		if projId != file.ProjId {
+			projIds = append(projIds, projId)
+		}
+	}
+	sort.Strings(projIds)
+
+	for _, projId := range projIds {
+		for _, dup := range fsys.findDuplicates(ctx, httpClient, projId, file, size, sum) {
+			if err := fsys.replaceWithClone(ctx, httpClient, file, dup); err != nil {
+				fsys.log("Could not replace %s with a clone of %s:%s, %s",
+					file.Id, dup.ProjId, dup.Id, err.Error())
+				continue
+			}
+			fsys.log("File %s is a duplicate of %s:%s, replaced it with a clone",
+				file.Id, dup.ProjId, dup.Id)
+			return dup.Id
+		}
+	}
+	return ""
+}
+
+// Search a project for closed files with the content that was written
+func (fsys *Filesys) findDuplicates(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	file File,
+	size int64,
+	sum *UploadChecksum) []DxDescribeDataObject {
+	candidates, err := DxFindFilesByProperty(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId,
+		Md5Property, sum.Md5(), maxDedupCandidates)
+	if err != nil {
+		fsys.log("Error searching project %s for duplicates of %s: %s", projId, file.Id, err.Error())
+		return nil
+	}
+	var dups []DxDescribeDataObject
+	for _, dup := range candidates {
+		if dup.Id == file.Id || dup.Size != size {
+			continue
+		}
+		if !fsys.sameContent(ctx, httpClient, dup, size, sum) {
+			continue
+		}
+		dups = append(dups, dup)
+	}
+	return dups
+}
+
+// Does a file on the platform have the content that was written, judging by
+// the md5 of its parts
+func (fsys *Filesys) sameContent(
+	ctx context.Context,
+	httpClient *http.Client,
+	dup DxDescribeDataObject,
+	size int64,
+	sum *UploadChecksum) bool {
+	desc, err := DxDescribeFileParts(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, dup.ProjId, dup.Id)
+	if err != nil {
+		fsys.log("Error describing the parts of %s:%s: %s", dup.ProjId, dup.Id, err.Error())
+		return false
+	}
+	if part, ok := desc.Parts["1"]; ok && len(desc.Parts) == 1 {
+		if desc.Size == size && part.Size == size && part.Md5 == sum.Md5() {
+			return true
+		}
+	}
+	if err := sum.compare(desc, size); err != nil {
+		if fsys.options.Verbose {
+			fsys.log("File %s:%s has the md5 property of the upload, but not its content, %s",
+				dup.ProjId, dup.Id, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// Make an upload a hard link to a file in the same project, and remove the
+// upload. As with any hard link, the names share the tags and properties, so
+// those of the upload are added to the file first.
+func (fsys *Filesys) linkToDuplicate(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	dup DxDescribeDataObject) error {
+	oDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if err != nil {
+		return err
+	}
+	if err := fsys.copyTagsAndProperties(ctx, httpClient, file.ProjId, oDesc, dup.Id); err != nil {
+		return err
+	}
+	if err := fsys.removeObjects(ctx, httpClient, file.ProjId, oDesc.Folder, []string{file.Id}); err != nil {
+		return err
+	}
+
+	lDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, dup.Id)
+	if err != nil {
+		fsys.log("Error describing %s: %s", dup.Id, err.Error())
+		lDesc = dup
+		lDesc.Tags = oDesc.Tags
+		lDesc.Properties = oDesc.Properties
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if err := fsys.mdb.LinkDuplicate(ctx, oph, file.Inode, file.Id, lDesc); err != nil {
+		fsys.log("database error in deduplicating file %s: %s", file.Id, err.Error())
+	}
+	return nil
+}
+
+// Clone a file into the place of an upload, and remove the upload. If any
+// step fails, the clone is removed, and the upload is left as it was.
+func (fsys *Filesys) replaceWithClone(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	dup DxDescribeDataObject) error {
+	// The name and folder on the platform may be different from what
+	// we show; for example, for files in faux directories.
+	oDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if err != nil {
+		return err
+	}
+	exists, err := fsys.ops.DxClone(ctx, httpClient, dup.ProjId, []string{dup.Id}, nil,
+		file.ProjId, oDesc.Folder)
+	if err != nil {
+		return err
+	}
+	if len(exists) > 0 {
+		return fmt.Errorf("%s is already in project %s", dup.Id, file.ProjId)
+	}
+
+	err = nil
+	if dup.Name != oDesc.Name {
+		err = fsys.ops.DxRename(ctx, httpClient, file.ProjId, dup.Id, oDesc.Name)
+	}
+	if err == nil {
+		err = fsys.copyTagsAndProperties(ctx, httpClient, file.ProjId, oDesc, dup.Id)
+	}
+	if err == nil {
+		err = fsys.removeObjects(ctx, httpClient, file.ProjId, oDesc.Folder, []string{file.Id})
+	}
+	if err != nil {
+		if rmErr := fsys.ops.DxRemoveObjects(ctx, httpClient, file.ProjId, []string{dup.Id}); rmErr != nil {
+			fsys.log("Error removing clone %s from project %s: %s", dup.Id, file.ProjId, rmErr.Error())
+		}
+		return err
+	}
+
+	// The clone has the tags and properties of both files
+	cDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, dup.Id)
+	if err != nil {
+		fsys.log("Error describing clone %s: %s", dup.Id, err.Error())
+		cDesc = oDesc
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if fsys.rewrites[file.Inode].fileId == file.Id {
+		// The new version of a rewritten file. The inode refers to the old
+		// version, until the clone takes its place.
+		if err := fsys.mdb.JournalRemove(oph, file.Id); err != nil {
+			fsys.log("database error in deduplicating file %s: %s", file.Id, err.Error())
+		}
+		return nil
+	}
+	if err := fsys.mdb.UpdateFileDeduped(ctx, oph, file.Inode, file.Id, dup.Id); err != nil {
+		fsys.log("database error in deduplicating file %s: %s", file.Id, err.Error())
+		return nil
+	}
+	file.Tags = cDesc.Tags
+	file.Properties = cDesc.Properties
+	if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file); err != nil {
+		fsys.log("database error in deduplicating file %s: %s", file.Id, err.Error())
+	}
+	return nil
+}
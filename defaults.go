@@ -0,0 +1,298 @@
+package dxfuse
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dnanexus/dxda"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Kinds of defaults a directory can have
+const (
+	defaultKindTag  = "tag"
+	defaultKindProp = "prop"
+	defaultKindType = "type"
+)
+
+// New files are given tags, properties, and types from two sources: the
+// -tag, -property, and -type flags, which apply to the whole mount, and the
+// default.tag.NAME, default.prop.KEY, and default.type.NAME extended
+// attributes of the directories above them. Tags and types are collected
+// from all the sources. For properties, the nearest directory wins over its
+// ancestors, and directories win over the flags.
+//
+// Values may contain templates, which are expanded when a file is created:
+//   {jobId}      the job dxfuse runs in, empty outside a job
+//   {hostname}   the name of the machine
+//   {mountTime}  when the filesystem was mounted, in RFC3339 format
+//   {project}    the project the file is created in
+//
+// Directory defaults are kept in the metadata database, and last until the
+// filesystem is unmounted.
+func templateVars(dxEnv dxda.DXEnvironment, mountTime time.Time) map[string]string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+	return map[string]string{
+		"{jobId}":     dxEnv.DxJobId,
+		"{hostname}":  hostname,
+		"{mountTime}": mountTime.UTC().Format(time.RFC3339),
+	}
+}
+
+func (fsys *Filesys) expandTemplate(s string, projId string) string {
+	var oldnew []string
+	for key, value := range fsys.templateVars {
+		oldnew = append(oldnew, key, value)
+	}
+	oldnew = append(oldnew, "{project}", projId)
+	return strings.NewReplacer(oldnew...).Replace(s)
+}
+
+// The metadata a new file in a directory is created with: the tags,
+// properties, and types from the defaults, with the templates expanded. With
+// the -mediaType flag, also the media type that matches the extension of
+// the name.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) newFileMetadata(ctx context.Context, oph *OpHandle, dir Dir, name string) (NewFileMetadata, error) {
+	meta := NewFileMetadata{
+		Properties: make(map[string]string),
+	}
+	if fsys.options.MediaType {
+		meta.Media = mediaType(name)
+	}
+	addUnique := func(list []string, value string) []string {
+		value = fsys.expandTemplate(value, dir.ProjId)
+		if value == "" {
+			return list
+		}
+		for _, v := range list {
+			if v == value {
+				return list
+			}
+		}
+		return append(list, value)
+	}
+
+	for _, tag := range fsys.options.DefaultTags {
+		meta.Tags = addUnique(meta.Tags, tag)
+	}
+	for _, t := range fsys.options.DefaultTypes {
+		meta.Types = addUnique(meta.Types, t)
+	}
+	for key, value := range fsys.options.DefaultProperties {
+		meta.Properties[key] = fsys.expandTemplate(value, dir.ProjId)
+	}
+
+	// from the root down to the directory itself
+	defaults, err := fsys.mdb.AncestorDirDefaults(oph, dir.FullPath)
+	if err != nil {
+		return NewFileMetadata{}, err
+	}
+	for _, d := range defaults {
+		switch d.Kind {
+		case defaultKindTag:
+			meta.Tags = addUnique(meta.Tags, d.Name)
+		case defaultKindType:
+			meta.Types = addUnique(meta.Types, d.Name)
+		case defaultKindProp:
+			meta.Properties[d.Name] = fsys.expandTemplate(d.Value, dir.ProjId)
+		}
+	}
+	return meta, nil
+}
+
+// The media type of a file, guessed from its extension. Parameters, such
+// as the charset of text files, are dropped.
+func mediaType(name string) string {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return ""
+	}
+	mt, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// split a directory attribute name, "tag.NAME", "prop.KEY", or "type.NAME"
+func (fsys *Filesys) dirXattrParseName(attrName string) (string, string, error) {
+	kind, name, err := fsys.xattrParseName(attrName)
+	if err != nil {
+		return "", "", err
+	}
+	if (kind != defaultKindTag && kind != defaultKindProp && kind != defaultKindType) || name == "" {
+		fsys.log("directory attributes must start with one of {%s.%s., %s.%s., %s.%s.}",
+			XATTR_DEFAULT, defaultKindTag, XATTR_DEFAULT, defaultKindProp, XATTR_DEFAULT, defaultKindType)
+		return "", "", fuse.EINVAL
+	}
+	return kind, name, nil
+}
+
+// The extended attributes of a directory are the defaults it gives new files
+func (fsys *Filesys) lookupDirForXattr(ctx context.Context, oph *OpHandle, inode int64) (Dir, []DirDefault, error) {
+	dir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, inode)
+	if err != nil {
+		fsys.log("database error in xattr op: %s", err.Error())
+		return Dir{}, nil, fuse.EIO
+	}
+	if !ok {
+		return Dir{}, nil, fuse.ENOENT
+	}
+	defaults, err := fsys.mdb.DirDefaults(oph, dir.Inode)
+	if err != nil {
+		fsys.log("database error in xattr op: %s", err.Error())
+		return Dir{}, nil, fuse.EIO
+	}
+	return dir, defaults, nil
+}
+
+// Note: the global lock must be held
+func (fsys *Filesys) getDirXattr(ctx context.Context, oph *OpHandle, op *fuseops.GetXattrOp) error {
+	_, defaults, err := fsys.lookupDirForXattr(ctx, oph, int64(op.Inode))
+	if err != nil {
+		return err
+	}
+	for _, d := range defaults {
+		if op.Name == XATTR_DEFAULT+"."+d.Kind+"."+d.Name {
+			return fsys.getXattrFill(op, d.Value)
+		}
+	}
+	return fuse.ENOATTR
+}
+
+// Note: the global lock must be held
+func (fsys *Filesys) listDirXattr(ctx context.Context, oph *OpHandle, inode int64) ([]string, error) {
+	_, defaults, err := fsys.lookupDirForXattr(ctx, oph, inode)
+	if err != nil {
+		return nil, err
+	}
+	var xattrKeys []string
+	for _, d := range defaults {
+		xattrKeys = append(xattrKeys, XATTR_DEFAULT+"."+d.Kind+"."+d.Name)
+	}
+	sort.Strings(xattrKeys)
+	return xattrKeys, nil
+}
+
+// Find the directory default an attribute refers to, for changing it.
+// Returns the directory, the kind and name of the default, and whether it
+// is already set.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) lookupDirDefault(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	attrName string) (Dir, string, string, bool, error) {
+	dir, defaults, err := fsys.lookupDirForXattr(ctx, oph, inode)
+	if err != nil {
+		return Dir{}, "", "", false, err
+	}
+	if dir.faux {
+		// new files cannot be created in faux directories
+		return Dir{}, "", "", false, syscall.EPERM
+	}
+	if !fsys.checkProjectPermissions(dir.ProjId, PERM_UPLOAD) {
+		return Dir{}, "", "", false, syscall.EPERM
+	}
+	namespace, rest, err := fsys.xattrParseName(attrName)
+	if err != nil {
+		return Dir{}, "", "", false, err
+	}
+	if namespace != XATTR_DEFAULT {
+		fsys.log("directory attributes must start with %s", XATTR_DEFAULT)
+		return Dir{}, "", "", false, fuse.EINVAL
+	}
+	kind, name, err := fsys.dirXattrParseName(rest)
+	if err != nil {
+		return Dir{}, "", "", false, err
+	}
+	for _, d := range defaults {
+		if d.Kind == kind && d.Name == name {
+			return dir, kind, name, true, nil
+		}
+	}
+	return dir, kind, name, false, nil
+}
+
+// Note: the global lock must be held
+func (fsys *Filesys) removeDirXattr(ctx context.Context, oph *OpHandle, inode int64, attrName string) error {
+	dir, kind, name, attrExists, err := fsys.lookupDirDefault(ctx, oph, inode, attrName)
+	if err != nil {
+		return err
+	}
+	if !attrExists {
+		return fuse.ENOATTR
+	}
+	if err := fsys.mdb.RemoveDirDefault(oph, dir.Inode, kind, name); err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Set a default on a directory. Defaults are kept in the metadata database
+// only, and do not survive a remount.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) setDirXattr(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	attrName string,
+	value []byte,
+	flags uint32) error {
+	dir, kind, name, attrExists, err := fsys.lookupDirDefault(ctx, oph, inode, attrName)
+	if err != nil {
+		return err
+	}
+
+	switch flags {
+	case 0x1:
+		if attrExists {
+			return fuse.EEXIST
+		}
+	case 0x2:
+		if !attrExists {
+			return fuse.ENOATTR
+		}
+	case 0x0:
+	default:
+		fsys.log("invalid SetAttr flag value %d, expecting one of {0x0, 0x1, 0x2}", flags)
+		return syscall.EINVAL
+	}
+
+	d := DirDefault{Kind: kind, Name: name}
+	if kind == defaultKindProp {
+		d.Value = string(value)
+	}
+	if err := fsys.mdb.SetDirDefault(oph, dir.Inode, d); err != nil {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Parse the -property flag values, given as KEY=VALUE
+func ParseDefaultProperties(kvs []string) (map[string]string, error) {
+	props := make(map[string]string)
+	for _, kv := range kvs {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("property %s is not of the form KEY=VALUE", kv)
+		}
+		props[kv[:i]] = kv[i+1:]
+	}
+	return props, nil
+}
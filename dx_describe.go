@@ -31,6 +31,8 @@ type DxDescribeDataObject struct {
 	MtimeSeconds  int64
 	Tags          []string
 	Properties    map[string]string
+	Types         []string
+	Media         string
 	SymlinkPath   string
 }
 
@@ -99,6 +101,8 @@ type DxDescribeRaw struct {
 	Size             int64             `json:"size"`
 	Tags             []string          `json:"tags"`
 	Properties       map[string]string `json:"properties"`
+	Types            []string          `json:"types"`
+	Media            string            `json:"media"`
 	SymlinkPath      *DxSymLink        `json:"symlinkPath,omitempty"`
 }
 
@@ -107,6 +111,7 @@ func submit(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string,
 	fileIds []string) (map[string]DxDescribeDataObject, error) {
 
@@ -126,6 +131,8 @@ func submit(
 			"size":          true,
 			"tags":          true,
 			"properties":    true,
+			"types":         true,
+			"media":         true,
 			"symlinkPath":   true,
 			"drive":         true,
 		},
@@ -161,7 +168,7 @@ func submit(
 
 	//log.Printf("payload = %s", string(payload))
 
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, "system/findDataObjects", string(payload))
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, "system/findDataObjects", string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +199,8 @@ func submit(
 			MtimeSeconds:  descRaw.ModifiedMillisec / 1000,
 			Tags:          descRaw.Tags,
 			Properties:    descRaw.Properties,
+			Types:         descRaw.Types,
+			Media:         descRaw.Media,
 			SymlinkPath:   symlinkUrl,
 		}
 		//fmt.Printf("%v\n", desc)
@@ -204,6 +213,7 @@ func DxDescribeBulkObjects(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string,
 	objIds []string) (map[string]DxDescribeDataObject, error) {
 
@@ -224,7 +234,7 @@ func DxDescribeBulkObjects(
 	// Don't forget the tail of the requests, that is smaller than the batch size
 	batches = append(batches, objIds)
 	for _, objIdBatch := range batches {
-		m, err := submit(ctx, httpClient, dxEnv, projectId, objIdBatch)
+		m, err := submit(ctx, httpClient, dxEnv, rp, projectId, objIdBatch)
 		if err != nil {
 			return nil, err
 		}
@@ -263,13 +273,15 @@ func listFolder(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string,
-	dir string) (*DxListFolder, error) {
+	dir string,
+	includeHidden bool) (*DxListFolder, error) {
 
 	request := ListFolderRequest{
 		Folder:        dir,
 		Only:          "all",
-		IncludeHidden: false,
+		IncludeHidden: includeHidden,
 	}
 	var payload []byte
 	payload, err := json.Marshal(request)
@@ -277,7 +289,7 @@ func listFolder(
 		return nil, err
 	}
 	dxRequest := fmt.Sprintf("%s/listFolder", projectId)
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, dxRequest, string(payload))
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, dxRequest, string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -300,11 +312,12 @@ func DxDescribeFolder(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string,
 	folder string) (*DxFolder, error) {
 	// The listFolder API call returns a list of object ids and folders.
 	// We could describe the objects right here, but we do that separately.
-	folderInfo, err := listFolder(ctx, httpClient, dxEnv, projectId, folder)
+	folderInfo, err := listFolder(ctx, httpClient, dxEnv, rp, projectId, folder, false)
 	if err != nil {
 		log.Printf("listFolder(%s) error %s", folder, err.Error())
 		return nil, err
@@ -316,7 +329,7 @@ func DxDescribeFolder(
 			"Too many elements (%d) in a directory, the limit is %d",
 			numElementsInDir, MaxDirSize)
 	}
-	dxObjs, err := DxDescribeBulkObjects(ctx, httpClient, dxEnv, projectId, folderInfo.objIds)
+	dxObjs, err := DxDescribeBulkObjects(ctx, httpClient, dxEnv, rp, projectId, folderInfo.objIds)
 	if err != nil {
 		log.Printf("describeBulkObjects(%v) error %s", folderInfo.objIds, err.Error())
 		return nil, err
@@ -368,6 +381,7 @@ func DxDescribeProject(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string) (*DxDescribePrj, error) {
 
 	var request RequestDescribeProject
@@ -389,7 +403,7 @@ func DxDescribeProject(
 	}
 
 	dxRequest := fmt.Sprintf("%s/describe", projectId)
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, dxRequest, string(payload))
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, dxRequest, string(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -418,11 +432,12 @@ func DxDescribe(
 	ctx context.Context,
 	httpClient *http.Client,
 	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
 	projectId string,
 	objId string) (DxDescribeDataObject, error) {
 	var objectIds []string
 	objectIds = append(objectIds, objId)
-	m, err := DxDescribeBulkObjects(ctx, httpClient, dxEnv, projectId, objectIds)
+	m, err := DxDescribeBulkObjects(ctx, httpClient, dxEnv, rp, projectId, objectIds)
 	if err != nil {
 		return DxDescribeDataObject{}, err
 	}
@@ -432,3 +447,126 @@ func DxDescribe(
 	}
 	return oDesc, nil
 }
+
+type RequestDescribeFileParts struct {
+	ProjId string          `json:"project"`
+	Fields map[string]bool `json:"fields"`
+}
+
+type DxFilePart struct {
+	Md5   string `json:"md5"`
+	Size  int64  `json:"size"`
+	State string `json:"state"`
+}
+
+// The size and parts of a file, as the platform sees them. Parts are
+// indexed by their number, starting at one.
+type DxFileParts struct {
+	Id    string                `json:"id"`
+	State string                `json:"state"`
+	Size  int64                 `json:"size"`
+	Parts map[string]DxFilePart `json:"parts"`
+}
+
+// Describe the parts of a file
+func DxDescribeFileParts(
+	ctx context.Context,
+	httpClient *http.Client,
+	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
+	projectId string,
+	fileId string) (*DxFileParts, error) {
+
+	var request RequestDescribeFileParts
+	request.ProjId = projectId
+	request.Fields = map[string]bool{
+		"id":    true,
+		"state": true,
+		"size":  true,
+		"parts": true,
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	dxRequest := fmt.Sprintf("%s/describe", fileId)
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, dxRequest, string(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply DxFileParts
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+type RequestFindByProperty struct {
+	Class           string                     `json:"class"`
+	State           string                     `json:"state"`
+	Properties      map[string]string          `json:"properties"`
+	Scope           map[string]interface{}     `json:"scope"`
+	DescribeOptions map[string]map[string]bool `json:"describe"`
+	Limit           int                        `json:"limit"`
+}
+
+// Find up to [limit] closed files in a project, that have a property
+// with the given value.
+func DxFindFilesByProperty(
+	ctx context.Context,
+	httpClient *http.Client,
+	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
+	projectId string,
+	key string,
+	value string,
+	limit int) ([]DxDescribeDataObject, error) {
+	request := RequestFindByProperty{
+		Class:      "file",
+		State:      "closed",
+		Properties: map[string]string{key: value},
+		Scope: map[string]interface{}{
+			"project": projectId,
+			"recurse": true,
+		},
+		DescribeOptions: map[string]map[string]bool{
+			"fields": map[string]bool{
+				"id":     true,
+				"name":   true,
+				"state":  true,
+				"folder": true,
+				"size":   true,
+			},
+		},
+		Limit: limit,
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, "system/findDataObjects", string(payload))
+	if err != nil {
+		return nil, err
+	}
+	var reply Reply
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return nil, err
+	}
+
+	var files []DxDescribeDataObject
+	for _, descRawTop := range reply.Results {
+		descRaw := descRawTop.Describe
+		files = append(files, DxDescribeDataObject{
+			Id:     descRaw.Id,
+			ProjId: projectId,
+			Name:   descRaw.Name,
+			State:  descRaw.State,
+			Folder: descRaw.Folder,
+			Size:   descRaw.Size,
+		})
+	}
+	return files, nil
+}
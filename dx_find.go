@@ -40,7 +40,9 @@ func DxFindProject(
 
 	//httpClient := dxda.NewHttpClient(false)
 	httpClient := dxda.NewHttpClient()
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, dxEnv, "system/findProjects", string(payload))
+	// this runs before the mount, and its retry policy, are set up
+	rp := NewRetryPolicy(RetryTimeoutDefault)
+	repJs, err := dxAPI(ctx, httpClient, dxEnv, rp, "system/findProjects", string(payload))
 	if err != nil {
 		return "", err
 	}
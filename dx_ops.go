@@ -21,16 +21,18 @@ const (
 type DxOps struct {
 	dxEnv   dxda.DXEnvironment
 	options Options
+	retry   *RetryPolicy
 
 	// http error that occurs when an upload has taken too long
 	timeoutExpirationErrorRe *regexp.Regexp
 }
 
-func NewDxOps(dxEnv dxda.DXEnvironment, options Options) *DxOps {
+func NewDxOps(dxEnv dxda.DXEnvironment, options Options, retry *RetryPolicy) *DxOps {
 	timeoutRe := regexp.MustCompile(`<Message>Request has expired</Message>`)
 	return &DxOps{
 		dxEnv:                    dxEnv,
 		options:                  options,
+		retry:                    retry,
 		timeoutExpirationErrorRe: timeoutRe,
 	}
 }
@@ -67,11 +69,11 @@ func (ops *DxOps) DxFolderNew(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
 		&ops.dxEnv,
+		ops.retry,
 		fmt.Sprintf("%s/newFolder", projId),
 		string(payload))
 	if err != nil {
@@ -87,8 +89,9 @@ func (ops *DxOps) DxFolderNew(
 }
 
 type RequestFolderRemove struct {
-	ProjId string `json:"project"`
-	Folder string `json:"folder"`
+	ProjId  string `json:"project"`
+	Folder  string `json:"folder"`
+	Recurse bool   `json:"recurse"`
 }
 
 type ReplyFolderRemove struct {
@@ -99,24 +102,26 @@ func (ops *DxOps) DxFolderRemove(
 	ctx context.Context,
 	httpClient *http.Client,
 	projId string,
-	folder string) error {
+	folder string,
+	recurse bool) error {
 	if ops.options.Verbose {
-		ops.log("remove-folder %s:%s", projId, folder)
+		ops.log("remove-folder %s:%s recurse=%t", projId, folder, recurse)
 	}
 
 	var request RequestFolderRemove
 	request.ProjId = projId
 	request.Folder = folder
+	request.Recurse = recurse
 
 	payload, err := json.Marshal(request)
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
 		&ops.dxEnv,
+		ops.retry,
 		fmt.Sprintf("%s/removeFolder", projId),
 		string(payload))
 	if err != nil {
@@ -157,11 +162,11 @@ func (ops *DxOps) DxRemoveObjects(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
+	repJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
 		&ops.dxEnv,
+		ops.retry,
 		fmt.Sprintf("%s/removeObjects", projId),
 		string(payload))
 	if err != nil {
@@ -177,11 +182,26 @@ func (ops *DxOps) DxRemoveObjects(
 }
 
 type RequestNewFile struct {
-	ProjId  string `json:"project"`
-	Name    string `json:"name"`
-	Folder  string `json:"folder"`
-	Parents bool   `json:"parents"`
-	Nonce   string `json:"nonce"`
+	ProjId     string            `json:"project"`
+	Name       string            `json:"name"`
+	Folder     string            `json:"folder"`
+	Parents    bool              `json:"parents"`
+	Nonce      string            `json:"nonce"`
+	Tags       []string          `json:"tags,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Types      []string          `json:"types,omitempty"`
+	Media      string            `json:"media,omitempty"`
+	Hidden     bool              `json:"hidden,omitempty"`
+}
+
+// The metadata a new file is created with. This saves calls to set it
+// afterwards, and the file never appears without it.
+type NewFileMetadata struct {
+	Tags       []string
+	Properties map[string]string
+	Types      []string
+	Media      string // the Internet media type
+	Hidden     bool   // not listed, until made visible
 }
 
 type ReplyNewFile struct {
@@ -194,7 +214,8 @@ func (ops *DxOps) DxFileNew(
 	nonceStr string,
 	projId string,
 	fname string,
-	folder string) (string, error) {
+	folder string,
+	meta NewFileMetadata) (string, error) {
 	if ops.options.Verbose {
 		ops.log("file-new %s:%s/%s", projId, folder, fname)
 	}
@@ -205,12 +226,17 @@ func (ops *DxOps) DxFileNew(
 	request.Folder = folder
 	request.Parents = false
 	request.Nonce = nonceStr
+	request.Tags = meta.Tags
+	request.Properties = meta.Properties
+	request.Types = meta.Types
+	request.Media = meta.Media
+	request.Hidden = meta.Hidden
 
 	payload, err := json.Marshal(request)
 	if err != nil {
 		return "", err
 	}
-	repJs, err := dxda.DxAPI(ctx, httpClient, NumRetriesDefault, &ops.dxEnv, "file/new", string(payload))
+	repJs, err := dxAPI(ctx, httpClient, &ops.dxEnv, ops.retry, "file/new", string(payload))
 	if err != nil {
 		return "", err
 	}
@@ -233,11 +259,11 @@ func (ops *DxOps) DxFileCloseAndWait(
 		ops.log("file close-and-wait %s", fid)
 	}
 
-	_, err := dxda.DxAPI(
+	_, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
 		&ops.dxEnv,
+		ops.retry,
 		fmt.Sprintf("%s/close", fid),
 		"{}")
 	if err != nil {
@@ -245,11 +271,21 @@ func (ops *DxOps) DxFileCloseAndWait(
 	}
 
 	// wait for file to achieve closed state
+	time.Sleep(400 * time.Millisecond)
+	return ops.DxFileWaitForClose(ctx, httpClient, projectId, fid)
+}
+
+// Wait for a file in the closing state to become closed. An open file
+// is an error, it will not be closed without a close call.
+func (ops *DxOps) DxFileWaitForClose(
+	ctx context.Context,
+	httpClient *http.Client,
+	projectId string,
+	fid string) error {
 	start := time.Now()
 	deadline := start.Add(fileCloseMaxWaitTime)
-	time.Sleep(400 * time.Millisecond)
 	for true {
-		fDesc, err := DxDescribe(ctx, httpClient, &ops.dxEnv, projectId, fid)
+		fDesc, err := DxDescribe(ctx, httpClient, &ops.dxEnv, ops.retry, projectId, fid)
 		if err != nil {
 			return err
 		}
@@ -308,12 +344,23 @@ func (ops *DxOps) DxFileUploadPart(
 	fileId string,
 	index int,
 	data []byte) error {
-
 	md5Sum := md5.Sum(data)
+	return ops.DxFileUploadPartMd5(ctx, httpClient, fileId, index, data, hex.EncodeToString(md5Sum[:]))
+}
+
+// Upload a part, whose md5 checksum has already been calculated
+func (ops *DxOps) DxFileUploadPartMd5(
+	ctx context.Context,
+	httpClient *http.Client,
+	fileId string,
+	index int,
+	data []byte,
+	md5Hex string) error {
+
 	uploadReq := RequestUploadChunk{
 		Size:  len(data),
 		Index: index,
-		Md5:   hex.EncodeToString(md5Sum[:]),
+		Md5:   md5Hex,
 	}
 
 	reqJson, err := json.Marshal(uploadReq)
@@ -321,11 +368,11 @@ func (ops *DxOps) DxFileUploadPart(
 		return err
 	}
 
-	replyJs, err := dxda.DxAPI(
+	replyJs, err := dxAPI(
 		ctx,
 		httpClient,
-		NumRetriesDefault,
 		&ops.dxEnv,
+		ops.retry,
 		fmt.Sprintf("%s/upload", fileId),
 		string(reqJson))
 	if err != nil {
@@ -378,8 +425,8 @@ func (ops *DxOps) DxRename(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/rename", fileId),
 		string(payload))
 	if err != nil {
@@ -427,8 +474,8 @@ func (ops *DxOps) DxMove(
 	if err != nil {
 		return err
 	}
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/move", projId),
 		string(payload))
 	if err != nil {
@@ -443,6 +490,52 @@ func (ops *DxOps) DxMove(
 	return nil
 }
 
+type RequestSetVisibility struct {
+	ProjId string `json:"project"`
+	Hidden bool   `json:"hidden"`
+}
+
+type ReplySetVisibility struct {
+	Id string `json:"id"`
+}
+
+//  API method: /class-xxxx/setVisibility
+//
+//  hide a data object, or make it visible
+func (ops *DxOps) DxSetVisibility(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	objId string,
+	hidden bool) error {
+	if ops.options.Verbose {
+		ops.log("set visibility %s:%s hidden=%t", projId, objId, hidden)
+	}
+
+	var request RequestSetVisibility
+	request.ProjId = projId
+	request.Hidden = hidden
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
+		fmt.Sprintf("%s/setVisibility", objId),
+		string(payload))
+	if err != nil {
+		return err
+	}
+
+	var reply ReplySetVisibility
+	if err := json.Unmarshal(repJs, &reply); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type RequestRenameFolder struct {
 	Folder string `json:"folder"`
 	Name   string `json:"name"`
@@ -468,8 +561,8 @@ func (ops *DxOps) DxRenameFolder(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/renameFolder", projId),
 		string(payload))
 	if err != nil {
@@ -498,50 +591,56 @@ type ReplyClone struct {
 	Exists  []string `json:"exists"`
 }
 
+//  API method: /class-xxxx/clone
+//
+// Clones data objects and folders into a folder in another project. The objects
+// keep their IDs and names, and no data is copied. Returns the IDs of the objects that
+// were not cloned, because they already exist in the destination project.
 func (ops *DxOps) DxClone(
 	ctx context.Context,
 	httpClient *http.Client,
 	srcProjId string,
-	srcId string,
+	objectIds []string,
+	folders []string,
 	destProjId string,
-	destProjFolder string) (bool, error) {
+	destProjFolder string) ([]string, error) {
+	if ops.options.Verbose {
+		ops.log("clone %s objects=%v folders=%v -> %s:%s",
+			srcProjId, objectIds, folders, destProjId, destProjFolder)
+	}
 
 	var request RequestClone
-	objs := make([]string, 1)
-	objs[0] = srcId
-	request.Objects = objs
-	request.Folders = make([]string, 0)
+	request.Objects = objectIds
+	request.Folders = folders
+	if request.Objects == nil {
+		request.Objects = make([]string, 0)
+	}
+	if request.Folders == nil {
+		request.Folders = make([]string, 0)
+	}
 	request.Project = destProjId
 	request.Destination = destProjFolder
 	request.Parents = false
 
 	payload, err := json.Marshal(request)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/clone", srcProjId),
 		string(payload))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	var reply ReplyClone
 	if err := json.Unmarshal(repJs, &reply); err != nil {
-		return false, err
-	}
-
-	for _, id := range reply.Exists {
-		if id == srcId {
-			// was not copied, because there is an existing
-			// copy in the destination project.
-			return false, nil
-		}
+		return nil, err
 	}
 
-	return true, nil
+	return reply.Exists, nil
 }
 
 type RequestSetProperties struct {
@@ -569,8 +668,8 @@ func (ops *DxOps) DxSetProperties(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/setProperties", objId),
 		string(payload))
 	if err != nil {
@@ -610,8 +709,8 @@ func (ops *DxOps) DxAddTags(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/addTags", objId),
 		string(payload))
 	if err != nil {
@@ -651,8 +750,8 @@ func (ops *DxOps) DxRemoveTags(
 		return err
 	}
 
-	repJs, err := dxda.DxAPI(
-		ctx, httpClient, NumRetriesDefault, &ops.dxEnv,
+	repJs, err := dxAPI(
+		ctx, httpClient, &ops.dxEnv, ops.retry,
 		fmt.Sprintf("%s/removeTags", objId),
 		string(payload))
 	if err != nil {
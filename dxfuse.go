@@ -3,15 +3,19 @@ package dxfuse
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,9 +30,10 @@ import (
 
 const (
 	// namespace for xattrs
-	XATTR_TAG  = "tag"
-	XATTR_PROP = "prop"
-	XATTR_BASE = "base"
+	XATTR_TAG     = "tag"
+	XATTR_PROP    = "prop"
+	XATTR_BASE    = "base"
+	XATTR_DEFAULT = "default" // directory defaults for new files
 )
 
 type Filesys struct {
@@ -58,6 +63,12 @@ type Filesys struct {
 	// parallel part uploader
 	uploader *FileUploader
 
+	// bulk removal of unlinked objects
+	remover *Remover
+
+	// closes written files in the background, if enabled
+	closer *Closer
+
 	// sync daemon
 	sybx *SyncDbDx
 
@@ -80,8 +91,33 @@ type Filesys struct {
 
 	tmpFileCounter uint64
 
+	// files that were closed, but did not match what was written
+	checksumFailures map[int64]checksumFailure
+
+	// md5 of files read from beginning to end
+	readChecksums map[int64]readChecksumResult
+
+	// values of the templates in default tags and properties
+	templateVars map[string]string
+
+	// tag and property changes of files being written
+	pendingXattrs map[int64]*PendingXattrs
+
+	// files that could not be closed, and can be retried
+	failedCloses map[int64]failedClose
+
+	// files being rewritten
+	rewrites map[int64]rewrite
+
+	// files rewritten since they were last opened, their cached pages are stale
+	rewritten map[int64]bool
+
 	// is the the system shutting down (unmounting)
 	shutdownCalled bool
+
+	// the metadata database is closing, uploaded parts are no longer
+	// written to the journal
+	journalClosed bool
 }
 
 // Files can be in two access modes: remote-read-only or remote-append-only
@@ -119,12 +155,40 @@ type FileHandle struct {
 	writeBuffer     []byte
 	// Keep track of bytes written to buffer
 	writeBufferOffset int
-	// Lock for writing
+	// Lock for writing, and for changing the access mode
 	mutex *sync.Mutex
 	// waitgroup for parallel part uploads
 	wg sync.WaitGroup
+	// number of parts in flight, it can be read without waiting
+	partsInFlight int32
 	// parallel uploader will report any errors here, should be checked on the next write
 	writeError error
+	// Limits of the project the file is uploaded to, used to plan part sizes
+	uploadParams FileUploadParameters
+	// Checksum of the data written, verified once the file is closed
+	checksum *UploadChecksum
+	// Checksum of the data read, verified if the file is read to the end
+	readChecksum *ReadChecksum
+
+	// A read-only handle of a closed file, opened for reading and writing, that
+	// may be converted into a writable handle. This happens when the file is
+	// truncated to zero through it. The new version replaces the old one when
+	// the handle is closed. The conversion is done under the handle lock.
+	rewritable bool
+	// The file-id of the version being replaced, empty for new files
+	replacedId string
+}
+
+// A part is sent to the uploader
+func (fh *FileHandle) startPart() {
+	fh.wg.Add(1)
+	atomic.AddInt32(&fh.partsInFlight, 1)
+}
+
+// A part has been uploaded, or failed
+func (fh *FileHandle) partDone() {
+	atomic.AddInt32(&fh.partsInFlight, -1)
+	fh.wg.Done()
 }
 
 type DirHandle struct {
@@ -154,20 +218,36 @@ func NewDxfuse(
 		options:        options,
 		mutex:          &sync.Mutex{},
 		httpClientPool: httpIoPool,
-		ops:            NewDxOps(dxEnv, options),
+		ops:            NewDxOps(dxEnv, options, NewRetryPolicy(options.RetryTimeout)),
 		fhCounter:      1,
 		fhTable:        make(map[fuseops.HandleID]*FileHandle),
 		dhCounter:      1,
 		dhTable:        make(map[fuseops.HandleID]*DirHandle),
 		tmpFileCounter: 0,
 		shutdownCalled: false,
+
+		checksumFailures: make(map[int64]checksumFailure),
+		readChecksums:    make(map[int64]readChecksumResult),
+		templateVars:     templateVars(dxEnv, time.Now()),
+		pendingXattrs:    make(map[int64]*PendingXattrs),
+		failedCloses:     make(map[int64]failedClose),
+		rewrites:         make(map[int64]rewrite),
+		rewritten:        make(map[int64]bool),
 	}
 	if options.Verbose {
 		fsys.log("Http client pool size: %d", HttpClientPoolSize)
 	}
 
-	// Create a fresh SQL database
+	// Create a fresh SQL database. Uploads that were in progress when the
+	// previous dxfuse process stopped are carried over, as orphans.
 	databaseFile := filepath.Join(dxfuseBaseDir, DatabaseFile)
+	orphans, err := ReadUploadJournal(databaseFile)
+	if err != nil {
+		fsys.log("Could not read the upload journal of the old database, %s", err.Error())
+	}
+	if len(orphans) > 0 {
+		fsys.log("Found %d uploads that were left open by a previous mount", len(orphans))
+	}
 	fsys.log("Removing old version of the database (%s)", databaseFile)
 	if err := os.RemoveAll(databaseFile); err != nil {
 		fsys.log("error removing old database %s", err.Error())
@@ -175,7 +255,7 @@ func NewDxfuse(
 	}
 
 	// create the metadata database
-	mdb, err := NewMetadataDb(databaseFile, dxEnv, options)
+	mdb, err := NewMetadataDb(databaseFile, dxEnv, options, fsys.ops.retry)
 	if err != nil {
 		return nil, err
 	}
@@ -189,9 +269,13 @@ func NewDxfuse(
 		fsys.opClose(oph)
 		return nil, err
 	}
+	if err := fsys.mdb.JournalAddOrphans(oph, orphans); err != nil {
+		fsys.opClose(oph)
+		return nil, err
+	}
 	fsys.opClose(oph)
 
-	fsys.pgs = NewPrefetchGlobalState(options.VerboseLevel, dxEnv)
+	fsys.pgs = NewPrefetchGlobalState(options.VerboseLevel, dxEnv, options, fsys.ops.retry)
 
 	// describe all the projects, we need their upload parameters
 	httpClient := <-fsys.httpClientPool
@@ -201,7 +285,7 @@ func NewDxfuse(
 
 	projId2Desc := make(map[string]DxDescribePrj)
 	for _, d := range manifest.Directories {
-		pDesc, err := DxDescribeProject(context.TODO(), httpClient, &fsys.dxEnv, d.ProjId)
+		pDesc, err := DxDescribeProject(context.TODO(), httpClient, &fsys.dxEnv, fsys.ops.retry, d.ProjId)
 		if err != nil {
 			fsys.log("Could not describe project %s, check permissions", d.ProjId)
 			return nil, err
@@ -210,18 +294,32 @@ func NewDxfuse(
 	}
 	fsys.projId2Desc = projId2Desc
 
+	// create an endpoint for communicating with the user
+	fsys.cmdSrv = NewCmdServer(options, fsys.sybx, fsys)
+	fsys.cmdSrv.Init()
+
 	if options.ReadOnly {
 		// we don't need the file upload module
 		return fsys, nil
 	}
 
-	fsys.uploader = NewFileUploader(options.VerboseLevel, options, dxEnv)
+	fsys.uploader = NewFileUploader(options.VerboseLevel, options, dxEnv, fsys)
+	fsys.remover = NewRemover(fsys)
+	if options.AsyncClose {
+		fsys.closer = NewCloser(fsys)
+	}
+	if options.RemoveOrphans && len(orphans) > 0 {
+		go func() {
+			msg, err := fsys.CmdOrphans(context.TODO(), "remove", []string{"all"})
+			if err != nil {
+				fsys.log("Error removing orphaned uploads: %s", err.Error())
+				return
+			}
+			fsys.log(msg)
+		}()
+	}
 	// initialize sync daemon
-	//fsys.sybx = NewSyncDbDx(options, dxEnv, projId2Desc, mdb, fsys.mutex)
-
-	// create an endpoint for communicating with the user
-	fsys.cmdSrv = NewCmdServer(options, fsys.sybx)
-	fsys.cmdSrv.Init()
+	//fsys.sybx = NewSyncDbDx(options, dxEnv, projId2Desc, mdb, fsys.mutex, fsys.uploader.throttle, fsys.ops.retry)
 
 	return fsys, nil
 }
@@ -249,6 +347,24 @@ func (fsys *Filesys) Shutdown() {
 	// We do not remove the metadata database file, so it could be inspected offline.
 	fsys.log("Shutting down dxfuse")
 
+	// complete queued closes, these update the metadata database
+	if fsys.closer != nil {
+		fsys.closer.Shutdown()
+	}
+
+	// complete queued removals. The remover may be putting objects that
+	// failed back in the metadata database, so this comes before it is closed.
+	if fsys.remover != nil {
+		fsys.remover.Shutdown()
+	}
+
+	// write the last uploaded parts to the journal, the database file is
+	// read by the next mount
+	fsys.flushJournalParts()
+	fsys.mutex.Lock()
+	fsys.journalClosed = true
+	fsys.mutex.Unlock()
+
 	// stop any background operations the metadata database may be running.
 	fsys.mdb.Shutdown()
 
@@ -340,11 +456,17 @@ func (fsys *Filesys) dxErrorToFilesystemError(dxErr dxda.DxError) error {
 		return fuse.ENOENT
 	case "Unauthorized":
 		return syscall.EPERM
-	default:
-		fsys.log("unexpected dnanexus error type (%s), returning EIO which will unmount the filesystem",
-			dxErr.EType)
+	}
+	if isTransientStatus(dxErr.HttpCode) {
+		// The call was retried, or waited for the platform to come
+		// back, for as long as the retry timeout allows.
+		fsys.log("the platform is unavailable (%s, status %d), returning EIO",
+			dxErr.EType, dxErr.HttpCode)
 		return fuse.EIO
 	}
+	fsys.log("unexpected dnanexus error type (%s), returning EIO which will unmount the filesystem",
+		dxErr.EType)
+	return fuse.EIO
 }
 
 func (fsys *Filesys) translateError(err error) error {
@@ -448,6 +570,25 @@ func (fsys *Filesys) GetInodeAttributes(ctx context.Context, op *fuseops.GetInod
 // if the file is writable, we can modify some of the attributes.
 // otherwise, this is a permission error.
 func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	// Truncating a file that is being written has to be serialized with
+	// the writes. The handle lock is taken before the global lock.
+	// Truncating a closed file to zero, through a handle that may rewrite
+	// it, converts the handle under its lock.
+	var wfh, rfh *FileHandle
+	if op.Size != nil {
+		wfh = fsys.findWriteHandle(int64(op.Inode), op.Handle)
+		if wfh != nil {
+			wfh.mutex.Lock()
+			defer wfh.mutex.Unlock()
+		} else if *op.Size == 0 && op.Handle != nil {
+			rfh = fsys.findRewritableHandle(*op.Handle)
+			if rfh != nil {
+				rfh.mutex.Lock()
+				defer rfh.mutex.Unlock()
+			}
+		}
+	}
+
 	fsys.mutex.Lock()
 	defer fsys.mutex.Unlock()
 	oph := fsys.opOpen()
@@ -478,13 +619,58 @@ func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInod
 		return syscall.EPERM
 	}
 
+	// Truncating a closed file through an open handle (O_TRUNC, ftruncate)
+	// starts rewriting it.
+	if rfh != nil && rfh.rewritable && rfh.inode == file.Inode && file.State == "closed" {
+		if err := fsys.startFileRewrite(ctx, oph, rfh); err != nil {
+			return err
+		}
+		wfh = rfh
+	}
+	if _, ok := fsys.rewrites[file.Inode]; ok {
+		return fsys.setRewriteAttributes(ctx, oph, op, wfh, file)
+	}
+
 	// we know it is a file.
-	// check if this is a read-only file.
+	// check if this is a read-only file. Its size cannot change, this is
+	// checked before anything is changed on the platform.
 	attrs := file.GetAttrs()
-	if attrs.Mode == fileReadOnlyMode {
+	readOnly := attrs.Mode == fileReadOnlyMode || file.State == "closed"
+	if readOnly && op.Size != nil {
+		return syscall.EPERM
+	}
+
+	if fsys.options.PosixMetadata {
+		if err := fsys.setPosixMetadata(ctx, oph, file, op.Mode, op.Mtime); err != nil {
+			return err
+		}
+		if readOnly {
+			// The properties are applied to the attributes when
+			// the file is looked up.
+			file, _, err = fsys.lookupFileByInode(ctx, oph, file.Inode)
+			if err != nil {
+				return err
+			}
+			op.Attributes = file.GetAttrs()
+			op.AttributesExpiration = fsys.calcExpirationTime(op.Attributes)
+			return nil
+		}
+	}
+	if readOnly {
 		return syscall.EPERM
 	}
 
+	if op.Size != nil {
+		if wfh != nil && wfh.accessMode == AM_AO_Remote && wfh.inode == file.Inode {
+			if err := fsys.truncateWriteHandle(wfh, int64(*op.Size)); err != nil {
+				return err
+			}
+		} else if int64(*op.Size) != file.Size {
+			fsys.log("Cannot truncate file (%s,%s), it is not open for writing", file.Name, file.Id)
+			return syscall.ENOTSUP
+		}
+	}
+
 	// update the file
 	if op.Size != nil {
 		attrs.Size = *op.Size
@@ -495,7 +681,7 @@ func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInod
 	if op.Mtime != nil {
 		attrs.Mtime = *op.Mtime
 	}
-	// Don't allow chmod
+	// Without posix metadata, chmod is not persisted
 	// we don't handle atime
 	err = fsys.mdb.UpdateFileAttrs(ctx, oph, file.Inode, int64(attrs.Size), attrs.Mtime, nil)
 	if err != nil {
@@ -510,6 +696,107 @@ func (fsys *Filesys) SetInodeAttributes(ctx context.Context, op *fuseops.SetInod
 	return nil
 }
 
+// Store mode and mtime changes in reserved properties of a file. This
+// works for open files as well, the platform allows setting properties
+// on them.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) setPosixMetadata(
+	ctx context.Context,
+	oph *OpHandle,
+	file File,
+	mode *os.FileMode,
+	mtime *time.Time) error {
+	if mode == nil && mtime == nil {
+		return nil
+	}
+	if !fsys.checkProjectPermissions(file.ProjId, PERM_CONTRIBUTE) {
+		return syscall.EPERM
+	}
+
+	if file.Properties == nil {
+		file.Properties = make(map[string]string)
+	}
+	propsToSet := make(map[string](*string))
+	if mode != nil {
+		modeStr := fmt.Sprintf("%o", mode.Perm())
+		file.Properties[ModeProperty] = modeStr
+		propsToSet[ModeProperty] = &modeStr
+	}
+	if mtime != nil {
+		mtimeStr := strconv.FormatInt(mtime.Unix(), 10)
+		file.Properties[MtimeProperty] = mtimeStr
+		propsToSet[MtimeProperty] = &mtimeStr
+	}
+
+	if err := fsys.ops.DxSetProperties(ctx, oph.httpClient, file.ProjId, file.Id, propsToSet); err != nil {
+		fsys.log("Error in setting posix metadata on %s: %s", file.Id, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, file); err != nil {
+		fsys.log("database error in setting posix metadata %s", err.Error())
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Find the append-only handle of a file, prefering the handle
+// the operation was issued on.
+func (fsys *Filesys) findWriteHandle(inode int64, hid *fuseops.HandleID) *FileHandle {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	if hid != nil {
+		fh, ok := fsys.fhTable[*hid]
+		if ok && fh.accessMode == AM_AO_Remote {
+			return fh
+		}
+	}
+	for _, fh := range fsys.fhTable {
+		if fh.inode == inode && fh.accessMode == AM_AO_Remote {
+			return fh
+		}
+	}
+	return nil
+}
+
+// Find a read-only handle that may start rewriting its file
+func (fsys *Filesys) findRewritableHandle(hid fuseops.HandleID) *FileHandle {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	fh, ok := fsys.fhTable[hid]
+	if ok && fh.rewritable {
+		return fh
+	}
+	return nil
+}
+
+// Truncate a file that is being written. Parts that have already been
+// uploaded cannot be changed, so we can only truncate to the current size,
+// or to zero before any part has been uploaded.
+//
+// Note: the file handle lock must be held
+func (fsys *Filesys) truncateWriteHandle(fh *FileHandle, size int64) error {
+	if size == fh.nextWriteOffset {
+		return nil
+	}
+	if size == 0 && fh.lastPartId == 0 {
+		if fh.writeBuffer != nil {
+			fh.writeBuffer = fh.writeBuffer[:0]
+		}
+		fh.writeBufferOffset = 0
+		fh.nextWriteOffset = 0
+		fh.size = 0
+		fh.checksum = NewUploadChecksum()
+		return nil
+	}
+	fsys.log("ERROR: Cannot truncate file %s to %d bytes, %d bytes have been written and %d parts uploaded",
+		fh.Id, size, fh.nextWriteOffset, fh.lastPartId)
+	return syscall.ENOTSUP
+}
+
 // make a pass through the open handles, and
 // release handles that reference this inode.
 func (fsys *Filesys) removeFileHandlesWithInode(inode int64) {
@@ -642,6 +929,67 @@ func (fsys *Filesys) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
 	return nil
 }
 
+// Remove the folder of an empty directory. Removals of the files that were in
+// it may still be queued. If these are all that is left in the folder,
+// including hidden objects, it is removed recursively with one call, instead
+// of removing the files first. Otherwise, the folder is removed only if it is
+// empty once the queued files are removed.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) removeFolder(ctx context.Context, oph *OpHandle, projId string, folder string) error {
+	queued := fsys.remover.Take(projId, folder)
+	if len(queued) == 0 && !fsys.options.Trash {
+		// the platform refuses to remove a folder that is not empty
+		return fsys.ops.DxFolderRemove(ctx, oph.httpClient, projId, folder, false)
+	}
+
+	// put the files back in the queue, if the folder cannot be removed
+	requeue := func() {
+		for _, objId := range queued {
+			fsys.remover.Enqueue(projId, folder, objId)
+		}
+	}
+	folderInfo, err := listFolder(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, projId, folder, true)
+	if err != nil {
+		requeue()
+		return err
+	}
+
+	queuedSet := make(map[string]bool)
+	for _, objId := range queued {
+		queuedSet[objId] = true
+	}
+	onlyQueued := len(folderInfo.subdirs) == 0
+	for _, objId := range folderInfo.objIds {
+		if !queuedSet[objId] {
+			onlyQueued = false
+			break
+		}
+	}
+	if onlyQueued {
+		if fsys.options.Trash {
+			err = fsys.trashFolder(ctx, oph.httpClient, projId, folder)
+		} else {
+			err = fsys.ops.DxFolderRemove(ctx, oph.httpClient, projId, folder, true)
+		}
+		if err != nil {
+			requeue()
+		}
+		return err
+	}
+
+	// The folder has other content on the platform. The queued files are
+	// removed, and the folder is removed only if that leaves it empty, also
+	// with the -trash flag.
+	if len(queued) > 0 {
+		if err := fsys.removeObjects(ctx, oph.httpClient, projId, folder, queued); err != nil {
+			requeue()
+			return err
+		}
+	}
+	return fsys.ops.DxFolderRemove(ctx, oph.httpClient, projId, folder, false)
+}
+
 func (fsys *Filesys) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	fsys.mutex.Lock()
 	defer fsys.mutex.Unlock()
@@ -696,7 +1044,7 @@ func (fsys *Filesys) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
 	if !childDir.faux {
 		// The directory exists and is empty, we can remove it.
 		folderFullPath := filepath.Join(parentDir.ProjFolder, op.Name)
-		err = fsys.ops.DxFolderRemove(ctx, oph.httpClient, parentDir.ProjId, folderFullPath)
+		err = fsys.removeFolder(ctx, oph, parentDir.ProjId, folderFullPath)
 		if err != nil {
 			fsys.log("Error in removing directory (%s:%s) on dnanexus: %s",
 				parentDir.ProjId, folderFullPath, err.Error())
@@ -774,10 +1122,17 @@ func (fsys *Filesys) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) e
 	if !fsys.checkProjectPermissions(parentDir.ProjId, PERM_UPLOAD) {
 		return syscall.EPERM
 	}
+	if err := fsys.checkWriteBufferMemory(parentDir.ProjId); err != nil {
+		return err
+	}
 	var mode os.FileMode = fileWriteOnlyMode
+	meta, err := fsys.newFileMetadata(ctx, oph, parentDir, op.Name)
+	if err != nil {
+		return err
+	}
 	// we now know that the parent directory exists, and the file does not.
 	// Create a remote file for appending data and then update the metadata db
-	file, err := fsys.mdb.CreateFile(ctx, oph, &parentDir, op.Name, mode)
+	file, err := fsys.mdb.CreateFile(ctx, oph, &parentDir, op.Name, mode, meta)
 	if err != nil {
 		return err
 	}
@@ -819,181 +1174,1089 @@ func (fsys *Filesys) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) e
 		writeBuffer:       nil,
 		writeBufferOffset: 0,
 		mutex:             &sync.Mutex{},
+		uploadParams:      fsys.projId2Desc[parentDir.ProjId].UploadParams,
+		checksum:          NewUploadChecksum(),
 	}
 	op.Handle = fsys.insertIntoFileHandleTable(&fh)
 	return nil
 }
 
+// Create a hard link. Inside a project, this only adds a name in the
+// metadata database; the platform object stays in a single folder, under
+// the name it already has, and the link is lost when the filesystem is
+// unmounted. Across projects, the file is cloned into the target project.
+// A clone is a separate platform object, and gets its own inode.
 func (fsys *Filesys) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
-	// not supporting creation of hard links now
-	return fuse.ENOSYS
-}
-
-func (fsys *Filesys) renameFile(
-	ctx context.Context,
-	oph *OpHandle,
-	oldParentDir Dir,
-	newParentDir Dir,
-	file File,
-	newName string) error {
-	err := fsys.mdb.MoveFile(ctx, oph, file.Inode, newParentDir, newName)
-	if err != nil {
-		fsys.log("database error in rename")
-		return fuse.EIO
-	}
-
-	if file.Id == "" {
-		// The file has not been uploaded to the platform yet
-		return nil
-	}
-
-	// The file is on the platform, we need to move it on the backend.
-	if oldParentDir.Inode == newParentDir.Inode {
-		// /file-xxxx/rename  API call
-		err := fsys.ops.DxRename(ctx, oph.httpClient, file.ProjId, file.Id, newName)
-		if err != nil {
-			fsys.log("Error in renaming file (%s:%s%s) on dnanexus: %s",
-				file.ProjId, oldParentDir.ProjFolder, file.Name,
-				err.Error())
-			oph.RecordError(err)
-			return fsys.translateError(err)
-		}
-	} else {
-		// /project-xxxx/move     {objects, folders}  -> destination
-
-		// move the file on the platform
-		var objIds []string
-		objIds = append(objIds, file.Id)
-		err := fsys.ops.DxMove(ctx, oph.httpClient, file.ProjId,
-			objIds, nil, newParentDir.ProjFolder)
-		if err != nil {
-			fsys.log("Error in moving file (%s:%s/%s) on dnanexus: %s",
-				file.ProjId, oldParentDir.ProjFolder, file.Name,
-				err.Error())
-			oph.RecordError(err)
-			return fsys.translateError(err)
-		}
-	}
-
-	return nil
-}
-
-func (fsys *Filesys) renameDir(
-	ctx context.Context,
-	oph *OpHandle,
-	oldParentDir Dir,
-	newParentDir Dir,
-	oldDir Dir,
-	newName string) error {
-	projId := oldParentDir.ProjId
-
-	if oldParentDir.Inode == newParentDir.Inode {
-		// rename a folder, but leave it under the same parent
-		err := fsys.ops.DxRenameFolder(
-			ctx, oph.httpClient,
-			projId,
-			oldDir.ProjFolder,
-			newName)
-		if err != nil {
-			fsys.log("Error in folder rename %s -> %s on dnanexus, %s",
-				oldDir.FullPath, newName, err.Error())
-			oph.RecordError(err)
-			return fsys.translateError(err)
-		}
-	} else {
-		// we are moving a directory to another directory. For example:
-		//   mkdir A
-		//   mkdir B
-		//   mv A B/
-		// The name "A" should not change.
-		check(newName == filepath.Base(oldDir.Dname))
-
-		// move a folder to a new parent
-		objIds := make([]string, 0)
-		folders := make([]string, 1)
-		folders[0] = oldDir.ProjFolder
-
-		err := fsys.ops.DxMove(
-			ctx, oph.httpClient,
-			projId,
-			objIds, folders,
-			newParentDir.ProjFolder)
-		if err != nil {
-			fsys.log("Error in moving directory %s:%s -> %s on dnanexus: %s",
-				projId, oldDir.ProjFolder, newParentDir.ProjFolder,
-				err.Error())
-			oph.RecordError(err)
-			return fsys.translateError(err)
-		}
-	}
-
-	err := fsys.mdb.MoveDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
-	if err != nil {
-		fsys.log("Database error in moving directory %s -> %s/%s",
-			oldDir.FullPath, newParentDir.FullPath, newName)
-		return fuse.EIO
-	}
-
-	return nil
-}
-
-func (fsys *Filesys) Rename(ctx context.Context, op *fuseops.RenameOp) error {
 	fsys.mutex.Lock()
 	defer fsys.mutex.Unlock()
 	oph := fsys.opOpen()
 	defer fsys.opClose(oph)
 
 	if fsys.options.Verbose {
-		fsys.log("Rename (inode=%d name=%s) -> (inode=%d, name=%s)",
-			op.OldParent, op.OldName,
-			op.NewParent, op.NewName)
-	}
-
-	// the old parent is supposed to be a directory
-	oldParentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.OldParent))
-	if err != nil {
-		return err
-	}
-	if !ok {
-		// parent directory does not exist
-		return fuse.ENOENT
+		fsys.log("CreateLink(%s -> inode=%d)", op.Name, op.Target)
 	}
 
-	// the new parent is supposed to be a directory
-	newParentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.NewParent))
+	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Parent))
 	if err != nil {
 		return err
 	}
 	if !ok {
-		// parent directory does not exist
 		return fuse.ENOENT
 	}
-	if newParentDir.faux {
-		fsys.log("can not move files into a faux dir")
+	if parentDir.faux {
+		// cannot add names in faux directories
 		return syscall.EPERM
 	}
 
-	// Find the source file
-	srcNode, ok, err := fsys.mdb.LookupInDir(ctx, oph, &oldParentDir, op.OldName)
+	targetNode, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Target))
 	if err != nil {
 		return err
 	}
 	if !ok {
-		// The source file doesn't exist
 		return fuse.ENOENT
 	}
+	var file File
+	switch targetNode.(type) {
+	case File:
+		file = targetNode.(File)
+	case Dir:
+		// hard links to directories are not allowed
+		return syscall.EPERM
+	}
 
-	// check if the target exists.
-	_, ok, err = fsys.mdb.LookupInDir(ctx, oph, &newParentDir, op.NewName)
+	_, ok, err = fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
 	if err != nil {
 		return err
 	}
 	if ok {
-		fsys.log(`
-Target already exists. We do not support atomically remove in conjunction with
-a rename. You will need to issue a separate remove operation prior to rename.
-`)
-		return syscall.EPERM
+		return fuse.EEXIST
+	}
+
+	var linkNode Node
+	if parentDir.ProjId == file.ProjId {
+		if !fsys.checkProjectPermissions(parentDir.ProjId, PERM_CONTRIBUTE) {
+			return syscall.EPERM
+		}
+		if err := fsys.mdb.CreateLink(ctx, oph, file, parentDir, op.Name); err != nil {
+			return fuse.EIO
+		}
+		linkNode, _, err = fsys.mdb.LookupByInode(ctx, oph, file.Inode)
+	} else {
+		if !fsys.checkProjectPermissions(parentDir.ProjId, PERM_UPLOAD) {
+			return syscall.EPERM
+		}
+		var inode int64
+		inode, err = fsys.linkAcrossProjects(ctx, oph, parentDir, file, op.Name)
+		if err != nil {
+			return err
+		}
+		linkNode, _, err = fsys.mdb.LookupByInode(ctx, oph, inode)
+	}
+	if err != nil {
+		fsys.log("database error in CreateLink: %s", err.Error())
+		return fuse.EIO
+	}
+
+	op.Entry.Child = linkNode.GetInode()
+	op.Entry.Attributes = linkNode.GetAttrs()
+	op.Entry.AttributesExpiration = fsys.calcExpirationTime(op.Entry.Attributes)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return nil
+}
+
+// Clone a file into a different project, under a new name. Returns the inode
+// of the clone.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) linkAcrossProjects(
+	ctx context.Context,
+	oph *OpHandle,
+	parentDir Dir,
+	file File,
+	name string) (int64, error) {
+	if file.State != "closed" || fsys.inodeHasWriteHandle(file.Inode) {
+		fsys.log("File %s is not closed, it cannot be linked into a different project", file.Id)
+		return 0, syscall.EBUSY
+	}
+
+	objectIds := []string{file.Id}
+	exists, err := fsys.ops.DxClone(ctx, oph.httpClient, file.ProjId, objectIds, nil,
+		parentDir.ProjId, parentDir.ProjFolder)
+	if err != nil {
+		fsys.log("Error in cloning %s:%s to %s:%s on dnanexus: %s",
+			file.ProjId, file.Id, parentDir.ProjId, parentDir.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return 0, fsys.translateError(err)
+	}
+	if len(exists) > 0 {
+		fsys.log("File %s already exists in project %s", file.Id, parentDir.ProjId)
+		return 0, syscall.EEXIST
+	}
+
+	// remove the clone from the target project, if the link cannot be completed
+	undoClone := func() {
+		if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, parentDir.ProjId, objectIds); err != nil {
+			fsys.log("Error undoing the clone of %s into %s: %s", file.Id, parentDir.ProjId, err.Error())
+		}
+	}
+	if name != file.Name {
+		if err := fsys.ops.DxRename(ctx, oph.httpClient, parentDir.ProjId, file.Id, name); err != nil {
+			fsys.log("Error in renaming file %s:%s on dnanexus: %s",
+				parentDir.ProjId, file.Id, err.Error())
+			undoClone()
+			oph.RecordError(err)
+			return 0, fsys.translateError(err)
+		}
+	}
+
+	oDesc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, parentDir.ProjId, file.Id)
+	if err != nil {
+		fsys.log("Error in describing %s:%s on dnanexus: %s",
+			parentDir.ProjId, file.Id, err.Error())
+		undoClone()
+		oph.RecordError(err)
+		return 0, fsys.translateError(err)
+	}
+	inode, err := fsys.mdb.AddDataObject(oph, &parentDir, name, oDesc)
+	if err != nil {
+		undoClone()
+		return 0, fuse.EIO
+	}
+	return inode, nil
+}
+
+// A file with several hard links exists on the platform under only one of
+// its names. Check if parentDir/name is that name.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) isPlatformLocation(
+	ctx context.Context,
+	oph *OpHandle,
+	file File,
+	parentDir Dir,
+	name string) (bool, error) {
+	oDesc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if err != nil {
+		fsys.log("Error in describing %s:%s on dnanexus: %s",
+			file.ProjId, file.Id, err.Error())
+		return false, err
+	}
+	return oDesc.Folder == parentDir.ProjFolder && oDesc.Name == name, nil
+}
+
+// One name of a hard linked file was removed from the database. If the platform
+// object was located under that name, move it to one of the remaining names, so
+// that it will be found there the next time the project is mounted.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) relocateLinkedFile(
+	ctx context.Context,
+	oph *OpHandle,
+	file File,
+	parentDir Dir,
+	name string) error {
+	if file.Id == "" {
+		return nil
+	}
+	isLocation, err := fsys.isPlatformLocation(ctx, oph, file, parentDir, name)
+	if err != nil {
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if !isLocation {
+		return nil
+	}
+
+	links, err := fsys.mdb.LinksOfInode(ctx, oph, file.Inode)
+	if err != nil {
+		return fuse.EIO
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	dirPath, newName := splitPath(links[0])
+	_, projFolder, err := fsys.mdb.lookupDirByName(oph, dirPath)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	if projFolder != parentDir.ProjFolder {
+		objIds := []string{file.Id}
+		if err := fsys.ops.DxMove(ctx, oph.httpClient, file.ProjId, objIds, nil, projFolder); err != nil {
+			fsys.log("Error in moving file %s to %s:%s on dnanexus: %s",
+				file.Id, file.ProjId, projFolder, err.Error())
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+	}
+	if newName != name {
+		if err := fsys.ops.DxRename(ctx, oph.httpClient, file.ProjId, file.Id, newName); err != nil {
+			fsys.log("Error in renaming file %s:%s on dnanexus: %s",
+				file.ProjId, file.Id, err.Error())
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+	}
+	fsys.log("Hard linked file %s now located at %s:%s/%s", file.Id, file.ProjId, projFolder, newName)
+	return nil
+}
+
+// Create a symbolic link. On the platform, the link is an empty file
+// with a reserved property that holds the target. The marker is created,
+// and closed, without holding the global lock, because closing a file
+// takes a while.
+func (fsys *Filesys) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	if fsys.options.Verbose {
+		fsys.log("CreateSymlink(%s -> %s)", op.Name, op.Target)
+	}
+
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	parentDir, err := fsys.checkCreateSymlink(ctx, oph, op)
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fileId, err := fsys.createSymlinkMarker(ctx, parentDir, op.Name, op.Target)
+	if err != nil {
+		return err
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph = fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+
+	// The name may have been taken while the lock was released
+	_, ok, err := fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
+	if err == nil && !ok {
+		var file File
+		file, err = fsys.mdb.CreateSymlink(ctx, oph, &parentDir, op.Name, fileId, op.Target)
+		if err == nil {
+			op.Entry.Child = file.GetInode()
+			op.Entry.Attributes = file.GetAttrs()
+			op.Entry.AttributesExpiration = fsys.calcExpirationTime(op.Entry.Attributes)
+			op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+			return nil
+		}
+	}
+
+	// remove the marker, it has no name in the filesystem
+	httpClient := <-fsys.httpClientPool
+	if rmErr := fsys.ops.DxRemoveObjects(ctx, httpClient, parentDir.ProjId, []string{fileId}); rmErr != nil {
+		fsys.log("Error removing symlink marker %s: %s", fileId, rmErr.Error())
+	}
+	fsys.httpClientPool <- httpClient
+	if err != nil {
+		fsys.log("database error in CreateSymlink: %s", err.Error())
+		return fuse.EIO
+	}
+	return fuse.EEXIST
+}
+
+// Note: the global lock must be held
+func (fsys *Filesys) checkCreateSymlink(ctx context.Context, oph *OpHandle, op *fuseops.CreateSymlinkOp) (Dir, error) {
+	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.Parent))
+	if err != nil {
+		return Dir{}, err
+	}
+	if !ok {
+		return Dir{}, fuse.ENOENT
+	}
+	if parentDir.faux {
+		// cannot write new files into faux directories
+		return Dir{}, syscall.EPERM
+	}
+	_, ok, err = fsys.mdb.LookupInDir(ctx, oph, &parentDir, op.Name)
+	if err != nil {
+		return Dir{}, err
+	}
+	if ok {
+		return Dir{}, fuse.EEXIST
+	}
+	if !fsys.checkProjectPermissions(parentDir.ProjId, PERM_UPLOAD) {
+		return Dir{}, syscall.EPERM
+	}
+	return parentDir, nil
+}
+
+// Create a closed, empty file, that stands for a symbolic link.
+func (fsys *Filesys) createSymlinkMarker(
+	ctx context.Context,
+	parentDir Dir,
+	name string,
+	target string) (string, error) {
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+
+	meta := NewFileMetadata{Properties: map[string]string{SymlinkProperty: target}}
+	fileId, err := fsys.ops.DxFileNew(ctx, httpClient, NewNonce().String(),
+		parentDir.ProjId, name, parentDir.ProjFolder, meta)
+	if err != nil {
+		fsys.log("Error creating symlink %s:%s/%s: %s",
+			parentDir.ProjId, parentDir.ProjFolder, name, err.Error())
+		return "", fsys.translateError(err)
+	}
+
+	err = fsys.ops.DxFileUploadPart(ctx, httpClient, fileId, 1, nil)
+	if err == nil {
+		err = fsys.ops.DxFileCloseAndWait(ctx, httpClient, parentDir.ProjId, fileId)
+	}
+	if err != nil {
+		fsys.log("Error creating symlink %s:%s/%s: %s",
+			parentDir.ProjId, parentDir.ProjFolder, name, err.Error())
+		if rmErr := fsys.ops.DxRemoveObjects(ctx, httpClient, parentDir.ProjId, []string{fileId}); rmErr != nil {
+			fsys.log("Error removing symlink marker %s: %s", fileId, rmErr.Error())
+		}
+		return "", fsys.translateError(err)
+	}
+	return fileId, nil
+}
+
+func (fsys *Filesys) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+
+	node, ok, err := fsys.mdb.LookupByInode(ctx, oph, int64(op.Inode))
+	if err != nil {
+		fsys.log("database error in ReadSymlink: %s", err.Error())
+		return fuse.EIO
+	}
+	if !ok {
+		return fuse.ENOENT
+	}
+	file, isFile := node.(File)
+	if !isFile || file.Kind != FK_PosixSymlink {
+		return fuse.EINVAL
+	}
+	op.Target = file.Symlink
+	return nil
+}
+
+func (fsys *Filesys) renameFile(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	file File,
+	newName string) error {
+	if oldParentDir.ProjId != newParentDir.ProjId {
+		return fsys.moveFileAcrossProjects(ctx, oph, oldParentDir, newParentDir, file, newName)
+	}
+
+	err := fsys.mdb.MoveFile(ctx, oph, file.Inode, oldParentDir, file.Name, newParentDir, newName)
+	if err != nil {
+		fsys.log("database error in rename")
+		return fuse.EIO
+	}
+
+	if file.Id == "" {
+		// The file has not been uploaded to the platform yet
+		return nil
+	}
+	if file.Nlink > 1 {
+		// The platform object is located under one of the names. If this is
+		// a different name, there is nothing to change on the platform.
+		isLocation, err := fsys.isPlatformLocation(ctx, oph, file, oldParentDir, file.Name)
+		if err != nil {
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+		if !isLocation {
+			return nil
+		}
+	}
+
+	// The file is on the platform, we need to move it on the backend.
+	if oldParentDir.Inode == newParentDir.Inode {
+		// /file-xxxx/rename  API call
+		err := fsys.ops.DxRename(ctx, oph.httpClient, file.ProjId, file.Id, newName)
+		if err != nil {
+			fsys.log("Error in renaming file (%s:%s%s) on dnanexus: %s",
+				file.ProjId, oldParentDir.ProjFolder, file.Name,
+				err.Error())
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+	} else {
+		// /project-xxxx/move     {objects, folders}  -> destination
+
+		// move the file on the platform
+		var objIds []string
+		objIds = append(objIds, file.Id)
+		err := fsys.ops.DxMove(ctx, oph.httpClient, file.ProjId,
+			objIds, nil, newParentDir.ProjFolder)
+		if err != nil {
+			fsys.log("Error in moving file (%s:%s/%s) on dnanexus: %s",
+				file.ProjId, oldParentDir.ProjFolder, file.Name,
+				err.Error())
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+
+		// the move keeps the name, rename if the file has a new one
+		if newName != file.Name {
+			err := fsys.ops.DxRename(ctx, oph.httpClient, file.ProjId, file.Id, newName)
+			if err != nil {
+				fsys.log("Error in renaming file (%s:%s/%s) on dnanexus: %s",
+					file.ProjId, newParentDir.ProjFolder, file.Name,
+					err.Error())
+				oph.RecordError(err)
+				return fsys.translateError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Move a file to a different project. The file is cloned into the target
+// project, and then removed from the source project. No data is copied.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) moveFileAcrossProjects(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	file File,
+	newName string) error {
+	if file.Nlink > 1 {
+		// The other names would lose the platform object. Tell the caller to
+		// copy the data, and remove just this name.
+		return syscall.EXDEV
+	}
+	if _, ok := fsys.rewrites[file.Inode]; ok || file.State != "closed" || fsys.inodeHasWriteHandle(file.Inode) {
+		fsys.log("File %s is not closed, it cannot be moved to a different project", file.Id)
+		return syscall.EBUSY
+	}
+
+	objectIds := []string{file.Id}
+	exists, err := fsys.ops.DxClone(ctx, oph.httpClient, file.ProjId, objectIds, nil,
+		newParentDir.ProjId, newParentDir.ProjFolder)
+	if err != nil {
+		fsys.log("Error in cloning %s:%s to %s:%s on dnanexus: %s",
+			file.ProjId, file.Id, newParentDir.ProjId, newParentDir.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if len(exists) > 0 {
+		fsys.log("File %s already exists in project %s", file.Id, newParentDir.ProjId)
+		return syscall.EEXIST
+	}
+
+	// remove the clone from the target project, if the move cannot be completed
+	undoClone := func() {
+		if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, newParentDir.ProjId, objectIds); err != nil {
+			fsys.log("Error undoing the clone of %s into %s: %s", file.Id, newParentDir.ProjId, err.Error())
+		}
+	}
+	if newName != file.Name {
+		if err := fsys.ops.DxRename(ctx, oph.httpClient, newParentDir.ProjId, file.Id, newName); err != nil {
+			fsys.log("Error in renaming file %s:%s on dnanexus: %s",
+				newParentDir.ProjId, file.Id, err.Error())
+			undoClone()
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+	}
+	if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, file.ProjId, objectIds); err != nil {
+		fsys.log("Error in removing %s from project %s on dnanexus: %s",
+			file.Id, file.ProjId, err.Error())
+		undoClone()
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+
+	if err := fsys.mdb.MoveFile(ctx, oph, file.Inode, oldParentDir, file.Name, newParentDir, newName); err != nil {
+		fsys.log("database error in rename")
+		return fuse.EIO
+	}
+	return nil
+}
+
+// Check that a directory can be renamed, before anything is changed. A
+// directory cannot move into itself. A directory moved to a different
+// project is cloned, so its files must be closed, none of them may have
+// hard links outside of it, and its original name must be free in the
+// target, where the clone is created.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) checkRenameDir(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	newName string) error {
+	if newParentDir.FullPath == oldDir.FullPath ||
+		strings.HasPrefix(newParentDir.FullPath, oldDir.FullPath+"/") {
+		fsys.log("Can not move directory %s into itself", oldDir.FullPath)
+		return syscall.EINVAL
+	}
+	if oldParentDir.ProjId == newParentDir.ProjId {
+		return nil
+	}
+
+	// Removed files must not be cloned along with the folder
+	if err := fsys.remover.Flush(); err != nil {
+		fsys.log("A queued removal failed: %s", err.Error())
+		return fsys.translateError(err)
+	}
+
+	// Open files cannot be cloned
+	numUnclosed, err := fsys.mdb.CountUnclosedInSubtree(oph, oldDir.FullPath)
+	if err != nil {
+		fsys.log("database error in rename %s", err.Error())
+		return fuse.EIO
+	}
+	if numUnclosed > 0 {
+		fsys.log("Directory %s has %d files that are not closed, it cannot be moved to a different project",
+			oldDir.FullPath, numUnclosed)
+		return syscall.EBUSY
+	}
+	numExternal, err := fsys.mdb.CountExternalLinks(oph, oldDir.FullPath)
+	if err != nil {
+		fsys.log("database error in rename %s", err.Error())
+		return fuse.EIO
+	}
+	if numExternal > 0 {
+		fsys.log("Directory %s has %d files with hard links outside of it, it cannot be moved to a different project",
+			oldDir.FullPath, numExternal)
+		return syscall.EXDEV
+	}
+
+	// The clone keeps the folder name. It is renamed afterwards, so
+	// a folder with the original name must not exist in the target.
+	baseName := filepath.Base(oldDir.ProjFolder)
+	if baseName != newName {
+		_, ok, err := fsys.mdb.LookupInDir(ctx, oph, &newParentDir, baseName)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fsys.log("Can not move %s to project %s, %s/%s already exists",
+				oldDir.FullPath, newParentDir.ProjId, newParentDir.FullPath, baseName)
+			return syscall.EEXIST
+		}
+	}
+	return nil
+}
+
+// Move a directory to a different project. The folder is cloned into the
+// target project, and then removed from the source project. The checks of
+// checkRenameDir must have passed. The database is updated before the
+// source is removed, so that a failure leaves the source in place.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) moveDirAcrossProjects(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	newName string) error {
+	baseName := filepath.Base(oldDir.ProjFolder)
+	folders := []string{oldDir.ProjFolder}
+	exists, err := fsys.ops.DxClone(ctx, oph.httpClient, oldDir.ProjId, nil, folders,
+		newParentDir.ProjId, newParentDir.ProjFolder)
+	if err != nil {
+		fsys.log("Error in cloning folder %s:%s to %s:%s on dnanexus: %s",
+			oldDir.ProjId, oldDir.ProjFolder, newParentDir.ProjId, newParentDir.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+
+	clonedFolder := filepath.Join(newParentDir.ProjFolder, baseName)
+	undoClone := func() {
+		if err := fsys.ops.DxFolderRemove(ctx, oph.httpClient, newParentDir.ProjId, clonedFolder, true); err != nil {
+			fsys.log("Error undoing the clone of folder %s into %s:%s: %s",
+				oldDir.ProjFolder, newParentDir.ProjId, clonedFolder, err.Error())
+		}
+	}
+	if len(exists) > 0 {
+		// Some of the objects are already in the target project, in other
+		// folders. Removing the source would lose track of them.
+		fsys.log("Objects %v already exist in project %s, can not move folder %s",
+			exists, newParentDir.ProjId, oldDir.ProjFolder)
+		undoClone()
+		return oph.RecordError(syscall.EEXIST)
+	}
+	if baseName != newName {
+		if err := fsys.ops.DxRenameFolder(ctx, oph.httpClient, newParentDir.ProjId, clonedFolder, newName); err != nil {
+			fsys.log("Error in folder rename %s:%s -> %s on dnanexus, %s",
+				newParentDir.ProjId, clonedFolder, newName, err.Error())
+			undoClone()
+			oph.RecordError(err)
+			return fsys.translateError(err)
+		}
+		clonedFolder = filepath.Join(newParentDir.ProjFolder, newName)
+	}
+
+	if err := fsys.mdb.MoveDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName); err != nil {
+		fsys.log("Database error in moving directory %s -> %s/%s",
+			oldDir.FullPath, newParentDir.FullPath, newName)
+		undoClone()
+		oph.RecordError(err)
+		return fuse.EIO
+	}
+	if err := fsys.ops.DxFolderRemove(ctx, oph.httpClient, oldDir.ProjId, oldDir.ProjFolder, true); err != nil {
+		fsys.log("Error in removing folder %s:%s on dnanexus: %s",
+			oldDir.ProjId, oldDir.ProjFolder, err.Error())
+		// the database update is rolled back
+		undoClone()
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	return nil
+}
+
+// Rename a file, replacing an existing target file. The platform requires two
+// calls for this, moving the source, and removing the target. The source is
+// moved first, so that if the target cannot be removed, the move can be
+// undone, and the target is left intact. The database is modified in a single
+// transaction, that is rolled back on failure. This makes the replacement atomic
+// from the point of view of the mount.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) renameFileOverTarget(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	file File,
+	target File,
+	newName string) error {
+	if target.Inode == file.Inode {
+		// both names refer to the same file, there is nothing to do
+		return nil
+	}
+	if _, ok := fsys.rewrites[target.Inode]; ok || fsys.inodeHasWriteHandle(target.Inode) {
+		fsys.log("Target %s/%s is being written, it cannot be replaced",
+			newParentDir.FullPath, newName)
+		return syscall.EBUSY
+	}
+
+	// clear the name in the database
+	lastLink, err := fsys.mdb.Unlink(ctx, oph, newParentDir, newName, target)
+	if err != nil {
+		fsys.log("database error in rename %s", err.Error())
+		return fuse.EIO
+	}
+	if !lastLink {
+		// The target has other names, it stays on the platform
+		if err := fsys.relocateLinkedFile(ctx, oph, target, newParentDir, newName); err != nil {
+			return err
+		}
+	}
+	if err := fsys.renameFile(ctx, oph, oldParentDir, newParentDir, file, newName); err != nil {
+		oph.RecordError(err)
+		return err
+	}
+	if !lastLink {
+		return nil
+	}
+
+	// remove the target on the platform
+	objectIds := []string{target.Id}
+	folder, err := fsys.platformFolder(ctx, oph, newParentDir, target)
+	if err == nil {
+		err = fsys.removeObjects(ctx, oph.httpClient, target.ProjId, folder, objectIds)
+	}
+	if err != nil {
+		fsys.log("Error in removing rename target %s:%s/%s on dnanexus: %s",
+			target.ProjId, newParentDir.ProjFolder, newName, err.Error())
+		oph.RecordError(err)
+
+		// move the source back to where it was. It is now under the new
+		// name, in the project of the target.
+		moved := file
+		moved.Name = newName
+		moved.ProjId = newParentDir.ProjId
+		if undoErr := fsys.renameFile(ctx, oph, newParentDir, oldParentDir, moved, file.Name); undoErr != nil {
+			fsys.log("Error undoing the move of %s, it remains in %s:%s",
+				file.Id, newParentDir.ProjId, newParentDir.ProjFolder)
+		}
+		return fsys.translateError(err)
+	}
+	fsys.log("Replaced %s:%s/%s with %s", target.ProjId, newParentDir.ProjFolder, newName, file.Id)
+	return nil
+}
+
+// Is there a file handle that is writing to this inode?
+//
+// Note: the global lock must be held
+func (fsys *Filesys) inodeHasWriteHandle(inode int64) bool {
+	for _, fh := range fsys.fhTable {
+		if fh.inode == inode && fh.accessMode == AM_AO_Remote {
+			return true
+		}
+	}
+	return false
+}
+
+// A folder operation returned an error. The platform may have completed it
+// anyway, for example, if the reply was lost. Check whether the folder is
+// now in its new place, and no longer in the old one.
+func (fsys *Filesys) folderMoved(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	from string,
+	to string) bool {
+	if _, err := listFolder(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, to, false); err != nil {
+		return false
+	}
+	_, err := listFolder(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, from, false)
+	return err != nil && isNotFound(err)
+}
+
+// Run a platform call that moves folder [from] to [to]. An error is ignored
+// if the folder did move.
+func (fsys *Filesys) folderStep(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	from string,
+	to string,
+	step func() error) error {
+	err := step()
+	if err == nil {
+		return nil
+	}
+	if fsys.folderMoved(ctx, httpClient, projId, from, to) {
+		fsys.log("Folder %s:%s was moved to %s, despite the error %s",
+			projId, from, to, err.Error())
+		return nil
+	}
+	return err
+}
+
+// Move a folder to a new parent folder, and give it a new name. The platform
+// cannot do both in one call. The folder is first renamed in place, and then
+// moved. The intermediate name has to be free in both parents; if the new
+// name is taken in the old parent, a temporary name is used, and the folder
+// is renamed again after the move. If a step fails, the steps before it are
+// undone, so the folder ends up either in its old place, or in its new place.
+func (fsys *Filesys) moveFolder(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	srcFolder string,
+	dstParentFolder string,
+	newName string) error {
+	srcParentFolder := filepath.Dir(srcFolder)
+	oldName := filepath.Base(srcFolder)
+	dstFolder := filepath.Join(dstParentFolder, newName)
+
+	if srcParentFolder == dstParentFolder {
+		return fsys.folderStep(ctx, httpClient, projId, srcFolder, dstFolder, func() error {
+			return fsys.ops.DxRenameFolder(ctx, httpClient, projId, srcFolder, newName)
+		})
+	}
+
+	midName := oldName
+	if newName != oldName {
+		srcParentInfo, err := listFolder(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, srcParentFolder, false)
+		if err != nil {
+			return err
+		}
+		midName = newName
+		for _, subdir := range srcParentInfo.subdirs {
+			if filepath.Base(subdir) == newName {
+				midName = ".dxfuse_rename_" + NewNonce().String()
+				break
+			}
+		}
+		err = fsys.folderStep(ctx, httpClient, projId, srcFolder, filepath.Join(srcParentFolder, midName),
+			func() error {
+				return fsys.ops.DxRenameFolder(ctx, httpClient, projId, srcFolder, midName)
+			})
+		if err != nil {
+			return err
+		}
+	}
+	midFolder := filepath.Join(srcParentFolder, midName)
+	undoRename := func() {
+		if midName == oldName {
+			return
+		}
+		if err := fsys.ops.DxRenameFolder(ctx, httpClient, projId, midFolder, oldName); err != nil {
+			fsys.log("Error undoing the rename of folder %s:%s, it remains at %s, %s",
+				projId, srcFolder, midFolder, err.Error())
+		}
+	}
+
+	dstMidFolder := filepath.Join(dstParentFolder, midName)
+	err := fsys.folderStep(ctx, httpClient, projId, midFolder, dstMidFolder, func() error {
+		return fsys.ops.DxMove(ctx, httpClient, projId, nil, []string{midFolder}, dstParentFolder)
+	})
+	if err != nil {
+		undoRename()
+		return err
+	}
+
+	if midName != newName {
+		err := fsys.folderStep(ctx, httpClient, projId, dstMidFolder, dstFolder, func() error {
+			return fsys.ops.DxRenameFolder(ctx, httpClient, projId, dstMidFolder, newName)
+		})
+		if err != nil {
+			if undoErr := fsys.ops.DxMove(ctx, httpClient, projId, nil, []string{dstMidFolder}, srcParentFolder); undoErr != nil {
+				fsys.log("Error undoing the move of folder %s:%s, it remains at %s, %s",
+					projId, srcFolder, dstMidFolder, undoErr.Error())
+				return err
+			}
+			undoRename()
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename a directory, and move it to a new parent. The database update runs
+// in the operation transaction, and the platform folder is moved last. Every
+// failure is recorded in the transaction, so the database is left unchanged.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) renameDir(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	newName string) error {
+	if err := fsys.checkRenameDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName); err != nil {
+		oph.RecordError(err)
+		return err
+	}
+	return fsys.moveCheckedDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
+}
+
+// Rename a directory that passed the checks of checkRenameDir
+//
+// Note: the global lock must be held
+func (fsys *Filesys) moveCheckedDir(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	newName string) error {
+	if oldParentDir.ProjId != newParentDir.ProjId {
+		return fsys.moveDirAcrossProjects(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
+	}
+	projId := oldParentDir.ProjId
+	newProjFolder := filepath.Join(newParentDir.ProjFolder, newName)
+
+	err := fsys.mdb.MoveDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName)
+	if err != nil {
+		fsys.log("Database error in moving directory %s -> %s/%s",
+			oldDir.FullPath, newParentDir.FullPath, newName)
+		oph.RecordError(err)
+		return fuse.EIO
+	}
+	err = fsys.moveFolder(ctx, oph.httpClient, projId, oldDir.ProjFolder, newParentDir.ProjFolder, newName)
+	if err != nil {
+		// the folder is back in its old place, and the database
+		// update is rolled back
+		fsys.log("Error in moving directory %s:%s -> %s on dnanexus: %s",
+			projId, oldDir.ProjFolder, newProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	fsys.remover.MoveFolder(projId, oldDir.ProjFolder, newProjFolder)
+	return nil
+}
+
+// Rename a directory, replacing an existing empty directory. Output
+// committers often create the target in advance. All the checks run first.
+// The target folder is then removed, and created again if the rename fails,
+// in which case the database changes are rolled back.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) renameDirOverTarget(
+	ctx context.Context,
+	oph *OpHandle,
+	oldParentDir Dir,
+	newParentDir Dir,
+	oldDir Dir,
+	target Dir,
+	newName string) error {
+	if target.faux {
+		fsys.log("can not replace a faux directory")
+		return syscall.EPERM
+	}
+	dentries, err := fsys.readEntireDir(ctx, oph, target)
+	if err != nil {
+		return err
+	}
+	if len(dentries) > 0 {
+		return fuse.ENOTEMPTY
+	}
+	if err := fsys.checkRenameDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName); err != nil {
+		oph.RecordError(err)
+		return err
+	}
+
+	if err := fsys.removeFolder(ctx, oph, target.ProjId, target.ProjFolder); err != nil {
+		fsys.log("Error in removing rename target %s:%s on dnanexus: %s",
+			target.ProjId, target.ProjFolder, err.Error())
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if err := fsys.mdb.RemoveEmptyDir(oph, target.Inode); err != nil {
+		if undoErr := fsys.ops.DxFolderNew(ctx, oph.httpClient, target.ProjId, target.ProjFolder); undoErr != nil {
+			fsys.log("Error recreating folder %s:%s, %s",
+				target.ProjId, target.ProjFolder, undoErr.Error())
+		}
+		oph.RecordError(err)
+		return fuse.EIO
+	}
+
+	if err := fsys.moveCheckedDir(ctx, oph, oldParentDir, newParentDir, oldDir, newName); err != nil {
+		if undoErr := fsys.ops.DxFolderNew(ctx, oph.httpClient, target.ProjId, target.ProjFolder); undoErr != nil {
+			fsys.log("Error recreating folder %s:%s, %s",
+				target.ProjId, target.ProjFolder, undoErr.Error())
+		}
+		oph.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Take the global lock, once the files that are being written under a
+// directory have no parts in flight. A directory is moved only after these
+// uploads complete. The waiting is done without holding the global lock, so
+// writers may send new parts meanwhile, and we check again once it is taken.
+func (fsys *Filesys) lockWithoutUploadsUnder(ctx context.Context, parent fuseops.InodeID, name string) {
+	for {
+		fsys.mutex.Lock()
+		oph := fsys.opOpenNoHttpClient()
+		writers := fsys.writeHandlesUnder(ctx, oph, int64(parent), name)
+		fsys.opClose(oph)
+
+		var busy []*FileHandle
+		for _, fh := range writers {
+			if atomic.LoadInt32(&fh.partsInFlight) > 0 {
+				busy = append(busy, fh)
+			}
+		}
+		if len(busy) == 0 {
+			return
+		}
+		fsys.mutex.Unlock()
+
+		for _, fh := range busy {
+			fh.mutex.Lock()
+			fh.wg.Wait()
+			fh.mutex.Unlock()
+		}
+	}
+}
+
+// Find the write handles of files under a directory. Returns nothing if the
+// path is not a directory.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) writeHandlesUnder(
+	ctx context.Context,
+	oph *OpHandle,
+	parent int64,
+	name string) []*FileHandle {
+	parentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, parent)
+	if err != nil || !ok {
+		return nil
+	}
+	node, ok, err := fsys.mdb.LookupInDir(ctx, oph, &parentDir, name)
+	if err != nil || !ok {
+		return nil
+	}
+	dir, isDir := node.(Dir)
+	if !isDir {
+		return nil
+	}
+	inodes, err := fsys.mdb.DataObjectsInSubtree(oph, dir.FullPath)
+	if err != nil {
+		return nil
+	}
+
+	var writers []*FileHandle
+	for _, fh := range fsys.fhTable {
+		if fh.accessMode == AM_AO_Remote && inodes[fh.inode] {
+			writers = append(writers, fh)
+		}
+	}
+	return writers
+}
+
+func (fsys *Filesys) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	fsys.lockWithoutUploadsUnder(ctx, op.OldParent, op.OldName)
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpen()
+	defer fsys.opClose(oph)
+
+	if fsys.options.Verbose {
+		fsys.log("Rename (inode=%d name=%s) -> (inode=%d, name=%s)",
+			op.OldParent, op.OldName,
+			op.NewParent, op.NewName)
+	}
+
+	// the old parent is supposed to be a directory
+	oldParentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.OldParent))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// parent directory does not exist
+		return fuse.ENOENT
+	}
+
+	// the new parent is supposed to be a directory
+	newParentDir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, int64(op.NewParent))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// parent directory does not exist
+		return fuse.ENOENT
+	}
+	if newParentDir.faux {
+		fsys.log("can not move files into a faux dir")
+		return syscall.EPERM
+	}
+
+	// Find the source file
+	srcNode, ok, err := fsys.mdb.LookupInDir(ctx, oph, &oldParentDir, op.OldName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The source file doesn't exist
+		return fuse.ENOENT
+	}
+
+	// check if the target exists.
+	dstNode, dstExists, err := fsys.mdb.LookupInDir(ctx, oph, &newParentDir, op.NewName)
+	if err != nil {
+		return err
+	}
+	if dstExists {
+		// A file can replace an existing file, and a directory can
+		// replace an existing empty directory.
+		_, srcIsFile := srcNode.(File)
+		_, dstIsFile := dstNode.(File)
+		if srcIsFile && !dstIsFile {
+			return syscall.EISDIR
+		}
+		if !srcIsFile && dstIsFile {
+			return syscall.ENOTDIR
+		}
 	}
 	if !fsys.checkProjectPermissions(oldParentDir.ProjId, PERM_CONTRIBUTE) {
 		return syscall.EPERM
@@ -1015,9 +2278,10 @@ a rename. You will need to issue a separate remove operation prior to rename.
 		fsys.log("Can not move into the root directory")
 		return syscall.EPERM
 	}
-	if oldParentDir.ProjId != newParentDir.ProjId {
-		// can't move between projects
-		fsys.log("Can not move objects between projects")
+	if oldParentDir.ProjId != newParentDir.ProjId &&
+		!fsys.checkProjectPermissions(newParentDir.ProjId, PERM_UPLOAD) {
+		// moving between projects clones into the target project,
+		// and removes from the source
 		return syscall.EPERM
 	}
 
@@ -1029,6 +2293,15 @@ a rename. You will need to issue a separate remove operation prior to rename.
 
 	switch srcNode.(type) {
 	case File:
+		if _, ok := fsys.rewrites[srcNode.(File).Inode]; ok {
+			// the new version keeps the name the file had when it was opened
+			fsys.log("File %s is being rewritten, it cannot be renamed", op.OldName)
+			return syscall.EBUSY
+		}
+		if dstExists {
+			return fsys.renameFileOverTarget(ctx, oph, oldParentDir, newParentDir,
+				srcNode.(File), dstNode.(File), op.NewName)
+		}
 		return fsys.renameFile(ctx, oph, oldParentDir, newParentDir, srcNode.(File), op.NewName)
 	case Dir:
 		srcDir := srcNode.(Dir)
@@ -1036,6 +2309,10 @@ a rename. You will need to issue a separate remove operation prior to rename.
 			fsys.log("can not move a faux directory")
 			return syscall.EPERM
 		}
+		if dstExists {
+			return fsys.renameDirOverTarget(ctx, oph, oldParentDir, newParentDir,
+				srcDir, dstNode.(Dir), op.NewName)
+		}
 		return fsys.renameDir(ctx, oph, oldParentDir, newParentDir, srcDir, op.NewName)
 	default:
 		log.Panicf("bad type for srcNode %v", srcNode)
@@ -1086,7 +2363,8 @@ func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 		return fuse.EINVAL
 	}
 
-	if err := fsys.mdb.Unlink(ctx, oph, fileToRemove); err != nil {
+	lastLink, err := fsys.mdb.Unlink(ctx, oph, parentDir, op.Name, fileToRemove)
+	if err != nil {
 		fsys.log("database error in unlink %s", err.Error())
 		return fuse.EIO
 	}
@@ -1096,16 +2374,19 @@ func (fsys *Filesys) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
 	if fileToRemove.Id == "" {
 		return nil
 	}
+	if !lastLink {
+		// The file still has other names, keep it on the platform
+		return fsys.relocateLinkedFile(ctx, oph, fileToRemove, parentDir, op.Name)
+	}
 
 	// remove the file on the platform
-	objectIds := make([]string, 1)
-	objectIds[0] = fileToRemove.Id
-	if err := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, parentDir.ProjId, objectIds); err != nil {
-		fsys.log("Error in removing %s:%s%s on dnanexus: %s",
-			parentDir.ProjId, parentDir.ProjFolder, op.Name,
-			err.Error())
+	folder, err := fsys.platformFolder(ctx, oph, parentDir, fileToRemove)
+	if err != nil {
+		oph.RecordError(err)
 		return fsys.translateError(err)
 	}
+	// The removal is queued, and sent together with other removals
+	fsys.remover.Enqueue(parentDir.ProjId, folder, fileToRemove.Id)
 	fsys.log("Removed %s, %s:%s%s", op.Name, parentDir.ProjId, parentDir.ProjFolder, op.Name)
 
 	return nil
@@ -1142,6 +2423,8 @@ func (fsys *Filesys) readEntireDir(ctx context.Context, oph *OpHandle, dir Dir)
 			dType = fuseutil.DT_File
 		case FK_Symlink:
 			dType = fuseutil.DT_File
+		case FK_PosixSymlink:
+			dType = fuseutil.DT_Link
 		default:
 			// There is no good way to represent these
 			// in the filesystem.
@@ -1281,18 +2564,51 @@ func (fsys *Filesys) openRegularFile(
 			writeBuffer:       nil,
 			writeBufferOffset: 0,
 			mutex:             &sync.Mutex{},
+			uploadParams:      fsys.projId2Desc[f.ProjId].UploadParams,
+			checksum:          NewUploadChecksum(),
 		}
 
 		return fh, nil
 	}
 
+	// In limitedWrite mode, a closed file opened write-only, or with
+	// truncation, is rewritten. Files opened for reading and writing are
+	// rewritten only if they are truncated to zero, so that writing a few
+	// bytes does not replace the whole file. Closed files cannot be
+	// appended to.
+	flags := uint32(op.OpenFlags)
+	writable := !op.OpenFlags.IsReadOnly() && !fsys.options.ReadOnly
+	appending := flags&syscall.O_APPEND != 0 && flags&syscall.O_TRUNC == 0
+	// Replacing a file requires removing the old version
+	if writable && (appending || !fsys.checkProjectPermissions(f.ProjId, PERM_CONTRIBUTE)) {
+		if op.OpenFlags.IsWriteOnly() {
+			return nil, syscall.EPERM
+		}
+		writable = false
+	}
+	if writable && (op.OpenFlags.IsWriteOnly() || flags&syscall.O_TRUNC != 0) {
+		fh := &FileHandle{
+			accessMode: AM_RO_Remote,
+			inode:      f.Inode,
+			size:       f.Size,
+			Id:         f.Id,
+			url:        nil,
+			Tgid:       tgid,
+			mutex:      &sync.Mutex{},
+		}
+		if err := fsys.startFileRewrite(ctx, oph, fh); err != nil {
+			return nil, err
+		}
+		return fh, nil
+	}
+
 	// A remote (immutable) file.
 	// create a download URL for this file.
 	const secondsInYear int = 60 * 60 * 24 * 365
 	payload := fmt.Sprintf("{\"project\": \"%s\", \"duration\": %d}",
 		f.ProjId, secondsInYear)
 
-	body, err := dxda.DxAPI(ctx, oph.httpClient, NumRetriesDefault, &fsys.dxEnv, fmt.Sprintf("%s/download", f.Id), payload)
+	body, err := dxAPI(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, fmt.Sprintf("%s/download", f.Id), payload)
 	if err != nil {
 		oph.RecordError(err)
 		return nil, fsys.translateError(err)
@@ -1312,6 +2628,14 @@ func (fsys *Filesys) openRegularFile(
 		writeBuffer:       nil,
 		writeBufferOffset: 0,
 		mutex:             nil,
+		readChecksum:      nil,
+		rewritable:        writable,
+	}
+	if writable {
+		fh.mutex = &sync.Mutex{}
+	}
+	if fsys.options.VerifyReads {
+		fh.readChecksum = NewReadChecksum(f.ProjId, f.Properties[Md5Property])
 	}
 
 	return fh, nil
@@ -1402,8 +2726,12 @@ func (fsys *Filesys) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error
 
 	if fh.accessMode == AM_RO_Remote {
 		// enable page cache for reads because file contents are immutable
-		// page cache enables shared read-only mmap access
-		op.KeepPageCache = true
+		// page cache enables shared read-only mmap access.
+		//
+		// The cached pages of a file that was rewritten since it was last
+		// opened are stale, have the kernel drop them.
+		op.KeepPageCache = !fsys.rewritten[file.Inode]
+		delete(fsys.rewritten, file.Inode)
 		op.UseDirectIO = false
 		// Create an entry in the prefetch table
 		fsys.pgs.CreateStreamEntry(fh.hid, file, *fh.url)
@@ -1439,7 +2767,7 @@ func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp,
 	len := fsys.pgs.CacheLookup(fh.hid, op.Offset, endOfs, op.Dst)
 	if len > 0 {
 		op.BytesRead = len
-		return nil
+		return fsys.verifyRead(ctx, fh, op.Offset, op.Dst[:len])
 	}
 
 	// The data has not been prefetched. Get the data from DNAx with an
@@ -1460,18 +2788,28 @@ func (fsys *Filesys) readRemoteFile(ctx context.Context, op *fuseops.ReadFileOp,
 
 	// Take an http client from the pool. Return it when done.
 	httpClient := <-fsys.httpClientPool
-	err := dxda.DxHttpRequestData(
-		ctx,
-		httpClient,
-		"GET",
-		fh.url.URL,
-		headers,
-		[]byte("{}"),
-		int(reqSize),
-		op.Dst)
+	err := fsys.ops.retry.Do(ctx, "read", true, func(ctx context.Context) error {
+		resp, err := dxHttpRequest(ctx, httpClient, "GET", fh.url.URL, headers, nil)
+		if err != nil {
+			return err
+		}
+		recvLen, _ := io.ReadFull(resp.Body, op.Dst[:reqSize])
+		resp.Body.Close()
+		if int64(recvLen) != reqSize {
+			fsys.log("received length is wrong, got %d, expected %d. Retrying.", recvLen, reqSize)
+			return errShortRead
+		}
+		return nil
+	})
 	fsys.httpClientPool <- httpClient
+	if err != nil {
+		return err
+	}
+	if err := fsys.verifyRead(ctx, fh, op.Offset, op.Dst[:reqSize]); err != nil {
+		return err
+	}
 	op.BytesRead = int(reqSize)
-	return err
+	return nil
 }
 
 func (fsys *Filesys) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
@@ -1485,6 +2823,12 @@ func (fsys *Filesys) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error
 	}
 	fsys.mutex.Unlock()
 
+	// The mode of a handle with a lock may change, when it starts a
+	// rewrite, or is closed.
+	if fh.mutex != nil {
+		fh.mutex.Lock()
+		defer fh.mutex.Unlock()
+	}
 	switch fh.accessMode {
 	case AM_RO_Remote:
 		return fsys.readRemoteFile(ctx, op, fh)
@@ -1497,6 +2841,132 @@ func (fsys *Filesys) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error
 	}
 }
 
+// Start rewriting a closed file. A new, empty, file is created on the
+// platform with the same name, folder, tags, and properties. It is hidden,
+// and the inode keeps referring to the old version, until the new one is
+// closed. From here on, the handle is append-only.
+//
+// Note: the global lock must be held, and the handle lock, unless the
+// handle is being opened
+func (fsys *Filesys) startFileRewrite(ctx context.Context, oph *OpHandle, fh *FileHandle) error {
+	if fh.accessMode == AM_AO_Remote {
+		// already started through this handle
+		return nil
+	}
+	file, _, err := fsys.lookupFileByInode(ctx, oph, fh.inode)
+	if err != nil {
+		return err
+	}
+	if _, ok := fsys.rewrites[file.Inode]; ok || file.Id != fh.Id || file.State != "closed" {
+		// the file is being rewritten through a different handle
+		return syscall.EBUSY
+	}
+	if fsys.options.Verbose {
+		fsys.log("Rewrite file (%s,%s)", file.Name, file.Id)
+	}
+	if err := fsys.checkWriteBufferMemory(file.ProjId); err != nil {
+		return err
+	}
+	links, err := fsys.mdb.LinksOfInode(ctx, oph, fh.inode)
+	if err != nil || len(links) == 0 {
+		fsys.log("database error in rewriting file %s", file.Id)
+		oph.RecordError(fuse.EIO)
+		return fuse.EIO
+	}
+
+	// The name and folder on the platform may be different from what
+	// we show; for example, for files in faux directories.
+	oDesc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if err != nil {
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	meta := rewriteMetadata(oDesc)
+	meta.Hidden = true
+	newId, err := fsys.ops.DxFileNew(
+		ctx, oph.httpClient, NewNonce().String(),
+		file.ProjId,
+		oDesc.Name,
+		oDesc.Folder,
+		meta)
+	if err != nil {
+		oph.RecordError(err)
+		return fsys.translateError(err)
+	}
+	if err := fsys.mdb.JournalStart(oph, newId, file.ProjId, links[0]); err != nil {
+		// the new file is hidden, and was never written
+		if rmErr := fsys.ops.DxRemoveObjects(ctx, oph.httpClient, file.ProjId, []string{newId}); rmErr != nil {
+			fsys.log("Error removing the new version %s of file %s: %s", newId, file.Id, rmErr.Error())
+		}
+		return fuse.EIO
+	}
+	fsys.rewrites[file.Inode] = rewrite{fileId: newId, projId: file.ProjId}
+
+	// The old contents are not accessible through this handle anymore
+	if fh.url != nil {
+		fsys.pgs.RemoveStreamEntry(fh.hid)
+	}
+	fh.replacedId = fh.Id
+	fh.Id = newId
+	fh.url = nil
+	fh.size = 0
+	fh.rewritable = false
+	fh.uploadParams = fsys.projId2Desc[file.ProjId].UploadParams
+	fh.checksum = NewUploadChecksum()
+	fh.readChecksum = nil
+	delete(fsys.checksumFailures, fh.inode)
+	fh.accessMode = AM_AO_Remote
+	return nil
+}
+
+// A new version of a file has the tags, properties, types, and media type
+// of the old one
+func rewriteMetadata(oDesc DxDescribeDataObject) NewFileMetadata {
+	meta := NewFileMetadata{
+		Tags:       oDesc.Tags,
+		Properties: make(map[string]string),
+		Types:      oDesc.Types,
+		Media:      oDesc.Media,
+	}
+	for key, value := range oDesc.Properties {
+		if key == MtimeProperty || key == Md5Property {
+			// the new version is modified now, and has different contents
+			continue
+		}
+		meta.Properties[key] = value
+	}
+	return meta
+}
+
+// Copy the tags and properties of an object to a new object
+func (fsys *Filesys) copyTagsAndProperties(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	oDesc DxDescribeDataObject,
+	newId string) error {
+	if len(oDesc.Tags) > 0 {
+		if err := fsys.ops.DxAddTags(ctx, httpClient, projId, newId, oDesc.Tags); err != nil {
+			return err
+		}
+	}
+	if len(oDesc.Properties) > 0 {
+		props := make(map[string](*string))
+		for key, value := range oDesc.Properties {
+			if key == MtimeProperty || key == Md5Property {
+				// the new version is modified now, and has different contents
+				continue
+			}
+			value := value
+			props[key] = &value
+		}
+		if err := fsys.ops.DxSetProperties(ctx, httpClient, projId, newId, props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Writes to files.
 //
 // Note: the file-open operation doesn't state if the file is going to be opened for
@@ -1510,17 +2980,19 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 		return fuse.EINVAL
 	}
 	fsys.mutex.Unlock()
-	if !ok {
-		// invalid file handle. It doesn't exist in the table
-		return fuse.EINVAL
-	}
-	// Possible case of file being flushed by one fd, but another open file descriptor still attempting to write
-	if fh.accessMode != AM_AO_Remote {
+	if fh.mutex == nil {
+		// a read-only handle
 		return syscall.EPERM
 	}
 	// One write at a time per fh so that sequential offsets work properly
 	fh.mutex.Lock()
 	defer fh.mutex.Unlock()
+	// Possible case of file being flushed by one fd, but another open file
+	// descriptor still attempting to write. A closed file opened for reading
+	// and writing is rewritten only once it is truncated.
+	if fh.accessMode != AM_AO_Remote {
+		return syscall.EPERM
+	}
 
 	if fh.writeError != nil {
 		return fsys.translateError(fh.writeError)
@@ -1531,9 +3003,12 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 		fsys.log("op.Offest: %d, fh.nextWriteOffest: %d", op.Offset, fh.nextWriteOffset)
 		return syscall.ENOTSUP
 	}
-	if fh.writeBuffer == nil {
-		// Allocate write buffer
-		fh.writeBuffer = fsys.uploader.AllocateWriteBuffer(fh.lastPartId, true)
+	// Fail before writing anything, if the file would grow beyond what the
+	// project allows.
+	if op.Offset+int64(len(op.Data)) > fsys.uploader.FileSizeLimit(fh.uploadParams) {
+		fsys.log("WriteFile %s: the file would be larger than %d bytes", fh.Id,
+			fsys.uploader.FileSizeLimit(fh.uploadParams))
+		return syscall.EFBIG
 	}
 
 	bytesToWrite := op.Data
@@ -1548,6 +3023,11 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 	//   strip bytes copied from op.Data for next copy
 
 	for {
+		if fh.writeBuffer == nil {
+			if err := fsys.allocateWriteBuffer(fh); err != nil {
+				return err
+			}
+		}
 		sliceUpperBound := fh.writeBufferOffset + len(bytesToWrite)
 		if sliceUpperBound > cap(fh.writeBuffer) {
 			sliceUpperBound = cap(fh.writeBuffer)
@@ -1556,6 +3036,7 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 		fh.writeBuffer = fh.writeBuffer[:sliceUpperBound]
 		// copy data into slice
 		bytesCopied := copy(fh.writeBuffer[fh.writeBufferOffset:sliceUpperBound], bytesToWrite)
+		fh.checksum.Write(bytesToWrite[:bytesCopied])
 		fh.size += int64(bytesCopied)
 		// increment next write offset
 		fh.nextWriteOffset += int64(bytesCopied)
@@ -1571,117 +3052,547 @@ func (fsys *Filesys) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) err
 				writeBuffer: fh.writeBuffer,
 				partId:      partId,
 			}
-			fh.wg.Add(1)
+			fh.startPart()
 			fsys.uploader.uploadQueue <- uploadReq
 			fh.writeBuffer = nil
 			fh.writeBufferOffset = 0
-			// Update the file attributes in the database (size, mtime)
-			fsys.mutex.Lock()
-			oph := fsys.opOpenNoHttpClient()
-			if err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fh.size, time.Now(), nil); err != nil {
-				fsys.log("database error in updating attributes for WriteFile %s", err.Error())
-				fsys.mutex.Unlock()
+			// Update the file attributes in the database (size, mtime). A file
+			// being rewritten shows the old version until the new one is closed.
+			if fh.replacedId == "" {
+				fsys.mutex.Lock()
+				oph := fsys.opOpenNoHttpClient()
+				if err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fh.size, time.Now(), nil); err != nil {
+					fsys.log("database error in updating attributes for WriteFile %s", err.Error())
+					fsys.mutex.Unlock()
+					fsys.opClose(oph)
+					return fuse.EIO
+				}
 				fsys.opClose(oph)
-				return fuse.EIO
+				fsys.mutex.Unlock()
 			}
-			fsys.opClose(oph)
+		}
+		// all data copied into buffer slice, break
+		if bytesCopied == len(bytesToWrite) {
+			break
+		}
+		// trim data if it was only partially copied
+		bytesToWrite = bytesToWrite[bytesCopied:]
+
+	}
+	return nil
+}
+
+// Files can be written to a project only if the memory budget for write
+// buffers can hold a part of the minimal size the project accepts.
+func (fsys *Filesys) checkWriteBufferMemory(projId string) error {
+	params := fsys.projId2Desc[projId].UploadParams
+	if fsys.uploader.FileSizeLimit(params) == 0 {
+		fsys.log("The write buffer memory, %d bytes, cannot hold a part of %d bytes, the minimum for project %s",
+			fsys.uploader.pool.Budget(), params.MinimumPartSize, projId)
+		return syscall.EFBIG
+	}
+	return nil
+}
+
+// Allocate the buffer for the next part of a file. This waits if the memory
+// budget is exhausted. Returns EFBIG if the project does not allow another part.
+func (fsys *Filesys) allocateWriteBuffer(fh *FileHandle) error {
+	size, ok := fsys.uploader.PartSize(fh.uploadParams, fh.lastPartId+1, fh.nextWriteOffset)
+	if !ok {
+		fsys.log("WriteFile %s: the project allows at most %d parts", fh.Id, fh.uploadParams.MaximumNumParts)
+		return syscall.EFBIG
+	}
+	buf, err := fsys.uploader.AllocateWriteBuffer(size)
+	if err != nil {
+		fsys.log("WriteFile %s: %s", fh.Id, err.Error())
+		return syscall.ENOBUFS
+	}
+	fh.writeBuffer = buf
+	return nil
+}
+
+func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
+	if fsys.options.Verbose {
+		fsys.log("Flush inode %d", op.Inode)
+	}
+	fsys.mutex.Lock()
+	fh, ok := fsys.fhTable[op.Handle]
+	if !ok {
+		// invalid file handle. It doesn't exist in the table
+		fsys.mutex.Unlock()
+		return fuse.EINVAL
+	}
+	fsys.mutex.Unlock()
+
+	if fh == nil || fh.mutex == nil {
+		// a read-only handle
+		return nil
+	}
+
+	// Get fh mutex
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if fh.accessMode != AM_AO_Remote {
+		// This isn't a writeable file
+		if fsys.ops.options.VerboseLevel > 1 {
+			fsys.log("Ignoring flush of inode %d, file is not writeable", op.Inode)
+		}
+		return nil
+	}
+
+	tgid, _ := GetTgid(op.OpContext.Pid)
+	if fh.Tgid != tgid {
+		fsys.log("Ignoring FlushFile: tgids does not match fh tgid")
+		fsys.log("tgid: %v, fh tgid: %v", tgid, fh.Tgid)
+		return nil
+	}
+	// Wait for any current part uploads to finish
+	fh.wg.Wait()
+	// Return previous write error
+	if fh.writeError != nil {
+		return fsys.translateError(fh.writeError)
+	}
+
+	// Empty files are handled by ReleaseFileHandle
+	if len(fh.writeBuffer) == 0 && fh.size == 0 {
+		if fsys.ops.options.VerboseLevel > 1 {
+			fsys.log("Ignoring FlushFile: file is empty")
+		}
+		return nil
+	}
+
+	// upload last part. It may be empty if the previous part was
+	// uploaded by SyncFile, or exactly filled the buffer; in which case it is skipped.
+	if len(fh.writeBuffer) > 0 || fh.lastPartId == 0 {
+		fh.lastPartId++
+		partId := fh.lastPartId
+		uploadReq := UploadRequest{
+			fh:          fh,
+			fileId:      fh.Id,
+			writeBuffer: fh.writeBuffer,
+			partId:      partId,
+		}
+		fh.startPart()
+		fsys.uploader.uploadQueue <- uploadReq
+	} else {
+		fsys.uploader.FreeWriteBuffer(fh.writeBuffer)
+	}
+	fh.writeBuffer = nil
+
+	fh.wg.Wait()
+	// Check if there was an error uploading the last part
+	if fh.writeError != nil {
+		return fsys.translateError(fh.writeError)
+	}
+
+	return fsys.finishWrittenFile(ctx, fh)
+}
+
+// A file has been fully uploaded. Close it, or queue it for closing in the
+// background.
+//
+// Note: the file handle lock must be held
+func (fsys *Filesys) finishWrittenFile(ctx context.Context, fh *FileHandle) error {
+	if fsys.closer == nil {
+		return fsys.closeWrittenFile(ctx, fh)
+	}
+
+	// No more writes are accepted through the handle. The attributes are
+	// final, only the state changes once the file is closed.
+	fh.accessMode = AM_RO_Remote
+	mtime := time.Now()
+	var mode os.FileMode = fileReadOnlyMode
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+
+	if fh.replacedId == "" {
+		if err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fh.size, mtime, &mode); err != nil {
+			fsys.log("database error in updating attributes for FlushFile %s", err.Error())
+			return fuse.EIO
+		}
+	}
+	fsys.closer.Enqueue(CloseRequest{
+		inode:      fh.inode,
+		fileId:     fh.Id,
+		replacedId: fh.replacedId,
+		size:       fh.size,
+		checksum:   fh.checksum,
+	})
+	fsys.journalState(oph, fh.Id, UploadStateQueued, nil)
+	fh.replacedId = ""
+	return nil
+}
+
+// Close a file that has been fully uploaded, on the platform. With the -dedup
+// flag, the upload may be replaced by a clone of an existing file. Otherwise,
+// the md5 property is set, if requested, and the file is closed and verified.
+// Returns the id of the file, and an error if the checksum did not match, in
+// which case the file is closed nevertheless.
+func (fsys *Filesys) closeUploadedFile(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	size int64,
+	sum *UploadChecksum) (string, error, error) {
+	// The tags and properties set while the file was written, a clone gets
+	// them from the upload.
+	fsys.mutex.Lock()
+	px := fsys.takePendingXattrs(file.Inode)
+	fsys.mutex.Unlock()
+	if err := fsys.applyPendingXattrs(ctx, httpClient, file.ProjId, file.Id, px); err != nil {
+		fsys.mutex.Lock()
+		fsys.restorePendingXattrs(file.Inode, px)
+		fsys.mutex.Unlock()
+		return "", nil, err
+	}
+
+	fileId := file.Id
+	var verifyErr error
+	if cloneId := fsys.dedupFile(ctx, httpClient, file, size, sum); cloneId != "" {
+		fileId = cloneId
+	} else {
+		if err := fsys.setMd5Property(ctx, httpClient, file.ProjId, fileId, sum); err != nil {
+			return "", nil, err
+		}
+		if err := fsys.ops.DxFileCloseAndWait(ctx, httpClient, file.ProjId, fileId); err != nil {
+			// the close may be retried, the changes are applied again
+			fsys.mutex.Lock()
+			fsys.restorePendingXattrs(file.Inode, px)
 			fsys.mutex.Unlock()
-			fh.writeBuffer = fsys.uploader.AllocateWriteBuffer(partId, false)
+			return "", nil, err
+		}
+		verifyErr = fsys.verifyUpload(ctx, httpClient, file.ProjId, file.Inode, fileId, size, sum)
+	}
+	return fileId, verifyErr, nil
+}
+
+// Close a file that was queued by finishWrittenFile. This runs in the
+// background, with an http client of the closer.
+func (fsys *Filesys) closeQueuedFile(ctx context.Context, httpClient *http.Client, req CloseRequest) error {
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	file, _, err := fsys.lookupFileByInode(ctx, oph, req.inode)
+	valid := err == nil && file.Id == req.fileId
+	if req.replacedId != "" {
+		valid = err == nil && file.Id == req.replacedId && fsys.rewrites[req.inode].fileId == req.fileId
+	}
+	if valid {
+		fsys.journalState(oph, req.fileId, UploadStateClosing, nil)
+	}
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if !valid {
+		// The file was removed while it was queued
+		fsys.log("File %s was removed before it was closed", req.fileId)
+		if req.replacedId != "" {
+			fsys.discardRewrite(ctx, httpClient, req.inode, req.fileId)
+		}
+		return nil
+	}
+
+	if req.replacedId != "" {
+		upload := file
+		upload.Id = req.fileId
+		fileId, verifyErr, err := fsys.closeUploadedFile(ctx, httpClient, upload, req.size, req.checksum)
+		if err == nil {
+			err = verifyErr
+		}
+		return fsys.finishRewrite(ctx, httpClient, file, req, fileId, err)
+	}
+
+	fileId, verifyErr, err := fsys.closeUploadedFile(ctx, httpClient, file, req.size, req.checksum)
+	if err != nil {
+		fsys.closeFailed(req, err)
+		return err
+	}
+
+	// tags and properties set while the file was closing
+	fsys.mutex.Lock()
+	if _, err := fsys.applyLastPendingXattrs(ctx, httpClient, file.ProjId, fileId, req.inode); err != nil {
+		fsys.log("ERROR: could not set the tags and properties of %s: %s", fileId, err.Error())
+		verifyErr = err
+	}
+	defer fsys.mutex.Unlock()
+	oph = fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if err := fsys.mdb.UpdateClosedFileMetadata(ctx, oph, req.inode); err != nil {
+		fsys.log("database error in updating attributes for closed file %s", err.Error())
+		return err
+	}
+	if err := fsys.recordMd5Property(ctx, oph, req.inode, req.checksum); err != nil {
+		fsys.log("database error in updating properties for closed file %s", err.Error())
+		return err
+	}
+	return verifyErr
+}
+
+// The upload state of a file: uploading while it is open for writing, then
+// queued and closing if it is closed in the background, and finally closed,
+// or failed.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) uploadState(file File) string {
+	if fsys.inodeHasWriteHandle(file.Inode) {
+		return UploadStateUploading
+	}
+	uploadId := fsys.uploadIdOf(file)
+	if cf, ok := fsys.checksumFailures[file.Inode]; ok && cf.fileId == uploadId {
+		return UploadStateFailed
+	}
+	if fsys.closeError(file.Inode, uploadId) != nil {
+		return UploadStateFailed
+	}
+	if fsys.closer != nil {
+		if state, ok := fsys.closer.Status(file.Inode, uploadId); ok {
+			return state
+		}
+	}
+	if file.State == "closed" {
+		return UploadStateClosed
+	}
+	// an open file that was not written through this mount
+	return file.State
+}
+
+// Wait for the files queued for closing. Returns an error if any of them
+// failed to close.
+func (fsys *Filesys) CmdWait() error {
+	if fsys.closer == nil {
+		return nil
+	}
+	return fsys.closer.Wait()
+}
+
+// Wait until every file under a directory is closed on the platform. This
+// is a barrier for job outputs: uploads in flight are completed, files
+// queued for closing are closed, and files in the closing state are waited
+// for. Returns the files that failed to reach the closed state, with the
+// reason, and separately, the files that are still open for writing. These
+// are closed only by their writers, so they are not waited for.
+func (fsys *Filesys) SyncAll(ctx context.Context, dirInode int64) ([]string, []string, error) {
+	if fsys.sybx != nil {
+		// push local changes to the platform first
+		if err := fsys.sybx.CmdSync(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Wait for the parts in flight
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	files, err := fsys.unclosedUnder(ctx, oph, dirInode)
+	fsys.opClose(oph)
+	pending := files
+	var writers []*FileHandle
+	inodes := make(map[int64]bool)
+	for _, f := range files {
+		inodes[f.Inode] = true
+	}
+	for _, fh := range fsys.fhTable {
+		if fh.accessMode == AM_AO_Remote && inodes[fh.inode] {
+			writers = append(writers, fh)
+		}
+	}
+	fsys.mutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fh := range writers {
+		fh.mutex.Lock()
+		fh.wg.Wait()
+		fh.mutex.Unlock()
+	}
+
+	// Wait for the background closes
+	if fsys.closer != nil {
+		fsys.closer.WaitFor(inodes)
+	}
+
+	// Check what is left
+	var failures []string
+	var writing []string
+	var closing []UnclosedFile
+	fsys.mutex.Lock()
+	for _, f := range pending {
+		// closed, but not as written
+		if cf, ok := fsys.checksumFailures[f.Inode]; ok && cf.fileId == f.Id {
+			failures = append(failures, fmt.Sprintf("%s: %s", f.FullPath, cf.err.Error()))
+		}
+	}
+	oph = fsys.opOpenNoHttpClient()
+	files, err = fsys.unclosedUnder(ctx, oph, dirInode)
+	fsys.opClose(oph)
+	for _, f := range files {
+		if fsys.inodeHasWriteHandle(f.Inode) {
+			writing = append(writing, f.FullPath)
+			continue
+		}
+		if _, ok := fsys.checksumFailures[f.Inode]; ok {
+			// already reported
+			continue
+		}
+		if cerr := fsys.closeError(f.Inode, f.Id); cerr != nil {
+			failures = append(failures, fmt.Sprintf("%s: close failed, %s", f.FullPath, cerr.Error()))
+			continue
+		}
+		if fsys.closer != nil {
+			if cerr := fsys.closer.Error(f.Inode, f.Id); cerr != nil {
+				failures = append(failures, fmt.Sprintf("%s: close failed, %s", f.FullPath, cerr.Error()))
+				continue
+			}
+		}
+		closing = append(closing, f)
+	}
+	fsys.mutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The rest are files that were not written through this mount, or
+	// that were closed on the platform since they were listed.
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+	for _, f := range closing {
+		if err := fsys.ops.DxFileWaitForClose(ctx, httpClient, f.ProjId, f.Id); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", f.FullPath, err.Error()))
+			continue
 		}
-		// all data copied into buffer slice, break
-		if bytesCopied == len(bytesToWrite) {
-			break
+		fsys.mutex.Lock()
+		oph := fsys.opOpenNoHttpClient()
+		err := fsys.mdb.UpdateClosedFileMetadata(ctx, oph, f.Inode)
+		fsys.opClose(oph)
+		fsys.mutex.Unlock()
+		if err != nil {
+			return nil, nil, err
 		}
-		// trim data if it was only partially copied
-		bytesToWrite = bytesToWrite[bytesCopied:]
-
 	}
-	return nil
+	return failures, writing, nil
 }
 
-func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
-	if fsys.options.Verbose {
-		fsys.log("Flush inode %d", op.Inode)
+// Note: the global lock must be held
+func (fsys *Filesys) unclosedUnder(ctx context.Context, oph *OpHandle, dirInode int64) ([]UnclosedFile, error) {
+	dir, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, dirInode)
+	if err != nil {
+		fsys.log("database error in SyncAll %s", err.Error())
+		return nil, fuse.EIO
 	}
-	fsys.mutex.Lock()
-	fh, ok := fsys.fhTable[op.Handle]
 	if !ok {
-		// invalid file handle. It doesn't exist in the table
-		fsys.mutex.Unlock()
-		return fuse.EINVAL
+		return nil, fuse.ENOENT
+	}
+	files, err := fsys.mdb.UnclosedInSubtree(oph, dir.FullPath)
+	if err != nil {
+		return nil, fuse.EIO
 	}
-	fsys.mutex.Unlock()
 
-	if fh == nil {
-		return nil
+	// The database shows the old version of files being rewritten
+	prefix := dir.FullPath
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
 	}
-	if fh.accessMode != AM_AO_Remote {
-		// This isn't a writeable file
-		if fsys.ops.options.VerboseLevel > 1 {
-			fsys.log("Ignoring flush of inode %d, file is not writeable", op.Inode)
+	for inode, rw := range fsys.rewrites {
+		links, err := fsys.mdb.LinksOfInode(ctx, oph, inode)
+		if err != nil {
+			return nil, fuse.EIO
+		}
+		for _, path := range links {
+			if strings.HasPrefix(path, prefix) {
+				files = append(files, UnclosedFile{
+					Inode:    inode,
+					Id:       rw.fileId,
+					ProjId:   rw.projId,
+					State:    "open",
+					FullPath: path,
+				})
+				break
+			}
 		}
-		return nil
 	}
+	return files, nil
+}
 
-	// Get fh mutex
-	fh.mutex.Lock()
-	defer fh.mutex.Unlock()
-
-	tgid, _ := GetTgid(op.OpContext.Pid)
-	if fh.Tgid != tgid {
-		fsys.log("Ignoring FlushFile: tgids does not match fh tgid")
-		fsys.log("tgid: %v, fh tgid: %v", tgid, fh.Tgid)
-		return nil
+// Run the SyncAll barrier on a path, and describe the outcome
+func (fsys *Filesys) CmdSyncAll(ctx context.Context, path string) (string, error) {
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	node, ok, err := fsys.lookupPath(ctx, oph, path)
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if err != nil {
+		return "", err
 	}
-	// Wait for any current part uploads to finish
-	fh.wg.Wait()
-	// Return previous write error
-	if fh.writeError != nil {
-		return fsys.translateError(fh.writeError)
+	if !ok {
+		return "", fmt.Errorf("%s does not exist", path)
 	}
-
-	// Empty files are handled by ReleaseFileHandle
-	if len(fh.writeBuffer) == 0 && fh.size == 0 {
-		if fsys.ops.options.VerboseLevel > 1 {
-			fsys.log("Ignoring FlushFile: file is empty")
-		}
-		return nil
+	dir, isDir := node.(Dir)
+	if !isDir {
+		return "", fmt.Errorf("%s is not a directory", path)
 	}
 
-	// upload last part
-	fh.lastPartId++
-	partId := fh.lastPartId
-	uploadReq := UploadRequest{
-		fh:          fh,
-		fileId:      fh.Id,
-		writeBuffer: fh.writeBuffer,
-		partId:      partId,
+	failures, writing, err := fsys.SyncAll(ctx, dir.Inode)
+	if err != nil {
+		return "", err
 	}
-	fh.wg.Add(1)
-	fsys.uploader.uploadQueue <- uploadReq
-	fh.writeBuffer = nil
-	<-fsys.uploader.writeBufferChan
+	return syncAllReport(failures, writing), nil
+}
 
-	fh.wg.Wait()
-	// Check if there was an error uploading the last part
-	if fh.writeError != nil {
-		return fsys.translateError(fh.writeError)
+func syncAllReport(failures []string, writing []string) string {
+	if len(failures) == 0 && len(writing) == 0 {
+		return "all files are closed"
+	}
+	var report []string
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		report = append(report, fmt.Sprintf("%d files are not closed:\n%s",
+			len(failures), strings.Join(failures, "\n")))
 	}
+	if len(writing) > 0 {
+		sort.Strings(writing)
+		report = append(report, fmt.Sprintf("%d files are still open for writing, they were not waited for:\n%s",
+			len(writing), strings.Join(writing, "\n")))
+	}
+	return strings.Join(report, "\n")
+}
 
+// Close a file that has been fully uploaded, and mark it as read-only in the
+// database. If the file is a new version of an existing file, the old
+// version is removed.
+//
+// Note: the file handle lock must be held
+func (fsys *Filesys) closeWrittenFile(ctx context.Context, fh *FileHandle) error {
 	// get project-id
 	fsys.mutex.Lock()
 	oph := fsys.opOpenNoHttpClient()
-	file, _, _ := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	file, _, _ := fsys.lookupFileByInode(ctx, oph, fh.inode)
+	fsys.journalState(oph, fh.Id, UploadStateClosing, nil)
 	fsys.opClose(oph)
 	fsys.mutex.Unlock()
 
 	// close file
 	httpClient := <-fsys.httpClientPool
-	err := fsys.ops.DxFileCloseAndWait(context.TODO(), httpClient, file.ProjId, fh.Id)
-	fsys.httpClientPool <- httpClient
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+	if fh.replacedId != "" {
+		return fsys.closeRewrittenFile(ctx, httpClient, fh, file)
+	}
+	fileId, verifyErr, err := fsys.closeUploadedFile(context.TODO(), httpClient, file, fh.size, fh.checksum)
 	if err != nil {
+		// All the data is uploaded. No more writes are accepted, and
+		// the close can be retried with the status command.
+		fh.accessMode = AM_RO_Remote
+		fsys.closeFailed(CloseRequest{
+			inode:    fh.inode,
+			fileId:   fh.Id,
+			size:     fh.size,
+			checksum: fh.checksum,
+		}, err)
 		return fsys.translateError(err)
 	}
+	fh.Id = fileId
 
 	// Update fh to be remote in case of subsequent write attempts
 	fh.accessMode = AM_RO_Remote
@@ -1689,7 +3600,12 @@ func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) err
 	// Update the file attributes in the database (size, mtime)
 	mtime := time.Now()
 	var mode os.FileMode = fileReadOnlyMode
+	// tags and properties set while the file was closing
 	fsys.mutex.Lock()
+	if _, err := fsys.applyLastPendingXattrs(ctx, httpClient, file.ProjId, fileId, fh.inode); err != nil {
+		fsys.log("ERROR: could not set the tags and properties of %s: %s", fileId, err.Error())
+		verifyErr = err
+	}
 	defer fsys.mutex.Unlock()
 	oph = fsys.opOpenNoHttpClient()
 	defer fsys.opClose(oph)
@@ -1703,15 +3619,83 @@ func (fsys *Filesys) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) err
 		fsys.log("database error in updating attributes for closed FlushFile %s", err.Error())
 		return fuse.EIO
 	}
-
+	if err := fsys.recordMd5Property(ctx, oph, fh.inode, fh.checksum); err != nil {
+		fsys.log("database error in updating properties for closed FlushFile %s", err.Error())
+		return fuse.EIO
+	}
+	if verifyErr != nil {
+		return fuse.EIO
+	}
 	return nil
 }
 
+// Wait until the data written so far reaches the platform. FUSE does not
+// distinguish fsync from fdatasync, in both cases the partially filled write
+// buffer is uploaded as a part of its own, if it is large enough to be a
+// non-final part.
 func (fsys *Filesys) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
 	if fsys.options.Verbose {
 		fsys.log("Sync inode %d", op.Inode)
 	}
+	fsys.mutex.Lock()
+	fh, ok := fsys.fhTable[op.Handle]
+	if !ok {
+		// invalid file handle. It doesn't exist in the table
+		fsys.mutex.Unlock()
+		return fuse.EINVAL
+	}
+	fsys.mutex.Unlock()
+	if fh.mutex == nil {
+		// Remote files are immutable, there is nothing to sync
+		return nil
+	}
+
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if fh.accessMode != AM_AO_Remote {
+		// not written through this handle, or already closed
+		return nil
+	}
+	uploadParams := fh.uploadParams
+
+	// Upload the partial buffer, if the platform allows a part of this size.
+	// The last part allowed is kept for the rest of the file.
+	bufLen := int64(len(fh.writeBuffer))
+	if bufLen > 0 && bufLen >= uploadParams.MinimumPartSize &&
+		(uploadParams.MaximumNumParts <= 0 || int64(fh.lastPartId+1) < uploadParams.MaximumNumParts) {
+		fh.lastPartId++
+		partId := fh.lastPartId
+		uploadReq := UploadRequest{
+			fh:          fh,
+			fileId:      fh.Id,
+			writeBuffer: fh.writeBuffer,
+			partId:      partId,
+		}
+		fh.startPart()
+		fsys.uploader.uploadQueue <- uploadReq
+		// the next write allocates a buffer
+		fh.writeBuffer = nil
+		fh.writeBufferOffset = 0
+
+		// Update the file attributes in the database (size, mtime)
+		if fh.replacedId == "" {
+			fsys.mutex.Lock()
+			oph := fsys.opOpenNoHttpClient()
+			err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fh.size, time.Now(), nil)
+			fsys.opClose(oph)
+			fsys.mutex.Unlock()
+			if err != nil {
+				fsys.log("database error in updating attributes for SyncFile %s", err.Error())
+				return fuse.EIO
+			}
+		}
+	}
 
+	// Wait for all the parts in flight
+	fh.wg.Wait()
+	if fh.writeError != nil {
+		return fsys.translateError(fh.writeError)
+	}
 	return nil
 }
 
@@ -1727,6 +3711,10 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 	delete(fsys.fhTable, op.Handle)
 	fsys.mutex.Unlock()
 
+	if fh.mutex != nil {
+		fh.mutex.Lock()
+		defer fh.mutex.Unlock()
+	}
 	// Clear the state involved with this open file descriptor
 	switch fh.accessMode {
 	case AM_RO_Remote:
@@ -1745,40 +3733,20 @@ func (fsys *Filesys) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseF
 			httpClient := <-fsys.httpClientPool
 			err := fsys.ops.DxFileUploadPart(context.TODO(), httpClient, fh.Id, partId, fh.writeBuffer)
 			fsys.httpClientPool <- httpClient
-			if err != nil {
-
-			}
-			// get project-id
-			fsys.mutex.Lock()
-			oph := fsys.opOpenNoHttpClient()
-			file, _, _ := fsys.lookupFileByInode(ctx, oph, int64(fh.inode))
-			fsys.opClose(oph)
-			fsys.mutex.Unlock()
-
-			httpClient = <-fsys.httpClientPool
-			err = fsys.ops.DxFileCloseAndWait(context.TODO(), httpClient, file.ProjId, fh.Id)
-			fsys.httpClientPool <- httpClient
+			fsys.uploader.FreeWriteBuffer(fh.writeBuffer)
+			fh.writeBuffer = nil
 			if err != nil {
 				return fsys.translateError(err)
 			}
-			// Update the file attributes in the database (size, mtime)
-			mtime := time.Now()
-			var mode os.FileMode = fileReadOnlyMode
-			fsys.mutex.Lock()
-			defer fsys.mutex.Unlock()
-			oph = fsys.opOpenNoHttpClient()
-			defer fsys.opClose(oph)
-
-			if err := fsys.mdb.UpdateFileAttrs(ctx, oph, fh.inode, fh.size, mtime, &mode); err != nil {
-				fsys.log("database error in updating attributes for FlushFile %s", err.Error())
-				return fuse.EIO
-			}
-			// update to remote read-only
-			if err := fsys.mdb.UpdateClosedFileMetadata(ctx, oph, fh.inode); err != nil {
-				fsys.log("database error in updating attributes for closed FlushFile %s", err.Error())
-				return fuse.EIO
-			}
-
+			return fsys.finishWrittenFile(ctx, fh)
+		}
+		// The buffer of a file that was not flushed
+		fsys.uploader.FreeWriteBuffer(fh.writeBuffer)
+		fh.writeBuffer = nil
+		if fh.replacedId != "" {
+			// keep the old version of a rewritten file
+			fh.wg.Wait()
+			fsys.abandonRewrite(ctx, fh)
 		}
 		return nil
 
@@ -1836,7 +3804,10 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 	}
 
 	// Grab the inode.
-	file, _, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	file, isDir, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	if isDir {
+		return fsys.removeDirXattr(ctx, oph, int64(op.Inode), op.Name)
+	}
 	if err != nil {
 		return err
 	}
@@ -1877,6 +3848,9 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 		return fuse.ENOATTR
 	}
 
+	// A file being written gets the change when it is closed
+	deferred := fsys.fileBeingWritten(file)
+
 	// remove the key from in-memory representation
 	switch namespace {
 	case XATTR_TAG:
@@ -1889,7 +3863,11 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 		file.Tags = tags
 		var tagToRemove []string
 		tagToRemove = append(tagToRemove, attrName)
-		err = fsys.ops.DxRemoveTags(ctx, oph.httpClient, file.ProjId, file.Id, tagToRemove)
+		if deferred {
+			fsys.pendingXattrsOf(file).tags[attrName] = false
+		} else {
+			err = fsys.ops.DxRemoveTags(ctx, oph.httpClient, file.ProjId, file.Id, tagToRemove)
+		}
 		if err != nil {
 			fsys.log("Error in removing tag (%s) on  %s",
 				attrName, file.Id)
@@ -1900,7 +3878,11 @@ func (fsys *Filesys) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp)
 		delete(file.Properties, attrName)
 		propToRemove := make(map[string](*string))
 		propToRemove[attrName] = nil
-		err = fsys.ops.DxSetProperties(ctx, oph.httpClient, file.ProjId, file.Id, propToRemove)
+		if deferred {
+			fsys.pendingXattrsOf(file).props[attrName] = nil
+		} else {
+			err = fsys.ops.DxSetProperties(ctx, oph.httpClient, file.ProjId, file.Id, propToRemove)
+		}
 		if err != nil {
 			fsys.log("Error in removing property (%s) on  %s",
 				attrName, file.Id)
@@ -1948,7 +3930,7 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 	// Grab the inode.
 	file, isDir, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
 	if isDir {
-		return fuse.ENOATTR
+		return fsys.getDirXattr(ctx, oph, op)
 	}
 	if err != nil {
 		return err
@@ -1978,7 +3960,7 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 			}
 		}
 	case XATTR_BASE:
-		// Is it one of {state, archivalState/archivedState, id}?
+		// Is it one of {state, archivalState/archivedState, id, uploadState, checksum}?
 		// There is no other way of reporting it, so we allow querying these
 		// attributes here.
 		switch attrName {
@@ -1988,6 +3970,12 @@ func (fsys *Filesys) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error
 			return fsys.getXattrFill(op, file.ArchivalState)
 		case "id":
 			return fsys.getXattrFill(op, file.Id)
+		case "uploadState":
+			return fsys.getXattrFill(op, fsys.uploadState(file))
+		case "checksum":
+			if r, ok := fsys.readChecksums[file.Inode]; ok && r.fileId == file.Id {
+				return fsys.getXattrFill(op, r.String())
+			}
 		}
 	}
 
@@ -2007,7 +3995,14 @@ func (fsys *Filesys) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) err
 	}
 
 	// Grab the inode.
-	file, _, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	file, isDir, err := fsys.lookupFileByInode(ctx, oph, int64(op.Inode))
+	if isDir {
+		xattrKeys, err := fsys.listDirXattr(ctx, oph, int64(op.Inode))
+		if err != nil {
+			return err
+		}
+		return fsys.listXattrFill(op, xattrKeys)
+	}
 	if err != nil {
 		return err
 	}
@@ -2021,15 +4016,21 @@ func (fsys *Filesys) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) err
 		xattrKeys = append(xattrKeys, XATTR_PROP+"."+key)
 	}
 	// Special attributes
-	for _, key := range []string{"state", "archivalState", "id"} {
+	for _, key := range []string{"state", "archivalState", "id", "uploadState"} {
 		xattrKeys = append(xattrKeys, XATTR_BASE+"."+key)
 	}
+	if r, ok := fsys.readChecksums[file.Inode]; ok && r.fileId == file.Id {
+		xattrKeys = append(xattrKeys, XATTR_BASE+".checksum")
+	}
 	if fsys.options.Verbose {
 		fsys.log("attribute keys: %v", xattrKeys)
 		fsys.log("output buffer len=%d", len(op.Dst))
 	}
+	return fsys.listXattrFill(op, xattrKeys)
+}
 
-	// encode the names as a sequence of null-terminated strings
+// encode the names as a sequence of null-terminated strings
+func (fsys *Filesys) listXattrFill(op *fuseops.ListXattrOp, xattrKeys []string) error {
 	dst := op.Dst[:]
 	for _, key := range xattrKeys {
 		keyLen := len(key) + 1
@@ -2072,12 +4073,12 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 	case File:
 		file = node.(File)
 	case Dir:
-		// directories do not have attributes
+		// directories only have the defaults they give new files
 		//
 		// Note: we may want to change this for directories
 		// representing projects. This would allow reporting project
 		// tags and properties.
-		return syscall.EINVAL
+		return fsys.setDirXattr(ctx, oph, int64(op.Inode), op.Name, op.Value, op.Flags)
 	}
 	if !fsys.checkProjectPermissions(file.ProjId, PERM_CONTRIBUTE) {
 		return syscall.EPERM
@@ -2133,6 +4134,9 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 		return syscall.EINVAL
 	}
 
+	// A file being written gets the change when it is closed
+	deferred := fsys.fileBeingWritten(file)
+
 	// update the file in-memory representation
 	switch namespace {
 	case XATTR_TAG:
@@ -2140,7 +4144,11 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 			file.Tags = append(file.Tags, attrName)
 			var tagToAdd []string
 			tagToAdd = append(tagToAdd, attrName)
-			err = fsys.ops.DxAddTags(ctx, oph.httpClient, file.ProjId, file.Id, tagToAdd)
+			if deferred {
+				fsys.pendingXattrsOf(file).tags[attrName] = true
+			} else {
+				err = fsys.ops.DxAddTags(ctx, oph.httpClient, file.ProjId, file.Id, tagToAdd)
+			}
 			if err != nil {
 				fsys.log("Error in setting tag (%s) on  %s",
 					attrName, file.Id)
@@ -2158,7 +4166,11 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 		file.Properties[attrName] = prop
 		propToAdd := make(map[string](*string))
 		propToAdd[attrName] = &prop
-		err = fsys.ops.DxSetProperties(ctx, oph.httpClient, file.ProjId, file.Id, propToAdd)
+		if deferred {
+			fsys.pendingXattrsOf(file).props[attrName] = &prop
+		} else {
+			err = fsys.ops.DxSetProperties(ctx, oph.httpClient, file.ProjId, file.Id, propToAdd)
+		}
 		if err != nil {
 			fsys.log("Error in setting property (%s=%s) on  %s",
 				attrName, prop, file.Id)
@@ -2176,3 +4188,195 @@ func (fsys *Filesys) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error
 	}
 	return nil
 }
+
+// ===
+// External commands
+//
+
+// Find a file or directory by its path, relative to the root of the filesystem
+//
+// Note: the global lock must be held
+func (fsys *Filesys) lookupPath(ctx context.Context, oph *OpHandle, path string) (Node, bool, error) {
+	root, ok, err := fsys.mdb.LookupDirByInode(ctx, oph, InodeRoot)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	var node Node = root
+	for _, name := range strings.Split(filepath.Clean(path), "/") {
+		if name == "" {
+			continue
+		}
+		dir, isDir := node.(Dir)
+		if !isDir {
+			return nil, false, nil
+		}
+		node, ok, err = fsys.mdb.LookupInDir(ctx, oph, &dir, name)
+		if err != nil || !ok {
+			return nil, ok, err
+		}
+	}
+	return node, true, nil
+}
+
+// Clone a file or a folder into a different project, without copying
+// any data. The destination is either an existing directory, or a new
+// name in an existing directory.
+func (fsys *Filesys) CmdClone(ctx context.Context, srcPath string, dstPath string) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpen()
+	defer fsys.opClose(oph)
+
+	if fsys.options.ReadOnly {
+		return errors.New("the filesystem is mounted read-only")
+	}
+	srcNode, ok, err := fsys.lookupPath(ctx, oph, srcPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s does not exist", srcPath)
+	}
+
+	// figure out the destination directory, and the new name
+	var dstDir Dir
+	var newName string
+	dstNode, ok, err := fsys.lookupPath(ctx, oph, dstPath)
+	if err != nil {
+		return err
+	}
+	if ok {
+		dir, isDir := dstNode.(Dir)
+		if !isDir {
+			return fmt.Errorf("%s already exists", dstPath)
+		}
+		dstDir = dir
+		newName = filepath.Base(srcPath)
+	} else {
+		parentPath, name := splitPath(dstPath)
+		parentNode, ok, err := fsys.lookupPath(ctx, oph, parentPath)
+		if err != nil {
+			return err
+		}
+		dir, isDir := parentNode.(Dir)
+		if !ok || !isDir {
+			return fmt.Errorf("directory %s does not exist", parentPath)
+		}
+		dstDir = dir
+		newName = name
+	}
+	if dstDir.Inode == InodeRoot || dstDir.faux {
+		return fmt.Errorf("can not copy into %s", dstDir.FullPath)
+	}
+	_, exists, err := fsys.mdb.LookupInDir(ctx, oph, &dstDir, newName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s/%s already exists", dstDir.FullPath, newName)
+	}
+	if !fsys.checkProjectPermissions(dstDir.ProjId, PERM_UPLOAD) {
+		return fmt.Errorf("insufficient permissions to copy into project %s", dstDir.ProjId)
+	}
+
+	switch srcNode.(type) {
+	case File:
+		return fsys.cloneFile(ctx, oph, srcNode.(File), dstDir, newName)
+	case Dir:
+		return fsys.cloneDir(ctx, oph, srcNode.(Dir), dstDir, newName)
+	}
+	return nil
+}
+
+func (fsys *Filesys) cloneFile(ctx context.Context, oph *OpHandle, file File, dstDir Dir, newName string) error {
+	if file.ProjId == dstDir.ProjId {
+		return fmt.Errorf("%s is already in project %s, a file can be cloned only to a different project",
+			file.Name, dstDir.ProjId)
+	}
+	if file.State != "closed" {
+		return fmt.Errorf("%s is not closed, it can not be cloned", file.Name)
+	}
+
+	exists, err := fsys.ops.DxClone(ctx, oph.httpClient, file.ProjId, []string{file.Id}, nil,
+		dstDir.ProjId, dstDir.ProjFolder)
+	if err != nil {
+		return err
+	}
+	if len(exists) > 0 {
+		return fmt.Errorf("%s already exists in project %s", file.Id, dstDir.ProjId)
+	}
+	if newName != file.Name {
+		if err := fsys.ops.DxRename(ctx, oph.httpClient, dstDir.ProjId, file.Id, newName); err != nil {
+			return err
+		}
+	}
+
+	oDesc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, dstDir.ProjId, file.Id)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.mdb.AddDataObject(oph, &dstDir, newName, oDesc); err != nil {
+		return err
+	}
+	fsys.log("Cloned %s:%s to %s:%s/%s", file.ProjId, file.Id, dstDir.ProjId, dstDir.ProjFolder, newName)
+	return nil
+}
+
+func (fsys *Filesys) cloneDir(ctx context.Context, oph *OpHandle, dir Dir, dstDir Dir, newName string) error {
+	if dir.ProjId == dstDir.ProjId {
+		return fmt.Errorf("%s is already in project %s, a folder can be cloned only to a different project",
+			dir.FullPath, dstDir.ProjId)
+	}
+	if dir.faux || dir.ProjFolder == "/" {
+		return fmt.Errorf("%s does not correspond to a single folder, it can not be cloned", dir.FullPath)
+	}
+	if fsys.remover != nil {
+		// Removed files must not be cloned along with the folder
+		if err := fsys.remover.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// The clone keeps the folder name. It is renamed afterwards, so
+	// a folder with the original name must not exist in the target.
+	baseName := filepath.Base(dir.ProjFolder)
+	if baseName != newName {
+		_, ok, err := fsys.mdb.LookupInDir(ctx, oph, &dstDir, baseName)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fmt.Errorf("%s/%s already exists", dstDir.FullPath, baseName)
+		}
+	}
+
+	exists, err := fsys.ops.DxClone(ctx, oph.httpClient, dir.ProjId, nil, []string{dir.ProjFolder},
+		dstDir.ProjId, dstDir.ProjFolder)
+	if err != nil {
+		return err
+	}
+	if len(exists) > 0 {
+		fsys.log("Objects %v already exist in project %s, they were not cloned", exists, dstDir.ProjId)
+	}
+	projFolder := filepath.Join(dstDir.ProjFolder, baseName)
+	if baseName != newName {
+		if err := fsys.ops.DxRenameFolder(ctx, oph.httpClient, dstDir.ProjId, projFolder, newName); err != nil {
+			return err
+		}
+		projFolder = filepath.Join(dstDir.ProjFolder, newName)
+	}
+
+	// The contents of the directory are read from the platform when it is accessed
+	nowSeconds := time.Now().Unix()
+	_, err = fsys.mdb.CreateDir(oph, dstDir.ProjId, projFolder, nowSeconds, nowSeconds,
+		dirReadWriteMode, filepath.Join(dstDir.FullPath, newName))
+	if err != nil {
+		return err
+	}
+	fsys.log("Cloned folder %s:%s to %s:%s", dir.ProjId, dir.ProjFolder, dstDir.ProjId, projFolder)
+	if len(exists) > 0 {
+		return fmt.Errorf("%d objects already exist in project %s, and were not cloned into %s",
+			len(exists), dstDir.ProjId, projFolder)
+	}
+	return nil
+}
@@ -6,7 +6,7 @@ require (
 	github.com/StackExchange/wmi v1.2.1 // indirect
 	github.com/dnanexus/dxda v0.5.8
 	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/jacobsa/fuse v0.0.0-20211019165009-c75d3f26fceb
+	github.com/jacobsa/fuse v0.0.0-20230124164109-5e0f2e6b432b
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/pbnjay/memory v0.0.0-20210728143218-7b4eea64cf58 // indirect
 	github.com/shirou/gopsutil v3.21.9+incompatible
@@ -14,5 +14,4 @@ require (
 	github.com/tklauser/go-sysconf v0.3.9 // indirect
 	golang.org/x/exp v0.0.0-20200513190911-00229845015e
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
 )
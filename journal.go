@@ -0,0 +1,385 @@
+package dxfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads in progress are recorded in the upload journal of the metadata
+// database: the file-id, and the size and md5 of each part uploaded. A file
+// leaves the journal when it is closed, or removed. If the dxfuse process
+// stops while files are being written, their entries remain in the database
+// file. The next mount reads them before creating a fresh database, and keeps
+// them as orphans, files that are open on the platform and will never be
+// closed by the process that created them.
+//
+// The journal is also the queue of uploads: each entry has the state of the
+// upload, the number of attempts to close it, and the last error. The
+// status command lists it, and closes that failed can be retried. Failed
+// part uploads cannot, the data of the part is gone; they are listed as
+// not retryable.
+
+// How long an uploaded part may wait before it is written to the journal.
+// Parts are written in batches, so that the upload workers do not take the
+// global lock, and open a transaction, for each part.
+const journalFlushDelay = time.Second
+
+// A file that could not be closed on the platform. Its parts are uploaded,
+// so closing it again may succeed.
+type failedClose struct {
+	req CloseRequest
+	err error
+}
+
+// Record an uploaded part. This is called by the upload workers, that do
+// not hold any lock. The part is written with the others uploaded within
+// journalFlushDelay.
+func (fsys *Filesys) journalPart(fileId string, part JournalPart) {
+	if fsys.mdb.BufferJournalPart(fileId, part) {
+		time.AfterFunc(journalFlushDelay, fsys.flushJournalParts)
+	}
+}
+
+// Write the parts that have been uploaded to the journal
+func (fsys *Filesys) flushJournalParts() {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	if fsys.journalClosed {
+		return
+	}
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if err := fsys.mdb.FlushJournalParts(oph); err != nil {
+		fsys.log("Could not record uploaded parts in the upload journal, %s", err.Error())
+	}
+}
+
+// Record a change in the state of an upload
+//
+// Note: the global lock must be held
+func (fsys *Filesys) journalState(oph *OpHandle, fileId string, state string, err error) {
+	if err := fsys.mdb.JournalState(oph, fileId, state, err); err != nil {
+		fsys.log("Could not record the %s state of %s in the upload journal", state, fileId)
+	}
+}
+
+// A part could not be uploaded. This is called by the upload workers, that
+// do not hold any lock. The data is gone, so the upload cannot be retried.
+func (fsys *Filesys) journalUploadFailed(fileId string, err error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	fsys.journalState(oph, fileId, UploadStateFailed, err)
+}
+
+// A file could not be closed. Keep what is needed to try again.
+func (fsys *Filesys) closeFailed(req CloseRequest, err error) {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	fsys.failedCloses[req.inode] = failedClose{req: req, err: err}
+	fsys.journalState(oph, req.fileId, UploadStateFailed, err)
+}
+
+// The file-ids of the failed uploads that status retry can close again.
+// Only closes can be retried, a file whose part failed to upload, or that
+// the sync daemon failed to upload, has lost data.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) retryableFileIds() map[string]bool {
+	fileIds := make(map[string]bool)
+	for _, fc := range fsys.failedCloses {
+		fileIds[fc.req.fileId] = true
+	}
+	return fileIds
+}
+
+// The error of a file that could not be closed, or nil
+//
+// Note: the global lock must be held
+func (fsys *Filesys) closeError(inode int64, fileId string) error {
+	fc, ok := fsys.failedCloses[inode]
+	if !ok || fc.req.fileId != fileId {
+		return nil
+	}
+	return fc.err
+}
+
+// List the uploads of this mount that are not closed yet, and the orphans
+// of previous mounts. With retry, close again the files that failed to
+// close, by file-id, or all of them.
+func (fsys *Filesys) CmdStatus(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		fsys.mutex.Lock()
+		oph := fsys.opOpenNoHttpClient()
+		statuses, err := fsys.mdb.JournalStatus(oph)
+		fsys.opClose(oph)
+		retryable := fsys.retryableFileIds()
+		fsys.mutex.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if len(statuses) == 0 {
+			return "There are no uploads in progress", nil
+		}
+		var lines []string
+		for _, st := range statuses {
+			state := st.State
+			switch {
+			case st.Orphan:
+				state = "orphan"
+			case st.State != UploadStateFailed:
+			case retryable[st.FileId]:
+				state += " (retryable)"
+			default:
+				// a part, or a sync, failed; the data has to be written again
+				state += " (not retryable)"
+			}
+			var size int64
+			for _, part := range st.Parts {
+				size += part.Size
+			}
+			line := fmt.Sprintf("%s  %s  %s:%s  %d parts  %d bytes  %d attempts  started %s",
+				st.FileId, state, st.ProjId, st.Path, len(st.Parts), size, st.Attempts,
+				time.Unix(st.Ctime, 0).Format(time.RFC3339))
+			if st.LastError != "" {
+				line += "  last error: " + st.LastError
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if args[0] != "retry" || len(args) != 2 {
+		return "", errors.New("status takes no arguments, or retry and a file-id, or all")
+	}
+	if fsys.options.ReadOnly {
+		return "", errors.New("the filesystem is mounted read-only")
+	}
+	which := args[1]
+
+	fsys.mutex.Lock()
+	var reqs []CloseRequest
+	for inode, fc := range fsys.failedCloses {
+		if which == "all" || fc.req.fileId == which {
+			reqs = append(reqs, fc.req)
+			delete(fsys.failedCloses, inode)
+		}
+	}
+	oph := fsys.opOpenNoHttpClient()
+	for _, req := range reqs {
+		fsys.journalState(oph, req.fileId, UploadStateQueued, nil)
+	}
+	var statuses []JournalStatus
+	if len(reqs) == 0 && which != "all" {
+		statuses, _ = fsys.mdb.JournalStatus(oph)
+	}
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if len(reqs) == 0 {
+		if which == "all" {
+			return "There are no failed closes to retry", nil
+		}
+		for _, st := range statuses {
+			if st.FileId == which && st.State == UploadStateFailed && !st.Orphan {
+				return "", fmt.Errorf("%s failed before it was closed, and cannot be retried; write the file again", which)
+			}
+		}
+		return "", fmt.Errorf("%s is not a file that failed to close", which)
+	}
+
+	if fsys.closer != nil {
+		for _, req := range reqs {
+			fsys.closer.Enqueue(req)
+		}
+		return fmt.Sprintf("Queued %d files for closing", len(reqs)), nil
+	}
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+	var failures []string
+	for _, req := range reqs {
+		if err := fsys.closeQueuedFile(ctx, httpClient, req); err != nil {
+			failures = append(failures, fmt.Sprintf("%s (%s)", req.fileId, err.Error()))
+		}
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("%d files failed to close: %s", len(failures), strings.Join(failures, ", "))
+	}
+	return fmt.Sprintf("Closed %d files", len(reqs)), nil
+}
+
+// Find orphans by file-id, or all of them
+//
+// Note: the global lock must be held
+func (fsys *Filesys) selectOrphans(oph *OpHandle, which string) ([]JournalEntry, error) {
+	orphans, err := fsys.mdb.JournalOrphans(oph)
+	if err != nil {
+		return nil, err
+	}
+	if which == "all" {
+		return orphans, nil
+	}
+	for _, o := range orphans {
+		if o.FileId == which {
+			return []JournalEntry{o}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not an orphaned upload", which)
+}
+
+// The number of bytes an orphan would have once closed. The parts uploaded
+// to the platform must be numbered from one, with no gaps, otherwise
+// closing the file would leave a hole in the data.
+func orphanSize(desc *DxFileParts) (int64, error) {
+	complete := make(map[int]int64)
+	maxPartId := 0
+	for key, part := range desc.Parts {
+		partId, err := strconv.Atoi(key)
+		if err != nil {
+			return 0, fmt.Errorf("the platform has a part numbered %s", key)
+		}
+		if part.State != "complete" {
+			continue
+		}
+		complete[partId] = part.Size
+		maxPartId = MaxInt(maxPartId, partId)
+	}
+
+	var missing []string
+	var size int64
+	for partId := 1; partId <= maxPartId; partId++ {
+		partSize, ok := complete[partId]
+		if !ok {
+			missing = append(missing, strconv.Itoa(partId))
+			continue
+		}
+		size += partSize
+	}
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("parts %s were not uploaded, closing would leave a gap in the data",
+			strings.Join(missing, ","))
+	}
+	return size, nil
+}
+
+// Close or remove an orphan on the platform, and drop it from the journal.
+// An orphan is closed only if the parts that were uploaded are contiguous.
+// Returns the number of bytes of a file that was closed.
+func (fsys *Filesys) resolveOrphan(ctx context.Context, httpClient *http.Client, verb string, o JournalEntry) (int64, error) {
+	var size int64
+	descs, err := DxDescribeBulkObjects(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, o.ProjId, []string{o.FileId})
+	if err != nil {
+		return 0, err
+	}
+	desc, ok := descs[o.FileId]
+	switch {
+	case !ok:
+		// already removed
+	case verb == "close" && desc.State == "open":
+		var parts *DxFileParts
+		parts, err = DxDescribeFileParts(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, o.ProjId, o.FileId)
+		if err != nil {
+			return 0, err
+		}
+		if size, err = orphanSize(parts); err != nil {
+			return 0, err
+		}
+		fsys.log("Closing orphan %s:%s, it has %d parts and %d bytes, the data written after them is lost",
+			o.ProjId, o.Path, len(parts.Parts), size)
+		err = fsys.ops.DxFileCloseAndWait(ctx, httpClient, o.ProjId, o.FileId)
+	case verb == "close":
+		// already closed, or closing
+	case verb == "remove":
+		err = fsys.ops.DxRemoveObjects(ctx, httpClient, o.ProjId, []string{o.FileId})
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	return size, fsys.mdb.JournalRemove(oph, o.FileId)
+}
+
+// List, close, or remove the uploads left open by a previous mount
+func (fsys *Filesys) CmdOrphans(ctx context.Context, verb string, args []string) (string, error) {
+	which := "all"
+	switch verb {
+	case "list":
+		if len(args) != 0 {
+			return "", errors.New("orphans list takes no arguments")
+		}
+	case "close", "remove":
+		if len(args) != 1 {
+			return "", fmt.Errorf("orphans %s takes a file-id, or all", verb)
+		}
+		if fsys.options.ReadOnly {
+			return "", errors.New("the filesystem is mounted read-only")
+		}
+		which = args[0]
+	default:
+		return "", fmt.Errorf("unknown orphans command %s", verb)
+	}
+
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	orphans, err := fsys.selectOrphans(oph, which)
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if len(orphans) == 0 {
+		return "There are no orphaned uploads", nil
+	}
+
+	if verb == "list" {
+		var lines []string
+		for _, o := range orphans {
+			var size int64
+			for _, part := range o.Parts {
+				size += part.Size
+			}
+			lines = append(lines, fmt.Sprintf("%s  %s:%s  %d parts  %d bytes  started %s",
+				o.FileId, o.ProjId, o.Path, len(o.Parts), size,
+				time.Unix(o.Ctime, 0).Format(time.RFC3339)))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+	numDone := 0
+	var numBytes int64
+	var failures []string
+	for _, o := range orphans {
+		size, err := fsys.resolveOrphan(ctx, httpClient, verb, o)
+		if err != nil {
+			fsys.log("Error in orphans %s %s: %s", verb, o.FileId, err.Error())
+			failures = append(failures, fmt.Sprintf("%s (%s)", o.FileId, err.Error()))
+			continue
+		}
+		numDone++
+		numBytes += size
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("%d orphans could not be handled: %s", len(failures), strings.Join(failures, ", "))
+	}
+	if verb == "close" {
+		return fmt.Sprintf("Closed %d orphans, with %d bytes. Data written after the last uploaded part is lost", numDone, numBytes), nil
+	}
+	return fmt.Sprintf("Removed %d orphans", numDone), nil
+}
@@ -152,9 +152,10 @@ func MakeManifestFromProjectIds(
 	projectIds []string) (*Manifest, error) {
 	// describe the projects, retrieve metadata for them
 	tmpHttpClient := dxda.NewHttpClient()
+	rp := NewRetryPolicy(RetryTimeoutDefault)
 	projDescs := make(map[string]DxDescribePrj)
 	for _, pId := range projectIds {
-		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, pId)
+		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, rp, pId)
 		if err != nil {
 			LogMsg("Could not describe project %s, check permissions", pId)
 			return nil, err
@@ -306,6 +307,7 @@ It is a node in the middle, which is illegal.
 
 func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnvironment) error {
 	tmpHttpClient := dxda.NewHttpClient()
+	rp := NewRetryPolicy(RetryTimeoutDefault)
 
 	// Map of all the files that are missing details grouped by project-id
 	fileIdsPerProject := make(map[string][]string)
@@ -318,7 +320,7 @@ func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnviron
 	var describedObjects = make(map[string]DxDescribeDataObject)
 	// batch calls per project-id
 	for projectId, fileIds := range fileIdsPerProject {
-		dataObjs, err := DxDescribeBulkObjects(ctx, tmpHttpClient, &dxEnv, projectId, fileIds)
+		dataObjs, err := DxDescribeBulkObjects(ctx, tmpHttpClient, &dxEnv, rp, projectId, fileIds)
 		if err != nil {
 			return err
 		}
@@ -364,7 +366,7 @@ func (m *Manifest) FillInMissingFields(ctx context.Context, dxEnv dxda.DXEnviron
 	// describe the projects, retrieve metadata for them
 	projDescs := make(map[string]DxDescribePrj)
 	for pId, _ := range projectIds {
-		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, pId)
+		pDesc, err := DxDescribeProject(ctx, tmpHttpClient, &dxEnv, rp, pId)
 		if err != nil {
 			m.log("Could not describe project %s, check permissions", pId)
 			return err
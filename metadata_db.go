@@ -10,7 +10,10 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dnanexus/dxda"
@@ -36,12 +39,24 @@ type MetadataDb struct {
 	options  Options
 	// API to dx
 	ops *DxOps
+
+	// Parts that have been uploaded, and are not written to the journal
+	// yet. The upload workers add parts without holding the global lock,
+	// they are written in batches.
+	journalMutex sync.Mutex
+	journalParts map[string][]JournalPart
+
+	// Files in the same project that written files were linked to by
+	// deduplication, by object id. When the folder of such a file is read,
+	// the file becomes another name of the written file's inode.
+	dedupLinks map[string]int64
 }
 
 func NewMetadataDb(
 	dbFullPath string,
 	dxEnv dxda.DXEnvironment,
-	options Options) (*MetadataDb, error) {
+	options Options,
+	retry *RetryPolicy) (*MetadataDb, error) {
 	// create a connection to the database, that will be kept open
 	db, err := sql.Open("sqlite3", dbFullPath+"?mode=rwc")
 	if err != nil {
@@ -55,7 +70,9 @@ func NewMetadataDb(
 		baseDir2ProjectId: make(map[string]string),
 		inodeCnt:          InodeRoot + 1,
 		options:           options,
-		ops:               NewDxOps(dxEnv, options),
+		ops:               NewDxOps(dxEnv, options, retry),
+		journalParts:      make(map[string][]JournalPart),
+		dedupLinks:        make(map[string]int64),
 	}, nil
 }
 
@@ -285,6 +302,60 @@ func (mdb *MetadataDb) init2(txn *sql.Tx) error {
 		return fmt.Errorf("Could not create index inode_rev_index on table namespace")
 	}
 
+	// Tags, properties, and types given to new files in a directory, and
+	// in its subdirectories. They are set through extended attributes, and
+	// only exist in the mount.
+	sqlStmt = `
+	CREATE TABLE dir_defaults (
+		inode bigint,
+		kind text,
+		name text,
+		value text,
+		PRIMARY KEY (inode, kind, name)
+	);
+	`
+	if _, err := txn.Exec(sqlStmt); err != nil {
+		mdb.log(err.Error())
+		return fmt.Errorf("Could not create table dir_defaults")
+	}
+
+	// A journal of the uploads in progress. A file is added when it is
+	// created on the platform for writing, and removed when it is closed.
+	// Entries left over from a previous mount are marked as orphans. The
+	// state is one of the upload states, with the number of attempts to
+	// close the file, and the last error.
+	sqlStmt = `
+	CREATE TABLE upload_journal (
+		file_id text,
+		proj_id text,
+		path text,
+                ctime bigint,
+                orphan int,
+                state text,
+                attempts int,
+                last_error text,
+                PRIMARY KEY (file_id)
+	);
+	`
+	if _, err := txn.Exec(sqlStmt); err != nil {
+		mdb.log(err.Error())
+		return fmt.Errorf("Could not create table upload_journal")
+	}
+
+	sqlStmt = `
+	CREATE TABLE upload_parts (
+		file_id text,
+                part_id int,
+                size bigint,
+                md5 text,
+                PRIMARY KEY (file_id, part_id)
+	);
+	`
+	if _, err := txn.Exec(sqlStmt); err != nil {
+		mdb.log(err.Error())
+		return fmt.Errorf("Could not create table upload_parts")
+	}
+
 	// A separate table for directories.
 	//
 	// If the inode is -1, then, the directory does not exist on the platform.
@@ -387,9 +458,11 @@ func (mdb *MetadataDb) allocInodeNum() int64 {
 // parent directory determines which project the file belongs to.
 // This is why we set the project-id instead of reading it from the file
 func (mdb *MetadataDb) lookupDataObjectByInode(oph *OpHandle, oname string, inode int64) (File, bool, error) {
-	// point lookup in the files table
+	// point lookup in the files table, the link count is the number of
+	// names the file has in the namespace
 	sqlStmt := fmt.Sprintf(`
- 		        SELECT kind,id,proj_id,state,archival_state,size,ctime,mtime,mode,tags,properties,symlink, dirty_data, dirty_metadata
+ 		        SELECT kind,id,proj_id,state,archival_state,size,ctime,mtime,mode,tags,properties,symlink, dirty_data, dirty_metadata,
+                               (SELECT COUNT(*) FROM namespace WHERE namespace.inode = data_objects.inode)
                         FROM data_objects
 			WHERE inode = '%d';`,
 		inode)
@@ -414,7 +487,7 @@ func (mdb *MetadataDb) lookupDataObjectByInode(oph *OpHandle, oname string, inod
 		var dirtyData int
 		var dirtyMetadata int
 		rows.Scan(&f.Kind, &f.Id, &f.ProjId, &f.State, &f.ArchivalState, &f.Size, &ctime, &mtime, &f.Mode,
-			&tags, &props, &f.Symlink, &dirtyData, &dirtyMetadata)
+			&tags, &props, &f.Symlink, &dirtyData, &dirtyMetadata, &f.Nlink)
 		f.Ctime = SecondsToTime(ctime)
 		f.Mtime = SecondsToTime(mtime)
 		f.Tags = tagsUnmarshal(tags)
@@ -431,11 +504,64 @@ func (mdb *MetadataDb) lookupDataObjectByInode(oph *OpHandle, oname string, inod
 		return File{}, false, nil
 	case 1:
 		// found exactly one file
-		return f, true, nil
 	default:
 		log.Panicf("Found %d data-objects with inode=%d (name %s)", numRows, inode, oname)
 		return File{}, false, nil
 	}
+
+	if mdb.options.PosixMetadata && f.State == "closed" {
+		mdb.applyPosixMetadata(&f)
+	}
+	return f, true, nil
+}
+
+// Override the default attributes of a file with the values stored in
+// its reserved properties. Badly formatted values are ignored.
+func (mdb *MetadataDb) applyPosixMetadata(f *File) {
+	if v, ok := f.Properties[ModeProperty]; ok {
+		if mode, err := strconv.ParseUint(v, 8, 32); err == nil {
+			f.Mode = (f.Mode &^ os.ModePerm) | (os.FileMode(mode) & os.ModePerm)
+		} else {
+			mdb.log("bad %s property (%s) for file %s", ModeProperty, v, f.Id)
+		}
+	}
+	if v, ok := f.Properties[MtimeProperty]; ok {
+		if mtime, err := strconv.ParseInt(v, 10, 64); err == nil {
+			f.Mtime = SecondsToTime(mtime)
+		} else {
+			mdb.log("bad %s property (%s) for file %s", MtimeProperty, v, f.Id)
+		}
+	}
+	if v, ok := f.Properties[UidProperty]; ok {
+		if uid, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.Uid = uint32(uid)
+		} else {
+			mdb.log("bad %s property (%s) for file %s", UidProperty, v, f.Id)
+		}
+	}
+	if v, ok := f.Properties[GidProperty]; ok {
+		if gid, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.Gid = uint32(gid)
+		} else {
+			mdb.log("bad %s property (%s) for file %s", GidProperty, v, f.Id)
+		}
+	}
+}
+
+// Count the names a data object has in the namespace. This is the
+// link count reported to the kernel.
+func (mdb *MetadataDb) countLinks(oph *OpHandle, inode int64) (int, error) {
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT COUNT(*)
+                        FROM namespace
+			WHERE inode = '%d';`,
+		inode)
+	var nlink int
+	if err := oph.txn.QueryRow(sqlStmt).Scan(&nlink); err != nil {
+		mdb.log("countLinks inode=%d err=%s", inode, err.Error())
+		return 0, oph.RecordError(err)
+	}
+	return nlink, nil
 }
 
 func (mdb *MetadataDb) lookupDirByInode(oph *OpHandle, parent string, dname string, inode int64) (Dir, bool, error) {
@@ -516,14 +642,18 @@ func (mdb *MetadataDb) LookupByInode(ctx context.Context, oph *OpHandle, inode i
 	var obj_type int
 	numRows := 0
 	for rows.Next() {
-		rows.Scan(&parent, &name, &obj_type)
+		// A file with several hard links has one row per name. All
+		// the names refer to the same data object, we use the first one.
+		if numRows == 0 {
+			rows.Scan(&parent, &name, &obj_type)
+		}
 		numRows++
 	}
 	rows.Close()
 	if numRows == 0 {
 		return nil, false, nil
 	}
-	if numRows > 1 {
+	if numRows > 1 && obj_type == nsDirType {
 		log.Panicf("More than one node with inode=%d", inode)
 		return nil, false, nil
 	}
@@ -532,8 +662,6 @@ func (mdb *MetadataDb) LookupByInode(ctx context.Context, oph *OpHandle, inode i
 	case nsDirType:
 		return mdb.lookupDirByInode(oph, parent, name, inode)
 	case nsDataObjType:
-		// This is important for a file with multiple hard links. The
-		// parent directory determines which project the file belongs to.
 		return mdb.lookupDataObjectByInode(oph, name, inode)
 	default:
 		log.Panicf("Invalid type %d in namespace table", obj_type)
@@ -554,6 +682,43 @@ func (mdb *MetadataDb) LookupDirByInode(ctx context.Context, oph *OpHandle, inod
 	return dir, true, nil
 }
 
+// Find the directories that represent a project folder. There can be
+// several, for example, if a project is mounted more than once.
+func (mdb *MetadataDb) LookupDirsByProjFolder(
+	ctx context.Context,
+	oph *OpHandle,
+	projId string,
+	projFolder string) ([]Dir, error) {
+	sqlStmt := `
+ 		        SELECT inode
+                        FROM directories
+			WHERE proj_id = $1 AND proj_folder = $2;`
+	rows, err := oph.txn.Query(sqlStmt, projId, projFolder)
+	if err != nil {
+		mdb.log("LookupDirsByProjFolder %s:%s err=%s", projId, projFolder, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	var inodes []int64
+	for rows.Next() {
+		var inode int64
+		rows.Scan(&inode)
+		inodes = append(inodes, inode)
+	}
+	rows.Close()
+
+	var dirs []Dir
+	for _, inode := range inodes {
+		dir, ok, err := mdb.LookupDirByInode(ctx, oph, inode)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
 // Find information on a directory by searching on its full name.
 //
 func (mdb *MetadataDb) lookupDirByName(oph *OpHandle, dirname string) (string, string, error) {
@@ -819,6 +984,160 @@ func (mdb *MetadataDb) CreateDir(
 	return dnode, nil
 }
 
+// Add a data object that was placed in a directory on the platform by
+// other means than creating it, for example by cloning.
+func (mdb *MetadataDb) AddDataObject(
+	oph *OpHandle,
+	dir *Dir,
+	name string,
+	o DxDescribeDataObject) (int64, error) {
+	kind := mdb.kindOfFile(o)
+	inode, err := mdb.createDataObject(
+		oph,
+		kind,
+		false,
+		false,
+		o.ProjId,
+		o.State,
+		o.ArchivalState,
+		o.Id,
+		o.Size,
+		o.CtimeSeconds,
+		o.MtimeSeconds,
+		o.Tags,
+		o.Properties,
+		modeOfFile(kind),
+		dir.FullPath,
+		name,
+		symlinkOfFile(kind, o))
+	if err != nil {
+		mdb.log("error adding data object %s to directory %s", o.Id, dir.FullPath)
+		return 0, oph.RecordError(err)
+	}
+	return inode, nil
+}
+
+// The condition that a namespace entry, whose parent is in column col, is
+// in the subtree of a directory. It takes the path of the directory as $1,
+// and the prefix of the paths below it as $2, see subtreePrefix. We compare
+// prefixes with substr, because LIKE treats '%' and '_' in names as
+// wildcards.
+func inSubtree(col string) string {
+	return fmt.Sprintf("(%s = $1 OR substr(%s, 1, length($2)) = $2)", col, col)
+}
+
+// The prefix of the parents of all the entries below a directory
+func subtreePrefix(dirFullPath string) string {
+	if dirFullPath == "/" {
+		return "/"
+	}
+	return dirFullPath + "/"
+}
+
+// Count the data objects under a directory, that are not closed on the
+// platform. Only the parts of the subtree that have been read from the
+// platform are considered.
+func (mdb *MetadataDb) CountUnclosedInSubtree(oph *OpHandle, dirFullPath string) (int, error) {
+	sqlStmt := `
+ 		        SELECT COUNT(*)
+                        FROM namespace
+                        JOIN data_objects ON namespace.inode = data_objects.inode
+			WHERE ` + inSubtree("namespace.parent") + `
+                        AND data_objects.state != 'closed';`
+	var count int
+	err := oph.txn.QueryRow(sqlStmt, dirFullPath, subtreePrefix(dirFullPath)).Scan(&count)
+	if err != nil {
+		mdb.log("CountUnclosedInSubtree(%s) error %s", dirFullPath, err.Error())
+		return 0, oph.RecordError(err)
+	}
+	return count, nil
+}
+
+// A file that has not reached the closed state, or has data that was
+// not uploaded yet.
+type UnclosedFile struct {
+	Inode    int64
+	Id       string
+	ProjId   string
+	State    string
+	FullPath string
+}
+
+// Find the files in a subtree that are not closed. Only the parts of the
+// subtree that have been read from the platform are considered.
+func (mdb *MetadataDb) UnclosedInSubtree(oph *OpHandle, dirFullPath string) ([]UnclosedFile, error) {
+	sqlStmt := `
+ 		        SELECT data_objects.inode, data_objects.id, data_objects.proj_id, data_objects.state,
+                               namespace.parent, namespace.name
+                        FROM namespace
+                        JOIN data_objects ON namespace.inode = data_objects.inode
+			WHERE ` + inSubtree("namespace.parent") + `
+                        AND (data_objects.state != 'closed' OR data_objects.dirty_data = '1');`
+	rows, err := oph.txn.Query(sqlStmt, dirFullPath, subtreePrefix(dirFullPath))
+	if err != nil {
+		mdb.log("UnclosedInSubtree(%s) error %s", dirFullPath, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	var files []UnclosedFile
+	seen := make(map[int64]bool)
+	for rows.Next() {
+		var f UnclosedFile
+		var parent, name string
+		rows.Scan(&f.Inode, &f.Id, &f.ProjId, &f.State, &parent, &name)
+		if seen[f.Inode] {
+			// a hard link to a file that is already listed
+			continue
+		}
+		seen[f.Inode] = true
+		f.FullPath = filepath.Join(parent, name)
+		files = append(files, f)
+	}
+	rows.Close()
+	return files, nil
+}
+
+// Return the inodes of the data objects in a subtree. Only the parts of
+// the subtree that have been read from the platform are considered.
+func (mdb *MetadataDb) DataObjectsInSubtree(oph *OpHandle, dirFullPath string) (map[int64]bool, error) {
+	sqlStmt := `
+ 		        SELECT inode
+                        FROM namespace
+			WHERE obj_type = $3
+                        AND ` + inSubtree("parent") + `;`
+	rows, err := oph.txn.Query(sqlStmt, dirFullPath, subtreePrefix(dirFullPath), nsDataObjType)
+	if err != nil {
+		mdb.log("DataObjectsInSubtree(%s) error %s", dirFullPath, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	inodes := make(map[int64]bool)
+	for rows.Next() {
+		var inode int64
+		rows.Scan(&inode)
+		inodes[inode] = true
+	}
+	rows.Close()
+	return inodes, nil
+}
+
+// Count the files in a subtree that also have names (hard links)
+// outside of it.
+func (mdb *MetadataDb) CountExternalLinks(oph *OpHandle, dirFullPath string) (int, error) {
+	sqlStmt := `
+ 		        SELECT COUNT(*)
+                        FROM namespace AS inside
+                        JOIN namespace AS outside ON inside.inode = outside.inode
+			WHERE inside.obj_type = $3
+                        AND ` + inSubtree("inside.parent") + `
+                        AND NOT ` + inSubtree("outside.parent") + `;`
+	var count int
+	err := oph.txn.QueryRow(sqlStmt, dirFullPath, subtreePrefix(dirFullPath), nsDataObjType).Scan(&count)
+	if err != nil {
+		mdb.log("CountExternalLinks(%s) error %s", dirFullPath, err.Error())
+		return 0, oph.RecordError(err)
+	}
+	return count, nil
+}
+
 // Remove a directory from the database
 func (mdb *MetadataDb) RemoveEmptyDir(oph *OpHandle, inode int64) error {
 	sqlStmt := fmt.Sprintf(`
@@ -839,6 +1158,11 @@ func (mdb *MetadataDb) RemoveEmptyDir(oph *OpHandle, inode int64) error {
 		return oph.RecordError(err)
 	}
 
+	if _, err := oph.txn.Exec("DELETE FROM dir_defaults WHERE inode = $1;", inode); err != nil {
+		mdb.log("RemoveEmptyDir(%d): error in dir_defaults table removal", inode)
+		return oph.RecordError(err)
+	}
+
 	return nil
 }
 
@@ -879,9 +1203,21 @@ func (mdb *MetadataDb) kindOfFile(o DxDescribeDataObject) int {
 		len(o.SymlinkPath) > 0 {
 		kind = FK_Symlink
 	}
+	if kind == FK_Regular {
+		if _, ok := o.Properties[SymlinkProperty]; ok {
+			kind = FK_PosixSymlink
+		}
+	}
 	return kind
 }
 
+func modeOfFile(kind int) os.FileMode {
+	if kind == FK_PosixSymlink {
+		return symlinkMode
+	}
+	return fileReadOnlyMode
+}
+
 func symlinkOfFile(kind int, o DxDescribeDataObject) string {
 	if kind == FK_Regular && len(o.SymlinkPath) > 0 {
 		// A symbolic link
@@ -891,6 +1227,8 @@ func symlinkOfFile(kind int, o DxDescribeDataObject) string {
 	switch kind {
 	case FK_Symlink:
 		return o.SymlinkPath
+	case FK_PosixSymlink:
+		return o.Properties[SymlinkProperty]
 	default:
 		return ""
 	}
@@ -921,10 +1259,17 @@ func (mdb *MetadataDb) populateDir(
 	}
 
 	for _, o := range dxObjs {
+		linked, err := mdb.addDedupLinkName(oph, o, dirPath)
+		if err != nil {
+			return err
+		}
+		if linked {
+			continue
+		}
 		kind := mdb.kindOfFile(o)
 		symlink := symlinkOfFile(kind, o)
 
-		_, err := mdb.createDataObject(
+		_, err = mdb.createDataObject(
 			oph,
 			kind,
 			false,
@@ -938,7 +1283,7 @@ func (mdb *MetadataDb) populateDir(
 			o.MtimeSeconds,
 			o.Tags,
 			o.Properties,
-			fileReadOnlyMode,
+			modeOfFile(kind),
 			dirPath,
 			o.Name,
 			symlink)
@@ -999,7 +1344,7 @@ func (mdb *MetadataDb) directoryReadFromDNAx(
 	}
 
 	// describe all (closed) files
-	dxDir, err := DxDescribeFolder(ctx, oph.httpClient, &mdb.dxEnv, projId, projFolder)
+	dxDir, err := DxDescribeFolder(ctx, oph.httpClient, &mdb.dxEnv, mdb.ops.retry, projId, projFolder)
 	if err != nil {
 		fmt.Printf(err.Error())
 		fmt.Printf("reading directory frmo DNAx error")
@@ -1022,6 +1367,17 @@ func (mdb *MetadataDb) directoryReadFromDNAx(
 		mtimeApprox = MaxInt64(mtimeApprox, f.MtimeSeconds)
 	}
 
+	// The trash folder is not shown
+	if projFolder == "/" {
+		var subdirs []string
+		for _, subdir := range dxDir.subdirs {
+			if subdir != TrashFolder {
+				subdirs = append(subdirs, subdir)
+			}
+		}
+		dxDir.subdirs = subdirs
+	}
+
 	// The DNAx storage system does not adhere to POSIX. Try
 	// to fix the elements in the directory, so they would comply. This
 	// comes at the cost of renaming the original files, which can
@@ -1248,7 +1604,8 @@ func (mdb *MetadataDb) CreateFile(
 	oph *OpHandle,
 	dir *Dir,
 	fname string,
-	mode os.FileMode) (File, error) {
+	mode os.FileMode,
+	meta NewFileMetadata) (File, error) {
 	if mdb.options.Verbose {
 		mdb.log("CreateFile %s/%s projpath=%s%s",
 			dir.FullPath, fname, dir.ProjId, dir.ProjFolder)
@@ -1259,7 +1616,8 @@ func (mdb *MetadataDb) CreateFile(
 		context.TODO(), oph.httpClient, NewNonce().String(),
 		dir.ProjId,
 		fname,
-		dir.ProjFolder)
+		dir.ProjFolder,
+		meta)
 	if err != nil {
 		mdb.log("CreateFile error creating data object")
 		return File{}, err
@@ -1282,8 +1640,8 @@ func (mdb *MetadataDb) CreateFile(
 		0, /* the file is empty */
 		nowSeconds,
 		nowSeconds,
-		nil, // A local file initially doesn't have tags or properties
-		nil,
+		meta.Tags,
+		meta.Properties,
 		mode,
 		dir.FullPath,
 		fname,
@@ -1294,6 +1652,9 @@ func (mdb *MetadataDb) CreateFile(
 	}
 	mdb.log("Created file %s/%s %s:%s",
 		dir.FullPath, fname, dir.ProjId, fileId)
+	if err := mdb.JournalStart(oph, fileId, dir.ProjId, filepath.Join(dir.FullPath, fname)); err != nil {
+		return File{}, err
+	}
 
 	// 3. return a File structure
 	return File{
@@ -1307,25 +1668,207 @@ func (mdb *MetadataDb) CreateFile(
 		Ctime:         SecondsToTime(nowSeconds),
 		Mtime:         SecondsToTime(nowSeconds),
 		Mode:          mode,
+		Tags:          meta.Tags,
+		Properties:    meta.Properties,
 		Symlink:       "",
 		dirtyData:     true,
 	}, nil
 }
 
-// TODO: take into account the case of ForgetInode, and files that are open, but unlinked.
-//
-// on this file system, since we don't keep track of link count, this amount to removing the file.
-func (mdb *MetadataDb) Unlink(ctx context.Context, oph *OpHandle, file File) error {
+// Add a symbolic link to a directory. The marker object has already been
+// created, and closed, on the platform.
+func (mdb *MetadataDb) CreateSymlink(
+	ctx context.Context,
+	oph *OpHandle,
+	dir *Dir,
+	name string,
+	fileId string,
+	target string) (File, error) {
+	if mdb.options.Verbose {
+		mdb.log("CreateSymlink %s/%s -> %s", dir.FullPath, name, target)
+	}
+	nowSeconds := time.Now().Unix()
+	props := map[string]string{SymlinkProperty: target}
+	inode, err := mdb.createDataObject(
+		oph,
+		FK_PosixSymlink,
+		false,
+		false,
+		dir.ProjId,
+		"closed",
+		"live",
+		fileId,
+		0,
+		nowSeconds,
+		nowSeconds,
+		nil,
+		props,
+		symlinkMode,
+		dir.FullPath,
+		name,
+		target)
+	if err != nil {
+		mdb.log("CreateSymlink error creating data object")
+		return File{}, err
+	}
+
+	file, _, err := mdb.lookupDataObjectByInode(oph, name, inode)
+	return file, err
+}
+
+// Add a name for an existing data object. The new name shares the inode,
+// and the data object row, with the existing names.
+func (mdb *MetadataDb) CreateLink(
+	ctx context.Context,
+	oph *OpHandle,
+	file File,
+	parentDir Dir,
+	name string) error {
+	if mdb.options.Verbose {
+		mdb.log("CreateLink %s/%s -> inode=%d", parentDir.FullPath, name, file.Inode)
+	}
+	sqlStmt := "INSERT INTO namespace VALUES ($1, $2, $3, $4)"
+	if _, err := oph.txn.Exec(sqlStmt, parentDir.FullPath, name, nsDataObjType, file.Inode); err != nil {
+		mdb.log("CreateLink error inserting into namespace table %s/%s, err=%s",
+			parentDir.FullPath, name, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// A written file was found to be a duplicate of a file in the same project,
+// and was removed on the platform. The inode of the written file now refers
+// to the duplicate; names the duplicate already has in the database are moved
+// to that inode, so the two are hard links. If the folder of the duplicate
+// has not been read yet, it gets the name when the folder is read.
+func (mdb *MetadataDb) LinkDuplicate(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	oldId string,
+	dup DxDescribeDataObject) error {
+	if mdb.options.Verbose {
+		mdb.log("LinkDuplicate inode=%d id=%s (deduplicated from %s)", inode, dup.Id, oldId)
+	}
 	sqlStmt := fmt.Sprintf(`
-                           DELETE FROM namespace
-                           WHERE inode='%d';`,
-		file.Inode)
-	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+ 		        SELECT inode
+                        FROM data_objects
+			WHERE proj_id = '%s' AND id = '%s' AND inode != '%d';`,
+		dup.ProjId, dup.Id, inode)
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.log("LinkDuplicate id=%s err=%s", dup.Id, err.Error())
+		return oph.RecordError(err)
+	}
+	var dupInodes []int64
+	for rows.Next() {
+		var dupInode int64
+		rows.Scan(&dupInode)
+		dupInodes = append(dupInodes, dupInode)
+	}
+	rows.Close()
+
+	for _, dupInode := range dupInodes {
+		sqlStmt := "UPDATE namespace SET inode = $1 WHERE inode = $2;"
+		if _, err := oph.txn.Exec(sqlStmt, inode, dupInode); err != nil {
+			mdb.log("LinkDuplicate error moving the names of inode=%d, err=%s", dupInode, err.Error())
+			return oph.RecordError(err)
+		}
+		sqlStmt = "DELETE FROM data_objects WHERE inode = $1;"
+		if _, err := oph.txn.Exec(sqlStmt, dupInode); err != nil {
+			mdb.log("LinkDuplicate error removing inode=%d, err=%s", dupInode, err.Error())
+			return oph.RecordError(err)
+		}
+	}
+
+	sqlStmt = "UPDATE data_objects SET id = $1, tags = $2, properties = $3 WHERE inode = $4;"
+	if _, err := oph.txn.Exec(sqlStmt, dup.Id, tagsMarshal(dup.Tags), propertiesMarshal(dup.Properties), inode); err != nil {
 		mdb.log(err.Error())
-		mdb.log("could not delete row for inode=%d from the namespace table",
-			file.Inode)
+		mdb.log("LinkDuplicate error executing transaction")
 		return oph.RecordError(err)
 	}
+	if err := mdb.JournalRemove(oph, oldId); err != nil {
+		return err
+	}
+	mdb.dedupLinks[dup.Id] = inode
+	return nil
+}
+
+// While reading a folder, give a file that a written file was linked to a
+// name in the inode of the written file, if it still exists. Returns true if
+// the name was added.
+func (mdb *MetadataDb) addDedupLinkName(oph *OpHandle, o DxDescribeDataObject, dirPath string) (bool, error) {
+	inode, ok := mdb.dedupLinks[o.Id]
+	if !ok {
+		return false, nil
+	}
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT COUNT(*)
+                        FROM data_objects
+			WHERE inode = '%d' AND proj_id = '%s' AND id = '%s';`,
+		inode, o.ProjId, o.Id)
+	var count int
+	if err := oph.txn.QueryRow(sqlStmt).Scan(&count); err != nil {
+		mdb.log("addDedupLinkName inode=%d err=%s", inode, err.Error())
+		return false, oph.RecordError(err)
+	}
+	if count == 0 {
+		// the written file was removed, or rewritten
+		delete(mdb.dedupLinks, o.Id)
+		return false, nil
+	}
+	sqlStmt = "INSERT INTO namespace VALUES ($1, $2, $3, $4)"
+	if _, err := oph.txn.Exec(sqlStmt, dirPath, o.Name, nsDataObjType, inode); err != nil {
+		mdb.log("Error inserting %s/%s into the namespace table  err=%s", dirPath, o.Name, err.Error())
+		return false, oph.RecordError(err)
+	}
+	return true, nil
+}
+
+// Paths of all the names a data object has, sorted.
+func (mdb *MetadataDb) LinksOfInode(ctx context.Context, oph *OpHandle, inode int64) ([]string, error) {
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT parent, name
+                        FROM namespace
+			WHERE inode = '%d'
+			ORDER BY parent, name;`,
+		inode)
+	rows, err := oph.txn.Query(sqlStmt)
+	if err != nil {
+		mdb.log("LinksOfInode inode=%d err=%s", inode, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	var paths []string
+	for rows.Next() {
+		var parent string
+		var name string
+		rows.Scan(&parent, &name)
+		paths = append(paths, filepath.Join(parent, name))
+	}
+	rows.Close()
+	return paths, nil
+}
+
+// TODO: take into account the case of ForgetInode, and files that are open, but unlinked.
+//
+// Remove one name of a file. The data object is removed only when its
+// last name goes away; the boolean return value says if that happened.
+func (mdb *MetadataDb) Unlink(ctx context.Context, oph *OpHandle, parentDir Dir, name string, file File) (bool, error) {
+	sqlStmt := "DELETE FROM namespace WHERE parent = $1 AND name = $2"
+	if _, err := oph.txn.Exec(sqlStmt, parentDir.FullPath, name); err != nil {
+		mdb.log(err.Error())
+		mdb.log("could not delete row for %s/%s from the namespace table",
+			parentDir.FullPath, name)
+		return false, oph.RecordError(err)
+	}
+
+	nlink, err := mdb.countLinks(oph, file.Inode)
+	if err != nil {
+		return false, err
+	}
+	if nlink > 0 {
+		return false, nil
+	}
 
 	sqlStmt = fmt.Sprintf(`
                            DELETE FROM data_objects
@@ -1335,9 +1878,12 @@ func (mdb *MetadataDb) Unlink(ctx context.Context, oph *OpHandle, file File) err
 		mdb.log(err.Error())
 		mdb.log("could not delete row for inode=%d from the data_objects table",
 			file.Inode)
-		return oph.RecordError(err)
+		return false, oph.RecordError(err)
 	}
-	return nil
+	if err := mdb.JournalRemove(oph, file.Id); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (mdb *MetadataDb) UpdateFileAttrs(
@@ -1399,7 +1945,63 @@ func (mdb *MetadataDb) UpdateClosedFileMetadata(
 		mdb.log("UpdateFile error executing transaction")
 		return oph.RecordError(err)
 	}
-	return nil
+
+	var fileId string
+	sqlStmt = "SELECT id FROM data_objects WHERE inode = $1;"
+	if err := oph.txn.QueryRow(sqlStmt, inode).Scan(&fileId); err != nil {
+		mdb.log("UpdateClosedFileMetadata(%d) error %s", inode, err.Error())
+		return oph.RecordError(err)
+	}
+	return mdb.JournalRemove(oph, fileId)
+}
+
+// A closed file was rewritten. The new version is closed, and from now on
+// the inode refers to it. The upload is no longer in progress.
+func (mdb *MetadataDb) UpdateFileRewritten(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	uploadId string,
+	fileId string,
+	fileSize int64,
+	modTime time.Time,
+	mode os.FileMode) error {
+	if mdb.options.Verbose {
+		mdb.log("Update inode=%d id=%s size=%d state=closed (rewritten)", inode, fileId, fileSize)
+	}
+	sqlStmt := fmt.Sprintf(`
+ 		        UPDATE data_objects
+                        SET id = '%s', state = 'closed', size = '%d', mtime = '%d', mode = '%d', dirty_data = '0'
+			WHERE inode = '%d';`,
+		fileId, fileSize, modTime.Unix(), int(mode), inode)
+
+	if _, err := oph.txn.Exec(sqlStmt); err != nil {
+		mdb.log(err.Error())
+		mdb.log("UpdateFileRewritten error executing transaction")
+		return oph.RecordError(err)
+	}
+	return mdb.JournalRemove(oph, uploadId)
+}
+
+// A file that was written is replaced by a clone of an existing file with
+// the same contents. The inode keeps its names and attributes, and now
+// refers to the clone. The upload is no longer in progress.
+func (mdb *MetadataDb) UpdateFileDeduped(
+	ctx context.Context,
+	oph *OpHandle,
+	inode int64,
+	oldId string,
+	newId string) error {
+	if mdb.options.Verbose {
+		mdb.log("Update inode=%d id=%s (deduplicated from %s)", inode, newId, oldId)
+	}
+	sqlStmt := "UPDATE data_objects SET id = $1 WHERE inode = $2;"
+	if _, err := oph.txn.Exec(sqlStmt, newId, inode); err != nil {
+		mdb.log(err.Error())
+		mdb.log("UpdateFileDeduped error executing transaction")
+		return oph.RecordError(err)
+	}
+	return mdb.JournalRemove(oph, oldId)
 }
 
 func (mdb *MetadataDb) UpdateFileLocalPath(
@@ -1428,94 +2030,56 @@ func (mdb *MetadataDb) UpdateFileLocalPath(
 // 1) Can move a file from one directory to another,
 //    or leave it in the same directory
 // 2) Can change the filename.
+//
+// Only the name being moved changes, other hard links to the same
+// file stay where they are.
 func (mdb *MetadataDb) MoveFile(
 	ctx context.Context,
 	oph *OpHandle,
 	inode int64,
+	oldParentDir Dir,
+	oldName string,
 	newParentDir Dir,
 	newName string) error {
 	if mdb.options.Verbose {
-		mdb.log("MoveFile -> %s/%s", newParentDir.FullPath, newName)
+		mdb.log("MoveFile %s/%s -> %s/%s", oldParentDir.FullPath, oldName, newParentDir.FullPath, newName)
 	}
 	sqlStmt := fmt.Sprintf(`
  		        UPDATE namespace
                         SET parent = '%s', name = '%s'
-			WHERE inode = '%d';`,
-		newParentDir.FullPath, newName, inode)
+			WHERE parent = '%s' AND name = '%s';`,
+		newParentDir.FullPath, newName, oldParentDir.FullPath, oldName)
 
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
 		mdb.log(err.Error())
 		mdb.log("MoveFile error executing transaction")
 		return oph.RecordError(err)
 	}
-	return nil
-}
-
-type MoveRecord struct {
-	oldFullPath   string
-	name          string
-	newParent     string
-	newProjFolder string
-	inode         int64
-	nsObjType     int
-}
-
-func (mdb *MetadataDb) execModifyRecord(oph *OpHandle, r MoveRecord) error {
-	// Modify the parent fields in the namespace table.
-	if mdb.options.Verbose {
-		mdb.log("%s -> %s/%s", r.oldFullPath, r.newParent, r.name)
-	}
-	sqlStmt := fmt.Sprintf(`
- 		        UPDATE namespace
-                        SET parent = '%s', name = '%s'
-			WHERE inode = '%d';`,
-		r.newParent, r.name, r.inode)
-	if _, err := oph.txn.Exec(sqlStmt); err != nil {
-		mdb.log(err.Error())
-		mdb.log("MoveDir error executing transaction")
-		return oph.RecordError(err)
-	}
-
-	if r.nsObjType == nsDataObjType {
-		return nil
-	}
-	//  /dxfuse_test_data/A/fruit ->  proj-xxxx:/D/K/A/fruit
-	//  /dxfuse_test_data/A       ->  proj-xxxx:/D/K/A
-	//
-	if mdb.options.Verbose {
-		mdb.log("move subdir (%s) project-folder %s", r.oldFullPath, r.newProjFolder)
-	}
 
+	// The file may have moved to a different project
 	sqlStmt = fmt.Sprintf(`
- 		        UPDATE directories
-                        SET proj_folder = '%s'
+ 		        UPDATE data_objects
+                        SET proj_id = '%s'
 			WHERE inode = '%d';`,
-		r.newProjFolder, r.inode)
+		newParentDir.ProjId, inode)
 	if _, err := oph.txn.Exec(sqlStmt); err != nil {
 		mdb.log(err.Error())
-		mdb.log("MoveDir error executing transaction")
+		mdb.log("MoveFile error executing transaction")
 		return oph.RecordError(err)
 	}
 	return nil
 }
 
-// As a running example:
+// Move a directory, with its entire subtree, to a new parent and name.
+// For example, moving /A to /D/K/B:
 //
-// say we have a directory structure:
-// A
-// ├── fruit
-// │   ├── grapes.txt
-// │   └── melon.txt
-// ├── X.txt
-// └── Y.txt
-//
-// We also have:
-// D
-// └── K
-//
-// From the shell we issue the command:
-// $ mv A D/K/
+//   /A/fruit/melon.txt  ->  /D/K/B/fruit/melon.txt
+//   proj-xxxx:/A/fruit  ->  proj-xxxx:/D/K/B/fruit
 //
+// The subtree is updated with a few set-based statements, instead of
+// a statement per entry, so the time does not depend much on the size
+// of the tree. Running inside the operation transaction makes the move
+// all-or-nothing.
 func (mdb *MetadataDb) MoveDir(
 	ctx context.Context,
 	oph *OpHandle,
@@ -1523,84 +2087,69 @@ func (mdb *MetadataDb) MoveDir(
 	newParentDir Dir,
 	oldDir Dir,
 	newName string) error {
-
-	// Find the sub-tree rooted at oldDir, and change
-	// all the:
-	// 1) namespace records olddir -> newDir
-	// 2) directory records for proj_folder: olddir -> newDir
-
 	if mdb.options.Verbose {
 		mdb.log("MoveDir %s -> %s/%s", oldDir.FullPath, newParentDir.FullPath, newName)
 	}
+	newFullPath := filepath.Join(newParentDir.FullPath, newName)
+	newProjFolder := filepath.Join(newParentDir.ProjFolder, newName)
 
-	// Find all directories and data objects in the subtree rooted at
-	// the old directory. We use the SQL ability to match the prefix
-	// of a string; we add % at the end.
-	sqlStmt := fmt.Sprintf(`
- 		        SELECT parent, name, inode, obj_type
-                        FROM namespace
-			WHERE parent LIKE '%s';`,
-		oldDir.FullPath+"%")
-	rows, err := oph.txn.Query(sqlStmt)
+	oldPrefix := subtreePrefix(oldDir.FullPath)
+
+	// The directories of the subtree. This has to run before the namespace
+	// is updated, because it finds the directories by their old paths.
+	// Faux directories do not have a project folder.
+	sqlStmt := `
+ 		        UPDATE directories
+                        SET proj_id = $3,
+                            proj_folder = CASE WHEN proj_folder = '' THEN ''
+                                               ELSE $4 || substr(proj_folder, length($5) + 1) END
+			WHERE inode = $6
+                        OR inode IN (SELECT inode FROM namespace
+                                     WHERE obj_type = $7 AND ` + inSubtree("parent") + `);`
+	_, err := oph.txn.Exec(sqlStmt,
+		oldDir.FullPath, oldPrefix,
+		newParentDir.ProjId, newProjFolder, oldDir.ProjFolder,
+		oldDir.Inode, nsDirType)
 	if err != nil {
+		mdb.log("MoveDir(%s) error updating directories, %s", oldDir.FullPath, err.Error())
 		return oph.RecordError(err)
 	}
 
-	// extract the records, close the query
-	var records []MoveRecord = make([]MoveRecord, 0)
-	for rows.Next() {
-		var parent string
-		var name string
-		var inode int64
-		var nsObjType int
-		rows.Scan(&parent, &name, &inode, &nsObjType)
-
-		// sanity check: make sure the path actually starts with the old directory
-		if !strings.HasPrefix(parent, oldDir.FullPath) {
-			log.Panicf("Query returned node %s that does not start with prefix %s",
-				parent, oldDir.FullPath)
-		}
-
-		// For file /A/fruit/melon.txt
-		//   oldFullPath : /A/fruit/melon.txt
-		//   name : melon.txt
-		//   midPath : /A/fruit
-		//
-		midPath := newName + "/" + strings.TrimPrefix(parent, oldDir.FullPath)
-		var newProjFolder string
-		if nsObjType == nsDirType {
-			newProjFolder = filepath.Clean(newParentDir.ProjFolder + "/" + midPath + "/" + name)
-		}
-		mr := MoveRecord{
-			oldFullPath:   parent + "/" + name,
-			name:          name,
-			newParent:     filepath.Clean(newParentDir.FullPath + "/" + midPath),
-			newProjFolder: newProjFolder,
-			inode:         inode,
-			nsObjType:     nsObjType,
+	// The data objects may have moved to a different project
+	if oldDir.ProjId != newParentDir.ProjId {
+		sqlStmt = `
+ 		        UPDATE data_objects
+                        SET proj_id = $3
+			WHERE inode IN (SELECT inode FROM namespace
+                                        WHERE obj_type = $4 AND ` + inSubtree("parent") + `);`
+		_, err := oph.txn.Exec(sqlStmt,
+			oldDir.FullPath, oldPrefix, newParentDir.ProjId, nsDataObjType)
+		if err != nil {
+			mdb.log("MoveDir(%s) error updating data objects, %s", oldDir.FullPath, err.Error())
+			return oph.RecordError(err)
 		}
-		records = append(records, mr)
 	}
-	rows.Close()
 
-	// add the top level directory (A) to be moved. Note, that the top level directory may
-	// change name.
-	records = append(records, MoveRecord{
-		oldFullPath:   oldDir.FullPath,
-		name:          newName,
-		newParent:     filepath.Clean(newParentDir.FullPath),
-		newProjFolder: filepath.Clean(filepath.Join(newParentDir.ProjFolder, newName)),
-		inode:         oldDir.Inode,
-		nsObjType:     nsDirType,
-	})
-	if mdb.options.Verbose {
-		mdb.log("found %d records under directory %s: %v", len(records), oldDir.FullPath, records)
+	// All the entries under the directory
+	sqlStmt = `
+ 		        UPDATE namespace
+                        SET parent = $3 || substr(parent, length($1) + 1)
+			WHERE ` + inSubtree("parent") + `;`
+	if _, err := oph.txn.Exec(sqlStmt, oldDir.FullPath, oldPrefix, newFullPath); err != nil {
+		mdb.log("MoveDir(%s) error updating namespace, %s", oldDir.FullPath, err.Error())
+		return oph.RecordError(err)
 	}
 
-	for _, r := range records {
-		if err := mdb.execModifyRecord(oph, r); err != nil {
-			return err
-		}
+	// The directory itself, which may also change name
+	sqlStmt = `
+ 		        UPDATE namespace
+                        SET parent = $1, name = $2
+			WHERE parent = $3 AND name = $4;`
+	_, err = oph.txn.Exec(sqlStmt,
+		newParentDir.FullPath, newName, oldParentDir.FullPath, oldDir.Dname)
+	if err != nil {
+		mdb.log("MoveDir(%s) error updating namespace, %s", oldDir.FullPath, err.Error())
+		return oph.RecordError(err)
 	}
 	return nil
 }
@@ -1727,3 +2276,370 @@ func (mdb *MetadataDb) DirtyFilesGetAndReset(flag int) ([]DirtyFileInfo, error)
 	}
 	return fAr, nil
 }
+
+// A tag, property, or type given to new files in a directory. Only
+// properties have a value.
+type DirDefault struct {
+	Kind  string // one of {tag, prop, type}
+	Name  string
+	Value string
+}
+
+// The defaults set on a directory itself, sorted by kind and name
+func (mdb *MetadataDb) DirDefaults(oph *OpHandle, inode int64) ([]DirDefault, error) {
+	rows, err := oph.txn.Query(
+		"SELECT kind, name, value FROM dir_defaults WHERE inode = $1 ORDER BY kind, name;", inode)
+	if err != nil {
+		mdb.log("DirDefaults(%d) err=%s", inode, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	var defaults []DirDefault
+	for rows.Next() {
+		var d DirDefault
+		rows.Scan(&d.Kind, &d.Name, &d.Value)
+		defaults = append(defaults, d)
+	}
+	rows.Close()
+	return defaults, nil
+}
+
+// The defaults of a directory and of all its ancestors, in one query. They
+// are ordered from the root down to the directory, so that a default set
+// deeper in the tree comes later, and overrides the ones above it.
+func (mdb *MetadataDb) AncestorDirDefaults(oph *OpHandle, dirFullPath string) ([]DirDefault, error) {
+	// the directory and its ancestors, from the directory up to the root
+	var paths []string
+	for path := filepath.Clean(dirFullPath); ; path = filepath.Dir(path) {
+		paths = append(paths, path)
+		if path == "/" {
+			break
+		}
+	}
+	var conds []string
+	var args []interface{}
+	depth := make(map[string]int)
+	for i, path := range paths {
+		parent, name := splitPath(path)
+		conds = append(conds, fmt.Sprintf("(nm.parent = $%d AND nm.name = $%d)", len(args)+1, len(args)+2))
+		args = append(args, parent, name)
+		depth[path] = len(paths) - 1 - i
+	}
+
+	sqlStmt := fmt.Sprintf(`
+ 		        SELECT nm.parent, nm.name, dd.kind, dd.name, dd.value
+                        FROM dir_defaults as dd
+                        JOIN namespace as nm
+                        ON dd.inode = nm.inode
+			WHERE nm.obj_type = %d AND (%s)
+			ORDER BY dd.kind, dd.name;`,
+		nsDirType, strings.Join(conds, " OR "))
+	rows, err := oph.txn.Query(sqlStmt, args...)
+	if err != nil {
+		mdb.log("AncestorDirDefaults(%s) err=%s", dirFullPath, err.Error())
+		return nil, oph.RecordError(err)
+	}
+	type levelDefault struct {
+		depth int
+		d     DirDefault
+	}
+	var found []levelDefault
+	for rows.Next() {
+		var parent, dname string
+		var d DirDefault
+		rows.Scan(&parent, &dname, &d.Kind, &d.Name, &d.Value)
+		fullPath := dname
+		if parent != "" {
+			fullPath = filepath.Join(parent, dname)
+		}
+		found = append(found, levelDefault{depth: depth[fullPath], d: d})
+	}
+	rows.Close()
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].depth < found[j].depth
+	})
+	defaults := make([]DirDefault, len(found))
+	for i, ld := range found {
+		defaults[i] = ld.d
+	}
+	return defaults, nil
+}
+
+func (mdb *MetadataDb) SetDirDefault(oph *OpHandle, inode int64, d DirDefault) error {
+	sqlStmt := "INSERT OR REPLACE INTO dir_defaults VALUES ($1, $2, $3, $4);"
+	if _, err := oph.txn.Exec(sqlStmt, inode, d.Kind, d.Name, d.Value); err != nil {
+		mdb.log("SetDirDefault(%d, %s.%s) err=%s", inode, d.Kind, d.Name, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+func (mdb *MetadataDb) RemoveDirDefault(oph *OpHandle, inode int64, kind string, name string) error {
+	sqlStmt := "DELETE FROM dir_defaults WHERE inode = $1 AND kind = $2 AND name = $3;"
+	if _, err := oph.txn.Exec(sqlStmt, inode, kind, name); err != nil {
+		mdb.log("RemoveDirDefault(%d, %s.%s) err=%s", inode, kind, name, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// An upload recorded in the journal
+type JournalEntry struct {
+	FileId string
+	ProjId string
+	Path   string
+	Ctime  int64
+	Parts  []JournalPart
+}
+
+// The progress of an upload in this mount
+type JournalStatus struct {
+	JournalEntry
+	Orphan    bool
+	State     string
+	Attempts  int
+	LastError string
+}
+
+type JournalPart struct {
+	PartId int
+	Size   int64
+	Md5    string
+}
+
+// Record that a file was created on the platform, and is being written
+func (mdb *MetadataDb) JournalStart(oph *OpHandle, fileId string, projId string, path string) error {
+	sqlStmt := `
+ 		        INSERT INTO upload_journal
+			VALUES ($1, $2, $3, $4, '0', $5, '0', '');`
+	if _, err := oph.txn.Exec(sqlStmt, fileId, projId, path, time.Now().Unix(), UploadStateUploading); err != nil {
+		mdb.log("JournalStart(%s) error %s", fileId, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// Record a file that the sync daemon failed to upload. It was not written
+// through a file handle, so it may have no entry yet.
+func (mdb *MetadataDb) JournalSyncFailed(oph *OpHandle, fileId string, projId string, path string, lastErr error) error {
+	sqlStmt := `
+ 		        INSERT OR REPLACE INTO upload_journal
+			VALUES ($1, $2, $3, $4, '0', $5, '0', $6);`
+	if _, err := oph.txn.Exec(sqlStmt, fileId, projId, path, time.Now().Unix(),
+		UploadStateFailed, lastErr.Error()); err != nil {
+		mdb.log("JournalSyncFailed(%s) error %s", fileId, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// Keep a part that has been uploaded, until the next FlushJournalParts.
+// This does not require the global lock. Returns true if there were no
+// parts waiting to be written.
+func (mdb *MetadataDb) BufferJournalPart(fileId string, part JournalPart) bool {
+	mdb.journalMutex.Lock()
+	defer mdb.journalMutex.Unlock()
+	first := len(mdb.journalParts) == 0
+	mdb.journalParts[fileId] = append(mdb.journalParts[fileId], part)
+	return first
+}
+
+// Write the buffered parts to the journal. Parts of files that have left
+// the journal are dropped.
+func (mdb *MetadataDb) FlushJournalParts(oph *OpHandle) error {
+	mdb.journalMutex.Lock()
+	buffered := mdb.journalParts
+	mdb.journalParts = make(map[string][]JournalPart)
+	mdb.journalMutex.Unlock()
+
+	for fileId, parts := range buffered {
+		var count int
+		sqlStmt := "SELECT COUNT(*) FROM upload_journal WHERE file_id = $1;"
+		if err := oph.txn.QueryRow(sqlStmt, fileId).Scan(&count); err != nil {
+			mdb.log("FlushJournalParts(%s) error %s", fileId, err.Error())
+			return oph.RecordError(err)
+		}
+		if count == 0 {
+			continue
+		}
+		for _, part := range parts {
+			if err := mdb.JournalPart(oph, fileId, part); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Record a part that has been uploaded
+func (mdb *MetadataDb) JournalPart(oph *OpHandle, fileId string, part JournalPart) error {
+	sqlStmt := `
+ 		        INSERT OR REPLACE INTO upload_parts
+			VALUES ($1, $2, $3, $4);`
+	if _, err := oph.txn.Exec(sqlStmt, fileId, part.PartId, part.Size, part.Md5); err != nil {
+		mdb.log("JournalPart(%s, %d) error %s", fileId, part.PartId, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// The file has been closed, or removed
+func (mdb *MetadataDb) JournalRemove(oph *OpHandle, fileId string) error {
+	mdb.journalMutex.Lock()
+	delete(mdb.journalParts, fileId)
+	mdb.journalMutex.Unlock()
+
+	for _, table := range []string{"upload_journal", "upload_parts"} {
+		sqlStmt := fmt.Sprintf("DELETE FROM %s WHERE file_id = $1;", table)
+		if _, err := oph.txn.Exec(sqlStmt, fileId); err != nil {
+			mdb.log("JournalRemove(%s) error %s", fileId, err.Error())
+			return oph.RecordError(err)
+		}
+	}
+	return nil
+}
+
+// Record a change in the state of an upload. A file that starts closing
+// counts as one more attempt. The error is kept until the next failure.
+func (mdb *MetadataDb) JournalState(oph *OpHandle, fileId string, state string, lastErr error) error {
+	var err error
+	switch {
+	case state == UploadStateClosing:
+		_, err = oph.txn.Exec(
+			"UPDATE upload_journal SET state = $1, attempts = attempts + 1 WHERE file_id = $2;",
+			state, fileId)
+	case lastErr != nil:
+		_, err = oph.txn.Exec(
+			"UPDATE upload_journal SET state = $1, last_error = $2 WHERE file_id = $3;",
+			state, lastErr.Error(), fileId)
+	default:
+		_, err = oph.txn.Exec("UPDATE upload_journal SET state = $1 WHERE file_id = $2;", state, fileId)
+	}
+	if err != nil {
+		mdb.log("JournalState(%s, %s) error %s", fileId, state, err.Error())
+		return oph.RecordError(err)
+	}
+	return nil
+}
+
+// All the uploads that are not closed, in the order they were started
+func (mdb *MetadataDb) JournalStatus(oph *OpHandle) ([]JournalStatus, error) {
+	if err := mdb.FlushJournalParts(oph); err != nil {
+		return nil, err
+	}
+	rows, err := oph.txn.Query(`
+ 		        SELECT j.file_id, j.proj_id, j.path, j.ctime, j.orphan, j.state, j.attempts, j.last_error,
+                               p.part_id, p.size, p.md5
+                        FROM upload_journal AS j
+                        LEFT JOIN upload_parts AS p ON j.file_id = p.file_id
+			ORDER BY j.ctime, j.file_id, p.part_id;`)
+	if err != nil {
+		mdb.log("JournalStatus error %s", err.Error())
+		return nil, oph.RecordError(err)
+	}
+	var statuses []JournalStatus
+	for rows.Next() {
+		var st JournalStatus
+		var orphan int
+		var part journalPartRow
+		rows.Scan(&st.FileId, &st.ProjId, &st.Path, &st.Ctime, &orphan, &st.State, &st.Attempts, &st.LastError,
+			&part.partId, &part.size, &part.md5)
+		if n := len(statuses); n == 0 || statuses[n-1].FileId != st.FileId {
+			st.Orphan = intToBool(orphan)
+			statuses = append(statuses, st)
+		}
+		part.addTo(&statuses[len(statuses)-1].JournalEntry)
+	}
+	rows.Close()
+	return statuses, nil
+}
+
+// Add uploads that were left in progress by a previous mount
+func (mdb *MetadataDb) JournalAddOrphans(oph *OpHandle, entries []JournalEntry) error {
+	for _, e := range entries {
+		sqlStmt := `
+ 		        INSERT OR REPLACE INTO upload_journal
+			VALUES ($1, $2, $3, $4, '1', '', '0', '');`
+		if _, err := oph.txn.Exec(sqlStmt, e.FileId, e.ProjId, e.Path, e.Ctime); err != nil {
+			mdb.log("JournalAddOrphans(%s) error %s", e.FileId, err.Error())
+			return oph.RecordError(err)
+		}
+		for _, part := range e.Parts {
+			if err := mdb.JournalPart(oph, e.FileId, part); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List the uploads left in progress by a previous mount
+func (mdb *MetadataDb) JournalOrphans(oph *OpHandle) ([]JournalEntry, error) {
+	entries, err := readJournal(oph.txn, "WHERE j.orphan = '1'")
+	if err != nil {
+		mdb.log("JournalOrphans error %s", err.Error())
+		return nil, oph.RecordError(err)
+	}
+	return entries, nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// A part of a journal entry, read with a left join. A file with no parts
+// has null columns.
+type journalPartRow struct {
+	partId sql.NullInt64
+	size   sql.NullInt64
+	md5    sql.NullString
+}
+
+func (row journalPartRow) addTo(e *JournalEntry) {
+	if !row.partId.Valid {
+		return
+	}
+	e.Parts = append(e.Parts, JournalPart{
+		PartId: int(row.partId.Int64),
+		Size:   row.size.Int64,
+		Md5:    row.md5.String,
+	})
+}
+
+func readJournal(q queryer, where string) ([]JournalEntry, error) {
+	rows, err := q.Query(`
+ 		        SELECT j.file_id, j.proj_id, j.path, j.ctime, p.part_id, p.size, p.md5
+                        FROM upload_journal AS j
+                        LEFT JOIN upload_parts AS p ON j.file_id = p.file_id
+			` + where + `
+			ORDER BY j.ctime, j.file_id, p.part_id;`)
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var part journalPartRow
+		rows.Scan(&e.FileId, &e.ProjId, &e.Path, &e.Ctime, &part.partId, &part.size, &part.md5)
+		if n := len(entries); n == 0 || entries[n-1].FileId != e.FileId {
+			entries = append(entries, e)
+		}
+		part.addTo(&entries[len(entries)-1])
+	}
+	rows.Close()
+	return entries, nil
+}
+
+// Read the upload journal of the database left by a previous mount. All of
+// its entries are uploads that did not complete.
+func ReadUploadJournal(dbFullPath string) ([]JournalEntry, error) {
+	if _, err := os.Stat(dbFullPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite3", dbFullPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return readJournal(db, "")
+}
@@ -0,0 +1,200 @@
+package dxfuse
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tag and property changes made while a file is being written. The object
+// is open on the platform, and may be in the middle of closing, so the
+// changes are only recorded in the metadata database, and shown by the
+// xattr calls. The changes made so far are applied just before the file is
+// closed, and those made while it was closing, right after it. The global
+// lock is not held while they are sent to the platform.
+//
+// The changes are kept by inode, the file-id changes if the upload is
+// replaced by a clone while it is closing.
+type PendingXattrs struct {
+	tags  map[string]bool    // true to add the tag, false to remove it
+	props map[string]*string // nil to remove the property
+}
+
+func NewPendingXattrs() *PendingXattrs {
+	return &PendingXattrs{
+		tags:  make(map[string]bool),
+		props: make(map[string]*string),
+	}
+}
+
+func (px *PendingXattrs) empty() bool {
+	return len(px.tags) == 0 && len(px.props) == 0
+}
+
+// Add the changes of a later record, they take precedence
+func (px *PendingXattrs) add(later *PendingXattrs) {
+	for tag, add := range later.tags {
+		px.tags[tag] = add
+	}
+	for key, value := range later.props {
+		px.props[key] = value
+	}
+}
+
+// Make the changes to a set of tags and properties
+func (px *PendingXattrs) update(tags []string, props map[string]string) ([]string, map[string]string) {
+	var newTags []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if add, ok := px.tags[tag]; ok && !add {
+			continue
+		}
+		newTags = append(newTags, tag)
+		seen[tag] = true
+	}
+	for tag, add := range px.tags {
+		if add && !seen[tag] {
+			newTags = append(newTags, tag)
+		}
+	}
+	newProps := make(map[string]string)
+	for key, value := range props {
+		newProps[key] = value
+	}
+	for key, value := range px.props {
+		if value == nil {
+			delete(newProps, key)
+		} else {
+			newProps[key] = *value
+		}
+	}
+	return newTags, newProps
+}
+
+// Is the file open on the platform, and written through this mount
+//
+// Note: the global lock must be held
+func (fsys *Filesys) fileBeingWritten(file File) bool {
+	if _, ok := fsys.rewrites[file.Inode]; ok {
+		// the new version is open
+		return true
+	}
+	if file.State != "open" {
+		return false
+	}
+	switch fsys.uploadState(file) {
+	case UploadStateUploading, UploadStateQueued, UploadStateClosing:
+		return true
+	}
+	return false
+}
+
+// The changes recorded for a file, created if there are none
+//
+// Note: the global lock must be held
+func (fsys *Filesys) pendingXattrsOf(file File) *PendingXattrs {
+	px, ok := fsys.pendingXattrs[file.Inode]
+	if !ok {
+		px = NewPendingXattrs()
+		fsys.pendingXattrs[file.Inode] = px
+	}
+	return px
+}
+
+// Take the changes recorded for a file, so they can be applied. Changes
+// made from now on are recorded anew.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) takePendingXattrs(inode int64) *PendingXattrs {
+	px, ok := fsys.pendingXattrs[inode]
+	if !ok {
+		return nil
+	}
+	fsys.pendingXattrs[inode] = NewPendingXattrs()
+	return px
+}
+
+// Put back changes that could not be applied, so they are applied when the
+// close is retried. Changes made since take precedence.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) restorePendingXattrs(inode int64, px *PendingXattrs) {
+	if px == nil || px.empty() {
+		return
+	}
+	if current, ok := fsys.pendingXattrs[inode]; ok {
+		px.add(current)
+	}
+	fsys.pendingXattrs[inode] = px
+}
+
+// Apply the changes made while a file was closing. The global lock is
+// released while they are sent to the platform, changes made meanwhile are
+// recorded, and applied in the next round. Once none are left the record is
+// removed, and the lock is still held, so the caller can mark the file
+// closed before any other change is made. The changes applied are returned
+// as well. Changes that could not be applied are kept, and applied when the
+// file is closed again.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) applyLastPendingXattrs(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	fileId string,
+	inode int64) (*PendingXattrs, error) {
+	applied := NewPendingXattrs()
+	for {
+		px := fsys.takePendingXattrs(inode)
+		if px == nil || px.empty() {
+			delete(fsys.pendingXattrs, inode)
+			return applied, nil
+		}
+		fsys.mutex.Unlock()
+		err := fsys.applyPendingXattrs(ctx, httpClient, projId, fileId, px)
+		fsys.mutex.Lock()
+		if err != nil {
+			fsys.restorePendingXattrs(inode, px)
+			return applied, err
+		}
+		applied.add(px)
+	}
+}
+
+// Apply tag and property changes to a file on the platform
+func (fsys *Filesys) applyPendingXattrs(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	fileId string,
+	px *PendingXattrs) error {
+	if px == nil || px.empty() {
+		return nil
+	}
+	var tagsToAdd, tagsToRemove []string
+	for tag, add := range px.tags {
+		if add {
+			tagsToAdd = append(tagsToAdd, tag)
+		} else {
+			tagsToRemove = append(tagsToRemove, tag)
+		}
+	}
+	if len(tagsToAdd) > 0 {
+		if err := fsys.ops.DxAddTags(ctx, httpClient, projId, fileId, tagsToAdd); err != nil {
+			return err
+		}
+	}
+	if len(tagsToRemove) > 0 {
+		if err := fsys.ops.DxRemoveTags(ctx, httpClient, projId, fileId, tagsToRemove); err != nil {
+			return err
+		}
+	}
+	if len(px.props) > 0 {
+		if err := fsys.ops.DxSetProperties(ctx, httpClient, projId, fileId, px.props); err != nil {
+			return err
+		}
+	}
+	if fsys.options.Verbose {
+		fsys.log("Applied the tags and properties set on %s while it was written", fileId)
+	}
+	return nil
+}
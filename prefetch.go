@@ -140,6 +140,8 @@ type PrefetchGlobalState struct {
 	numPrefetchThreads    int
 	maxNumChunksReadAhead int
 	ioCounter             uint64
+	throttle              *Throttle // limits on concurrent IOs, and on their bandwidth
+	retry                 *RetryPolicy
 }
 
 // presumption: there is some intersection
@@ -225,7 +227,7 @@ func (pgs *PrefetchGlobalState) log(a string, args ...interface{}) {
 	LogMsg("prefetch", a, args...)
 }
 
-func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *PrefetchGlobalState {
+func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment, options Options, retry *RetryPolicy) *PrefetchGlobalState {
 	// We want to:
 	// 1) allow all streams to have a worker available
 	// 2) not have more than two workers per CPU
@@ -272,7 +274,10 @@ func NewPrefetchGlobalState(verboseLevel int, dxEnv dxda.DXEnvironment) *Prefetc
 		prefetchMaxIoSize:     prefetchMaxIoSize,
 		numPrefetchThreads:    numPrefetchThreads,
 		maxNumChunksReadAhead: maxNumChunksReadAhead,
+		throttle:              NewThrottle("download", options.DownloadConcurrency, options.DownloadBandwidth),
+		retry:                 retry,
 	}
+	log.Printf("Download limits: %s", pgs.throttle.String())
 
 	// limit the number of prefetch IOs
 	pgs.wg.Add(numPrefetchThreads)
@@ -356,47 +361,51 @@ func (pgs *PrefetchGlobalState) readData(client *http.Client, ioReq IoReq) ([]by
 	}
 	headers["Range"] = fmt.Sprintf("bytes=%d-%d", ioReq.startByte, ioReq.endByte)
 
-	// Safety procedure to force timeout to prevent hanging
-	ctx, cancel := context.WithCancel(context.TODO())
-	timer := time.AfterFunc(readRequestTimeout, func() {
-		cancel()
-	})
-	defer timer.Stop()
+	// wait for our turn, the time spent waiting is not part of the IO
+	pgs.throttle.Start(expectedLen)
+	defer pgs.throttle.Done()
 
 	startTs := time.Now()
 	defer pgs.reportIfSlowIO(startTs, ioReq.inode, ioReq.startByte, ioReq.endByte)
 
-	for tCnt := 0; tCnt < NumRetriesDefault; tCnt++ {
-		resp, err := dxda.DxHttpRequest(ctx, client, 1, "GET", ioReq.url.URL, headers, []byte("{}"))
+	// Transient errors, and short reads, are retried according to the
+	// retry policy. During an outage, the read waits for the platform to
+	// come back, up to the retry timeout.
+	var data []byte
+	err := pgs.retry.Do(context.TODO(), "read", true, func(ctx context.Context) error {
+		// Safety procedure to force timeout to prevent hanging
+		ctx, cancel := context.WithTimeout(ctx, readRequestTimeout)
+		defer cancel()
+
+		resp, err := dxHttpRequest(ctx, client, "GET", ioReq.url.URL, headers, nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// TODO: optimize by using a pre-allocated buffer
-		data, _ := ioutil.ReadAll(resp.Body)
+		data, err = ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
+		if err != nil {
+			return err
+		}
 
 		recvLen := int64(len(data))
 		if recvLen != expectedLen {
-			// retry (only) in the case of short read
 			pgs.log("(inode=%d) (io=%d) received length is wrong, got %d, expected %d. Retrying.",
 				ioReq.inode, ioReq.id, recvLen, expectedLen)
-			continue
-		}
-
-		if pgs.verbose {
-			if err == nil {
-				pgs.log("(inode=%d) (io=%d) [%d -- %d] returned correctly",
-					ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte)
-			} else {
-				pgs.log("(inode=%d) (io=%d) [%d -- %d] returned with error %s",
-					ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte, err.Error())
-			}
+			return errShortRead
 		}
-		return data, err
+		return nil
+	})
+	if err != nil {
+		pgs.log("(inode=%d) (io=%d) [%d -- %d] returned with error %s",
+			ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte, err.Error())
+		return nil, err
 	}
-
-	pgs.log("Did not received the data for IO [%d -- %d]", ioReq.startByte, ioReq.endByte)
-	return nil, fmt.Errorf("Did not receive the data")
+	if pgs.verbose {
+		pgs.log("(inode=%d) (io=%d) [%d -- %d] returned correctly",
+			ioReq.inode, ioReq.id, ioReq.startByte, ioReq.endByte)
+	}
+	return data, nil
 }
 
 // Download an entire file, and write it to disk.
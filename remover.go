@@ -0,0 +1,252 @@
+package dxfuse
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnanexus/dxda"
+)
+
+const (
+	// The platform accepts up to 1000 objects in a single removal call
+	maxRemoveBatchSize = 1000
+
+	// How long an unlinked object may wait before it is removed on the platform
+	removeBatchDelay = 500 * time.Millisecond
+)
+
+type removeKey struct {
+	projId string
+	folder string
+}
+
+// Removes data objects on the platform in the background. Unlinking a file
+// updates the metadata database right away, and queues the object. Queued
+// objects are coalesced into bulk calls, one per project folder. If a bulk
+// call fails, the objects are still on the platform, and they are put back
+// in the metadata database.
+type Remover struct {
+	fsys       *Filesys
+	httpClient *http.Client
+
+	mutex    sync.Mutex
+	cond     *sync.Cond // signaled when a batch has been sent
+	pending  map[removeKey][]string
+	inflight int
+	failed   map[removeKey][]string // objects to put back in the database
+
+	wakeup chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewRemover(fsys *Filesys) *Remover {
+	rm := &Remover{
+		fsys:       fsys,
+		httpClient: dxda.NewHttpClient(),
+		pending:    make(map[removeKey][]string),
+		failed:     make(map[removeKey][]string),
+		wakeup:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	rm.cond = sync.NewCond(&rm.mutex)
+
+	rm.wg.Add(1)
+	go rm.removeWorker()
+	return rm
+}
+
+// write a log message, and add a header
+func (rm *Remover) log(a string, args ...interface{}) {
+	LogMsg("remover", a, args...)
+}
+
+// Send all the queued objects, and stop
+func (rm *Remover) Shutdown() {
+	close(rm.done)
+	rm.wg.Wait()
+}
+
+func (rm *Remover) removeWorker() {
+	defer rm.wg.Done()
+	for {
+		select {
+		case <-rm.done:
+			// the metadata database is discarded on unmount, failed
+			// objects will be found by the next mount
+			rm.sendAll()
+			return
+		case <-rm.wakeup:
+		case <-time.After(removeBatchDelay):
+		}
+		rm.sendAll()
+		rm.restoreFailed()
+	}
+}
+
+// Wake up the worker, if it is not awake already
+func (rm *Remover) wake() {
+	select {
+	case rm.wakeup <- struct{}{}:
+	default:
+		// the worker has already been woken up
+	}
+}
+
+// Queue an object for removal
+func (rm *Remover) Enqueue(projId string, folder string, objId string) {
+	key := removeKey{projId: projId, folder: folder}
+
+	rm.mutex.Lock()
+	rm.pending[key] = append(rm.pending[key], objId)
+	full := len(rm.pending[key]) >= maxRemoveBatchSize
+	rm.mutex.Unlock()
+
+	if full {
+		rm.wake()
+	}
+}
+
+// Remove from the queue the objects of a project folder, and return them. Waits
+// for batches that are being sent, so that none of the folder objects is
+// in flight when this returns.
+func (rm *Remover) Take(projId string, folder string) []string {
+	key := removeKey{projId: projId, folder: folder}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for rm.inflight > 0 {
+		rm.cond.Wait()
+	}
+	objIds := rm.pending[key]
+	delete(rm.pending, key)
+	return objIds
+}
+
+// A folder has moved on the platform. Objects queued under it, or under its
+// subfolders, are queued under the new location.
+func (rm *Remover) MoveFolder(projId string, oldFolder string, newFolder string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	moved := make(map[removeKey][]string)
+	for key, objIds := range rm.pending {
+		if key.projId != projId {
+			continue
+		}
+		if key.folder != oldFolder && !strings.HasPrefix(key.folder, oldFolder+"/") {
+			continue
+		}
+		newKey := removeKey{
+			projId: projId,
+			folder: newFolder + strings.TrimPrefix(key.folder, oldFolder),
+		}
+		moved[newKey] = objIds
+		delete(rm.pending, key)
+	}
+	for key, objIds := range moved {
+		rm.pending[key] = append(rm.pending[key], objIds...)
+	}
+}
+
+// Send everything that is queued, and wait for it to complete. Returns an
+// error if one of the objects could not be removed.
+func (rm *Remover) Flush() error {
+	err := rm.sendAll()
+
+	rm.mutex.Lock()
+	for rm.inflight > 0 {
+		rm.cond.Wait()
+	}
+	rm.mutex.Unlock()
+	return err
+}
+
+// Send the queued objects. Objects that could not be removed are handed
+// to the worker, which puts them back in the metadata database. Returns
+// the first error.
+func (rm *Remover) sendAll() error {
+	rm.mutex.Lock()
+	if len(rm.pending) == 0 {
+		rm.mutex.Unlock()
+		return nil
+	}
+	batches := rm.pending
+	rm.pending = make(map[removeKey][]string)
+	rm.inflight++
+	rm.mutex.Unlock()
+
+	var firstErr error
+	for key, objIds := range batches {
+		for len(objIds) > 0 {
+			n := MinInt(len(objIds), maxRemoveBatchSize)
+			chunk := objIds[:n]
+			objIds = objIds[n:]
+
+			err := rm.fsys.removeObjects(context.TODO(), rm.httpClient, key.projId, key.folder, chunk)
+			if err != nil {
+				rm.log("Error removing %d objects from %s:%s, %s",
+					len(chunk), key.projId, key.folder, err.Error())
+				rm.mutex.Lock()
+				rm.failed[key] = append(rm.failed[key], chunk...)
+				rm.mutex.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if rm.fsys.options.Verbose {
+				rm.log("Removed %d objects from %s:%s", len(chunk), key.projId, key.folder)
+			}
+		}
+	}
+
+	rm.mutex.Lock()
+	rm.inflight--
+	rm.cond.Broadcast()
+	rm.mutex.Unlock()
+
+	if firstErr != nil {
+		rm.wake()
+	}
+	return firstErr
+}
+
+// Put the objects that could not be removed back in the directories they
+// are in on the platform, so that they do not disappear from the mount
+// while they still exist. This takes the global lock, so it runs only on
+// the worker.
+func (rm *Remover) restoreFailed() {
+	rm.mutex.Lock()
+	failed := rm.failed
+	rm.failed = make(map[removeKey][]string)
+	rm.mutex.Unlock()
+
+	fsys := rm.fsys
+	for key, objIds := range failed {
+		dxObjs, err := DxDescribeBulkObjects(context.TODO(), rm.httpClient, &fsys.dxEnv, fsys.ops.retry, key.projId, objIds)
+		if err != nil {
+			rm.log("Error describing %d objects that could not be removed from %s:%s, %s",
+				len(objIds), key.projId, key.folder, err.Error())
+			continue
+		}
+		objects := make(map[string][]DxDescribeDataObject)
+		for _, oDesc := range dxObjs {
+			objects[oDesc.Folder] = append(objects[oDesc.Folder], oDesc)
+		}
+
+		fsys.mutex.Lock()
+		oph := fsys.opOpenNoHttpClient()
+		if err := fsys.attachRestored(context.TODO(), oph, key.projId, nil, objects); err != nil {
+			rm.log("Error restoring %d objects that could not be removed from %s:%s, %s",
+				len(dxObjs), key.projId, key.folder, err.Error())
+		} else {
+			rm.log("Restored %d objects that could not be removed from %s:%s",
+				len(dxObjs), key.projId, key.folder)
+		}
+		fsys.opClose(oph)
+		fsys.mutex.Unlock()
+	}
+}
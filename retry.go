@@ -0,0 +1,495 @@
+package dxfuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dnanexus/dxda"
+)
+
+const (
+	// How long a call keeps retrying, and waiting for the platform to
+	// come back, before it fails. Many filesystem operations call the
+	// platform while holding the global lock, so during an outage they
+	// hold up the rest of the mount for this long.
+	RetryTimeoutDefault = 2 * time.Minute
+
+	// bounds on the exponential backoff between attempts
+	retryBackoffInit = 1 * time.Second
+	retryBackoffMax  = 60 * time.Second
+
+	// After this many consecutive transient failures, across all calls,
+	// the circuit opens. Calls wait, instead of going to the platform,
+	// until the cooldown is over. Then, a single call checks if the
+	// platform is back, while the others keep waiting.
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+	breakerPollWait  = 1 * time.Second
+
+	// Safety timeout for a single API request, to prevent hanging
+	apiRequestTimeout = 5 * time.Minute
+
+	// Error responses larger than this are not parsed
+	maxErrorResponseSize = 16 * KiB
+)
+
+// A read that returned less data than was asked for
+var errShortRead = errors.New("received fewer bytes than requested")
+
+// A transient error, with the wait the platform asked for in its
+// Retry-After header
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%s (retry after %v)", e.err.Error(), e.after)
+}
+
+// The retry policy for requests to the platform. There is one for each
+// mount, shared by all its calls, since they go to the same platform, and
+// an outage seen by one call applies to the others.
+//
+// Transient errors, such as 5xx statuses, rate limiting, maintenance
+// mode, and dropped connections, are retried with exponential backoff and
+// jitter, for up to the retry timeout. Other errors are returned right
+// away.
+//
+// A call that changes something on the platform, and cannot be repeated
+// safely, is retried only if the platform surely did not carry it out: the
+// connection was refused, or the platform turned the request away because
+// of rate limiting or maintenance. Otherwise, if the reply was lost, the
+// retry would fail although the first attempt succeeded.
+type RetryPolicy struct {
+	mutex    sync.Mutex
+	timeout  time.Duration
+	cooldown time.Duration // how long the circuit stays open
+	pollWait time.Duration // how often waiting calls check on a probe
+
+	failures  int       // consecutive transient failures
+	openUntil time.Time // calls wait until then before going to the platform
+	probing   bool      // a call is checking if the platform is back
+}
+
+// Zero timeout means the default
+func NewRetryPolicy(timeout time.Duration) *RetryPolicy {
+	if timeout <= 0 {
+		timeout = RetryTimeoutDefault
+	}
+	return &RetryPolicy{
+		timeout:  timeout,
+		cooldown: breakerCooldown,
+		pollWait: breakerPollWait,
+	}
+}
+
+func (rp *RetryPolicy) log(a string, args ...interface{}) {
+	LogMsg("retry", a, args...)
+}
+
+// Call [fn] until it succeeds, fails with an error that is not transient,
+// or the retry timeout runs out. The error returned is the last one [fn]
+// returned. A call that is not [idempotent] is repeated only if the
+// platform turned it away.
+func (rp *RetryPolicy) Do(
+	ctx context.Context,
+	what string,
+	idempotent bool,
+	fn func(context.Context) error) error {
+	rp.mutex.Lock()
+	timeout := rp.timeout
+	rp.mutex.Unlock()
+	deadline := time.Now().Add(timeout)
+
+	// If this call checks whether the platform is back, and returns
+	// before it finds out, another call has to take over.
+	probe := false
+	defer func() {
+		if probe {
+			rp.endProbe()
+		}
+	}()
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		var err error
+		probe, err = rp.waitForCircuit(ctx, deadline, timeout)
+		if err != nil {
+			if lastErr != nil {
+				return lastErr
+			}
+			return err
+		}
+
+		err = fn(ctx)
+		if err == nil {
+			rp.succeeded()
+			probe = false
+			return nil
+		}
+		lastErr = unwrapRetryAfter(err)
+		if ctx.Err() != nil {
+			return lastErr
+		}
+		if !isTransientError(err) {
+			// the platform answered, it is up
+			rp.succeeded()
+			probe = false
+			return lastErr
+		}
+		after := retryAfter(err)
+		rp.failed(what, lastErr, after)
+		probe = false
+		if !idempotent && !isRejectedError(err) {
+			rp.log("%s failed, and may have been carried out, not retrying: %s", what, lastErr.Error())
+			return lastErr
+		}
+
+		delay := backoff(attempt)
+		if after > delay {
+			delay = after
+		}
+		if time.Now().Add(delay).After(deadline) {
+			rp.log("%s failed, and did not recover within %v: %s", what, timeout, lastErr.Error())
+			return lastErr
+		}
+		if err := sleepCtx(ctx, delay); err != nil {
+			return lastErr
+		}
+	}
+}
+
+// Wait while the circuit is open. Returns true if the call is the one that
+// checks if the platform is back, and an error if the circuit does not
+// close before the deadline.
+func (rp *RetryPolicy) waitForCircuit(ctx context.Context, deadline time.Time, timeout time.Duration) (bool, error) {
+	for {
+		now := time.Now()
+		if !now.Before(deadline) {
+			return false, &dxda.DxError{
+				EType:                 "ServiceUnavailable",
+				Message:               fmt.Sprintf("the platform did not recover within %v", timeout),
+				HttpCode:              http.StatusServiceUnavailable,
+				HttpCodeHumanReadable: http.StatusText(http.StatusServiceUnavailable),
+			}
+		}
+
+		rp.mutex.Lock()
+		var wait time.Duration
+		if now.Before(rp.openUntil) {
+			wait = rp.openUntil.Sub(now)
+		} else if rp.probing {
+			wait = rp.pollWait
+		} else {
+			probe := false
+			if rp.failures >= breakerThreshold {
+				// this call checks if the platform is back
+				rp.probing = true
+				probe = true
+			}
+			rp.mutex.Unlock()
+			return probe, nil
+		}
+		rp.mutex.Unlock()
+
+		if remaining := deadline.Sub(now); wait > remaining {
+			wait = remaining
+		}
+		if err := sleepCtx(ctx, wait); err != nil {
+			return false, err
+		}
+	}
+}
+
+// A call that was checking if the platform is back returned without an
+// answer, for example, because it was interrupted.
+func (rp *RetryPolicy) endProbe() {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.probing = false
+}
+
+func (rp *RetryPolicy) succeeded() {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	if rp.failures >= breakerThreshold {
+		rp.log("the platform is reachable again")
+	}
+	rp.failures = 0
+	rp.probing = false
+	rp.openUntil = time.Time{}
+}
+
+func (rp *RetryPolicy) failed(what string, err error, after time.Duration) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	rp.failures++
+	rp.probing = false
+
+	// A wait asked for by the platform, during maintenance for example,
+	// applies to all calls.
+	until := time.Now().Add(after)
+	if rp.failures >= breakerThreshold {
+		if rp.failures == breakerThreshold {
+			rp.log("%d consecutive transient errors, the last from %s: %s. Holding requests to the platform.",
+				rp.failures, what, err.Error())
+		}
+		cooldown := time.Now().Add(rp.cooldown)
+		if cooldown.After(until) {
+			until = cooldown
+		}
+	}
+	if until.After(rp.openUntil) {
+		rp.openUntil = until
+	}
+}
+
+// Exponential backoff with full jitter, so calls that failed together do
+// not retry together
+func backoff(attempt int) time.Duration {
+	max := retryBackoffMax
+	if attempt < 16 {
+		if d := retryBackoffInit << uint(attempt); d < max {
+			max = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func isTransientStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout,
+		http.StatusLocked,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Is an error worth retrying
+func isTransientError(err error) bool {
+	err = unwrapRetryAfter(err)
+	switch e := err.(type) {
+	case *dxda.DxError:
+		return isTransientStatus(e.HttpCode)
+	case *dxda.HttpError:
+		return isTransientStatus(e.StatusCode)
+	}
+	if err == errShortRead {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Did the platform turn the request away, without carrying it out
+func isRejectedError(err error) bool {
+	if _, ok := err.(*retryAfterError); ok {
+		return true
+	}
+	switch e := err.(type) {
+	case *dxda.DxError:
+		return e.HttpCode == http.StatusTooManyRequests || e.HttpCode == http.StatusServiceUnavailable
+	case *dxda.HttpError:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func unwrapRetryAfter(err error) error {
+	if e, ok := err.(*retryAfterError); ok {
+		return e.err
+	}
+	return err
+}
+
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*retryAfterError); ok {
+		return e.after
+	}
+	return 0
+}
+
+// The Retry-After header is either a number of seconds, or a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// A single http request, without retries. A status outside the 2xx
+// range is returned as a *dxda.HttpError, wrapped with the wait the
+// server asked for, if it sent a Retry-After header.
+func dxHttpRequest(
+	ctx context.Context,
+	client *http.Client,
+	requestType string,
+	url string,
+	headers map[string]string,
+	data []byte) (*http.Response, error) {
+	var dataReader io.Reader
+	if data != nil {
+		dataReader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, requestType, url, dataReader)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	hErr := &dxda.HttpError{
+		Message:             body,
+		StatusCode:          resp.StatusCode,
+		StatusHumanReadable: http.StatusText(resp.StatusCode),
+	}
+	if after := parseRetryAfter(resp.Header.Get("Retry-After")); after > 0 {
+		return nil, &retryAfterError{err: hErr, after: after}
+	}
+	return nil, hErr
+}
+
+// API methods that cannot be repeated safely. Repeating them fails, or does
+// the work twice. Creating a file is safe, since it carries a nonce.
+var nonIdempotentMethods = map[string]bool{
+	"clone":         true,
+	"close":         true,
+	"move":          true,
+	"newFolder":     true,
+	"removeFolder":  true,
+	"removeObjects": true,
+	"renameFolder":  true,
+}
+
+// The method of an API route, for example, "close" for "file-xxxx/close"
+func isIdempotentAPI(api string) bool {
+	method := api
+	if i := strings.LastIndex(api, "/"); i >= 0 {
+		method = api[i+1:]
+	}
+	return !nonIdempotentMethods[method]
+}
+
+// Call a DNAnexus API method, retrying transient errors according to the
+// retry policy. Errors from the platform are returned as *dxda.DxError.
+func dxAPI(
+	ctx context.Context,
+	client *http.Client,
+	dxEnv *dxda.DXEnvironment,
+	rp *RetryPolicy,
+	api string,
+	payload string) ([]byte, error) {
+	if dxEnv.Token == "" {
+		return nil, errors.New("The token is not set. This may be because the environment isn't set.")
+	}
+	headers := map[string]string{
+		"User-Agent":    dxda.UserAgent,
+		"Authorization": fmt.Sprintf("Bearer %s", dxEnv.Token),
+		"Content-Type":  "application/json",
+	}
+	url := fmt.Sprintf("%s://%s:%d/%s",
+		dxEnv.ApiServerProtocol,
+		dxEnv.ApiServerHost,
+		dxEnv.ApiServerPort,
+		api)
+
+	var body []byte
+	err := rp.Do(ctx, api, isIdempotentAPI(api), func(ctx context.Context) error {
+		ctx2, cancel := context.WithTimeout(ctx, apiRequestTimeout)
+		defer cancel()
+
+		resp, err := dxHttpRequest(ctx2, client, "POST", url, headers, []byte(payload))
+		if err != nil {
+			return httpErrorToDxError(err)
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Convert an http error status to a DNAnexus error, with the type and
+// message from the JSON response. A Retry-After wait is kept.
+func httpErrorToDxError(err error) error {
+	hErr, ok := unwrapRetryAfter(err).(*dxda.HttpError)
+	if !ok {
+		return err
+	}
+	dxErr := &dxda.DxError{
+		HttpCode:              hErr.StatusCode,
+		HttpCodeHumanReadable: hErr.StatusHumanReadable,
+	}
+	if len(hErr.Message) < maxErrorResponseSize {
+		var dxErrJson dxda.DxErrorJson
+		if json.Unmarshal(hErr.Message, &dxErrJson) == nil {
+			dxErr.EType = dxErrJson.E.EType
+			dxErr.Message = dxErrJson.E.Message
+		}
+	}
+	if after := retryAfter(err); after > 0 {
+		return &retryAfterError{err: dxErr, after: after}
+	}
+	return dxErr
+}
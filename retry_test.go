@@ -0,0 +1,249 @@
+package dxfuse
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dnanexus/dxda"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		max := retryBackoffMax
+		if attempt < 16 && retryBackoffInit<<uint(attempt) < max {
+			max = retryBackoffInit << uint(attempt)
+		}
+		for i := 0; i < 100; i++ {
+			d := backoff(attempt)
+			if d < 0 || d > max {
+				t.Fatalf("backoff(%d) = %v, expected between 0 and %v", attempt, d, max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"5", 5 * time.Second},
+		{"120", 2 * time.Minute},
+		{"-3", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tc := range testCases {
+		if d := parseRetryAfter(tc.value); d != tc.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", tc.value, d, tc.expected)
+		}
+	}
+
+	// a date is relative to now, and has a resolution of a second
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	d := parseRetryAfter(date)
+	if d < 58*time.Second || d > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, expected about a minute", date, d)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	timeout := &url.Error{Op: "Post", URL: "http://x", Err: context.DeadlineExceeded}
+	refused := &url.Error{Op: "Post", URL: "http://x",
+		Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+
+	testCases := []struct {
+		name      string
+		err       error
+		transient bool
+		rejected  bool
+	}{
+		{"503", &dxda.DxError{EType: "ServiceUnavailable", HttpCode: 503}, true, true},
+		{"429", &dxda.DxError{EType: "RateLimitConditional", HttpCode: 429}, true, true},
+		{"500", &dxda.DxError{EType: "InternalError", HttpCode: 500}, true, false},
+		{"502 http", &dxda.HttpError{StatusCode: 502}, true, false},
+		{"504 http", &dxda.HttpError{StatusCode: 504}, true, false},
+		{"404", &dxda.DxError{EType: "ResourceNotFound", HttpCode: 404}, false, false},
+		{"401", &dxda.DxError{EType: "InvalidAuthentication", HttpCode: 401}, false, false},
+		{"400 http", &dxda.HttpError{StatusCode: 400}, false, false},
+		{"retry after", &retryAfterError{err: &dxda.DxError{HttpCode: 503}, after: time.Second}, true, true},
+		{"short read", errShortRead, true, false},
+		{"timeout", timeout, true, false},
+		{"refused", refused, true, true},
+		{"other", errors.New("bad request"), false, false},
+	}
+	for _, tc := range testCases {
+		if isTransientError(tc.err) != tc.transient {
+			t.Errorf("%s: isTransientError = %t, expected %t", tc.name, !tc.transient, tc.transient)
+		}
+		if isRejectedError(tc.err) != tc.rejected {
+			t.Errorf("%s: isRejectedError = %t, expected %t", tc.name, !tc.rejected, tc.rejected)
+		}
+	}
+}
+
+func TestIsIdempotentAPI(t *testing.T) {
+	testCases := []struct {
+		api        string
+		idempotent bool
+	}{
+		{"system/findDataObjects", true},
+		{"file-xxxx/describe", true},
+		{"file/new", true},
+		{"file-xxxx/upload", true},
+		{"file-xxxx/rename", true},
+		{"project-xxxx/setProperties", true},
+		{"file-xxxx/close", false},
+		{"project-xxxx/clone", false},
+		{"project-xxxx/move", false},
+		{"project-xxxx/removeObjects", false},
+		{"project-xxxx/newFolder", false},
+		{"project-xxxx/removeFolder", false},
+		{"project-xxxx/renameFolder", false},
+	}
+	for _, tc := range testCases {
+		if isIdempotentAPI(tc.api) != tc.idempotent {
+			t.Errorf("isIdempotentAPI(%s) = %t, expected %t", tc.api, !tc.idempotent, tc.idempotent)
+		}
+	}
+}
+
+// A policy with a short cooldown, and the circuit open
+func openPolicy(t *testing.T, cooldown time.Duration) *RetryPolicy {
+	rp := NewRetryPolicy(time.Minute)
+	rp.cooldown = cooldown
+	rp.pollWait = 10 * time.Millisecond
+	err := &dxda.DxError{HttpCode: 503}
+	for i := 0; i < breakerThreshold; i++ {
+		rp.failed("test", err, 0)
+	}
+	if !time.Now().Before(rp.openUntil) {
+		t.Fatalf("the circuit did not open after %d failures", breakerThreshold)
+	}
+	return rp
+}
+
+func TestBreakerStates(t *testing.T) {
+	rp := NewRetryPolicy(time.Minute)
+	for i := 0; i < breakerThreshold-1; i++ {
+		rp.failed("test", errShortRead, 0)
+	}
+	probe, err := rp.waitForCircuit(context.TODO(), time.Now().Add(time.Second), time.Second)
+	if err != nil || probe {
+		t.Fatalf("closed circuit: probe=%t err=%v", probe, err)
+	}
+
+	// open: calls wait, and fail at their deadline
+	rp = openPolicy(t, time.Hour)
+	start := time.Now()
+	_, err = rp.waitForCircuit(context.TODO(), time.Now().Add(50*time.Millisecond), 50*time.Millisecond)
+	if dxErr, ok := err.(*dxda.DxError); !ok || dxErr.HttpCode != 503 {
+		t.Fatalf("open circuit: expected a 503 error, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("open circuit: returned before the deadline")
+	}
+
+	// half-open: after the cooldown, one call probes, the others wait
+	rp = openPolicy(t, 20*time.Millisecond)
+	probe, err = rp.waitForCircuit(context.TODO(), time.Now().Add(time.Second), time.Second)
+	if err != nil || !probe {
+		t.Fatalf("half-open circuit: probe=%t err=%v", probe, err)
+	}
+	_, err = rp.waitForCircuit(context.TODO(), time.Now().Add(50*time.Millisecond), 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("half-open circuit: a second call did not wait for the probe")
+	}
+
+	// a successful probe closes the circuit
+	rp.succeeded()
+	probe, err = rp.waitForCircuit(context.TODO(), time.Now().Add(time.Second), time.Second)
+	if err != nil || probe {
+		t.Fatalf("closed again: probe=%t err=%v", probe, err)
+	}
+
+	// a failed probe opens it again
+	rp = openPolicy(t, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	rp.failed("test", errShortRead, 0)
+	if !time.Now().Before(rp.openUntil) || rp.probing {
+		t.Fatalf("failed probe: the circuit did not open again")
+	}
+}
+
+// A probe that is interrupted must let another call take over
+func TestBreakerProbeCancelled(t *testing.T) {
+	rp := openPolicy(t, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	err := rp.Do(ctx, "test", true, func(ctx context.Context) error {
+		cancel()
+		return &url.Error{Op: "Post", URL: "http://x", Err: context.Canceled}
+	})
+	if err == nil {
+		t.Fatalf("expected the cancelled call to fail")
+	}
+	if rp.probing {
+		t.Fatalf("the probe was not released")
+	}
+
+	calls := 0
+	err = rp.Do(context.TODO(), "test", true, func(ctx context.Context) error {
+		calls++
+		return nil
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("the next call did not reach the platform, err=%v calls=%d", err, calls)
+	}
+	if rp.failures != 0 {
+		t.Fatalf("the circuit did not close")
+	}
+}
+
+func TestDoNonIdempotent(t *testing.T) {
+	rp := NewRetryPolicy(time.Minute)
+
+	// may have been carried out, not repeated
+	calls := 0
+	err := rp.Do(context.TODO(), "test", false, func(ctx context.Context) error {
+		calls++
+		return &dxda.DxError{HttpCode: 500}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("a failed mutation was repeated, err=%v calls=%d", err, calls)
+	}
+
+	// turned away by the platform, repeated
+	calls = 0
+	err = rp.Do(context.TODO(), "test", false, func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return &dxda.DxError{HttpCode: 429}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("a rate limited mutation was not repeated, err=%v calls=%d", err, calls)
+	}
+
+	// errors that are not transient are returned right away
+	calls = 0
+	notFound := &dxda.DxError{EType: "ResourceNotFound", HttpCode: 404}
+	err = rp.Do(context.TODO(), "test", true, func(ctx context.Context) error {
+		calls++
+		return &retryAfterError{err: notFound, after: time.Second}
+	})
+	if err != notFound || calls != 1 {
+		t.Fatalf("expected the not found error after one call, err=%v calls=%d", err, calls)
+	}
+}
@@ -0,0 +1,341 @@
+package dxfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DNAnexus files are immutable, so a closed file is rewritten by writing a
+// new version next to it. The new version is hidden while it is written,
+// and the inode keeps referring to the old version, so readers see the old
+// contents, and a listing of the folder shows a single file. Once the new
+// version is closed and verified, it is made visible, the old version is
+// removed, and the inode refers to the new version. If the new version
+// cannot be closed, or does not match what was written, it is removed, and
+// the old version is kept.
+type rewrite struct {
+	fileId string // the new version
+	projId string
+}
+
+// The id of the upload in progress for a file, the new version if the file
+// is being rewritten.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) uploadIdOf(file File) string {
+	if rw, ok := fsys.rewrites[file.Inode]; ok {
+		return rw.fileId
+	}
+	return file.Id
+}
+
+// Change the attributes of a file that is being rewritten. The database
+// describes the old version until the new one is closed, so only the new
+// version is changed.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) setRewriteAttributes(
+	ctx context.Context,
+	oph *OpHandle,
+	op *fuseops.SetInodeAttributesOp,
+	wfh *FileHandle,
+	file File) error {
+	rw := fsys.rewrites[file.Inode]
+
+	// The handle the new version is written through. It is the handle
+	// of the call, if the rewrite was just started through it.
+	var fh *FileHandle
+	if op.Handle != nil {
+		fh = fsys.fhTable[*op.Handle]
+	}
+	if wfh != nil && wfh.inode == file.Inode {
+		fh = wfh
+	}
+	if fh != nil && (fh.accessMode != AM_AO_Remote || fh.Id != rw.fileId) {
+		fh = nil
+	}
+	if op.Size != nil {
+		switch {
+		case fh == nil:
+			// the new version is closing
+			return syscall.EBUSY
+		case fh == wfh:
+			if err := fsys.truncateWriteHandle(wfh, int64(*op.Size)); err != nil {
+				return err
+			}
+		case int64(*op.Size) != fh.size:
+			// the lock of the handle is not held
+			return syscall.EBUSY
+		}
+	}
+
+	if fsys.options.PosixMetadata {
+		upload := file
+		upload.Id = rw.fileId
+		if err := fsys.setPosixMetadata(ctx, oph, upload, op.Mode, op.Mtime); err != nil {
+			return err
+		}
+	}
+
+	attrs := file.GetAttrs()
+	if fh != nil {
+		attrs.Size = uint64(fh.size)
+		attrs.Mode = fileWriteOnlyMode
+		attrs.Mtime = time.Now()
+	}
+	op.Attributes = attrs
+	op.AttributesExpiration = fsys.calcExpirationTime(attrs)
+	return nil
+}
+
+// Close the new version of a file that is being rewritten, and make it take
+// the place of the old one.
+//
+// Note: the file handle lock must be held
+func (fsys *Filesys) closeRewrittenFile(
+	ctx context.Context,
+	httpClient *http.Client,
+	fh *FileHandle,
+	file File) error {
+	req := CloseRequest{
+		inode:      fh.inode,
+		fileId:     fh.Id,
+		replacedId: fh.replacedId,
+		size:       fh.size,
+		checksum:   fh.checksum,
+	}
+	// No more writes are accepted through the handle
+	fh.accessMode = AM_RO_Remote
+	fh.replacedId = ""
+
+	fsys.mutex.Lock()
+	valid := file.Id == req.replacedId && fsys.rewrites[req.inode].fileId == req.fileId
+	fsys.mutex.Unlock()
+	if !valid {
+		fsys.log("File %s was removed before it was closed", req.fileId)
+		fsys.discardRewrite(ctx, httpClient, req.inode, req.fileId)
+		return nil
+	}
+
+	upload := file
+	upload.Id = req.fileId
+	fileId, verifyErr, err := fsys.closeUploadedFile(ctx, httpClient, upload, req.size, req.checksum)
+	if err == nil {
+		err = verifyErr
+	}
+	if err := fsys.finishRewrite(ctx, httpClient, file, req, fileId, err); err != nil {
+		return fsys.translateError(err)
+	}
+	fh.Id = fileId
+	return nil
+}
+
+// The new version of a file was closed, or could not be. On success, it is
+// made visible, the old version is removed, and the inode refers to the new
+// version. Otherwise, the rewrite is undone. The file is the old version,
+// as it was when the close started.
+func (fsys *Filesys) finishRewrite(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	req CloseRequest,
+	fileId string,
+	err error) error {
+	if fileId == "" {
+		fileId = req.fileId
+	}
+	if err == nil {
+		err = fsys.ops.DxSetVisibility(ctx, httpClient, file.ProjId, fileId, false)
+	}
+	if err != nil {
+		return fsys.abortRewrite(ctx, httpClient, file, req.fileId, fileId, err)
+	}
+
+	if !fsys.options.KeepReplacedFiles {
+		// The new version is safely on the platform. If we cannot remove the
+		// old one, there is no reason to fail the close.
+		if err := fsys.removeObject(ctx, httpClient, file.ProjId, req.replacedId); err != nil {
+			fsys.log("Error removing replaced version %s of file %s: %s",
+				req.replacedId, fileId, err.Error())
+		}
+	}
+
+	// The new version has the tags and properties of the old one, except
+	// for the md5 and mtime, and those changed while it was written.
+	desc, descErr := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, fileId)
+	if descErr != nil {
+		fsys.log("Error describing the new version %s of file %s: %s", fileId, file.Id, descErr.Error())
+	}
+	// tags and properties set while the file was closing
+	fsys.mutex.Lock()
+	applied, pxErr := fsys.applyLastPendingXattrs(ctx, httpClient, file.ProjId, fileId, file.Inode)
+	if pxErr != nil {
+		fsys.log("ERROR: could not set the tags and properties of %s: %s", fileId, pxErr.Error())
+	}
+	if descErr == nil {
+		desc.Tags, desc.Properties = applied.update(desc.Tags, desc.Properties)
+	}
+	swapped, err := fsys.swapRewrittenFile(ctx, file, req, fileId, desc, descErr == nil)
+	fsys.mutex.Unlock()
+	if !swapped {
+		// removed, or replaced, while it was closing
+		fsys.log("File %s was removed before it was closed", req.fileId)
+		if err := fsys.removeObject(ctx, httpClient, file.ProjId, fileId); err != nil {
+			fsys.log("Error removing the new version %s of a removed file: %s", fileId, err.Error())
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return pxErr
+}
+
+// Make the inode refer to the new version of a rewritten file, unless the
+// file was removed or replaced meanwhile.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) swapRewrittenFile(
+	ctx context.Context,
+	file File,
+	req CloseRequest,
+	fileId string,
+	desc DxDescribeDataObject,
+	described bool) (bool, error) {
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+
+	current, _, err := fsys.lookupFileByInode(ctx, oph, file.Inode)
+	if err != nil || current.Id != req.replacedId || fsys.rewrites[file.Inode].fileId != req.fileId {
+		return false, nil
+	}
+	delete(fsys.rewrites, file.Inode)
+	fsys.rewritten[file.Inode] = true
+	if err := fsys.mdb.UpdateFileRewritten(ctx, oph, file.Inode, req.fileId, fileId,
+		req.size, time.Now(), fileReadOnlyMode); err != nil {
+		fsys.log("database error in updating attributes for rewritten file %s", err.Error())
+		return true, fuse.EIO
+	}
+	if described {
+		current.Tags = desc.Tags
+		current.Properties = desc.Properties
+	} else {
+		delete(current.Properties, MtimeProperty)
+		delete(current.Properties, Md5Property)
+	}
+	if err := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, current); err != nil {
+		fsys.log("database error in updating properties for rewritten file %s", err.Error())
+		return true, fuse.EIO
+	}
+	if err := fsys.recordMd5Property(ctx, oph, file.Inode, req.checksum); err != nil {
+		fsys.log("database error in updating properties for rewritten file %s", err.Error())
+		return true, fuse.EIO
+	}
+	return true, nil
+}
+
+// Undo a rewrite that failed. The new version is removed, and the inode
+// keeps referring to the old one. The tags and properties changed during
+// the rewrite were applied to the new version, the database gets those of
+// the old version back.
+func (fsys *Filesys) abortRewrite(
+	ctx context.Context,
+	httpClient *http.Client,
+	file File,
+	uploadId string,
+	fileId string,
+	cause error) error {
+	err := fmt.Errorf("could not rewrite %s, the previous version %s is kept, %s",
+		uploadId, file.Id, cause.Error())
+	fsys.log("ERROR: %s", err.Error())
+
+	removed := true
+	if rmErr := fsys.removeObject(ctx, httpClient, file.ProjId, fileId); rmErr != nil {
+		fsys.log("Error removing the new version %s of file %s: %s", fileId, file.Id, rmErr.Error())
+		removed = false
+	}
+	oDesc, descErr := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if descErr != nil {
+		fsys.log("Error describing file %s: %s", file.Id, descErr.Error())
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if fsys.rewrites[file.Inode].fileId == uploadId {
+		delete(fsys.rewrites, file.Inode)
+		delete(fsys.pendingXattrs, file.Inode)
+	}
+	fsys.checksumFailures[file.Inode] = checksumFailure{fileId: uploadId, err: err}
+	if removed {
+		if jErr := fsys.mdb.JournalRemove(oph, uploadId); jErr != nil {
+			fsys.log("database error in removing %s from the upload journal", uploadId)
+		}
+	} else {
+		fsys.journalState(oph, uploadId, UploadStateFailed, err)
+	}
+
+	current, _, lookupErr := fsys.lookupFileByInode(ctx, oph, file.Inode)
+	if descErr == nil && lookupErr == nil && current.Id == file.Id {
+		current.Tags = oDesc.Tags
+		current.Properties = oDesc.Properties
+		if dbErr := fsys.mdb.UpdateFileTagsAndProperties(ctx, oph, current); dbErr != nil {
+			fsys.log("database error in restoring the properties of %s", file.Id)
+		}
+	}
+	return err
+}
+
+// The new version of a file that is not written to the end. The old version
+// is kept.
+func (fsys *Filesys) abandonRewrite(ctx context.Context, fh *FileHandle) {
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	file, _, err := fsys.lookupFileByInode(ctx, oph, fh.inode)
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+	if err != nil || file.Id != fh.replacedId {
+		fsys.discardRewrite(ctx, httpClient, fh.inode, fh.Id)
+		return
+	}
+	fsys.abortRewrite(ctx, httpClient, file, fh.Id, fh.Id, errors.New("the file was not written to the end"))
+}
+
+// A file was removed, or replaced, while it was being rewritten. Remove the
+// new version as well.
+func (fsys *Filesys) discardRewrite(ctx context.Context, httpClient *http.Client, inode int64, fileId string) {
+	fsys.mutex.Lock()
+	rw, ok := fsys.rewrites[inode]
+	if !ok || rw.fileId != fileId {
+		fsys.mutex.Unlock()
+		return
+	}
+	delete(fsys.rewrites, inode)
+	delete(fsys.pendingXattrs, inode)
+	fsys.mutex.Unlock()
+
+	if err := fsys.removeObject(ctx, httpClient, rw.projId, fileId); err != nil {
+		fsys.log("Error removing the new version %s of a removed file: %s", fileId, err.Error())
+		return
+	}
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if err := fsys.mdb.JournalRemove(oph, fileId); err != nil {
+		fsys.log("database error in removing %s from the upload journal", fileId)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
@@ -50,6 +51,8 @@ type SyncDbDx struct {
 	mdb                *MetadataDb
 	ops                *DxOps
 	nonce              *Nonce
+	// uploads share the limits of the file uploader
+	throttle *Throttle
 }
 
 func NewSyncDbDx(
@@ -57,7 +60,9 @@ func NewSyncDbDx(
 	dxEnv dxda.DXEnvironment,
 	projId2Desc map[string]DxDescribePrj,
 	mdb *MetadataDb,
-	mutex *sync.Mutex) *SyncDbDx {
+	mutex *sync.Mutex,
+	throttle *Throttle,
+	retry *RetryPolicy) *SyncDbDx {
 
 	numCPUs := runtime.NumCPU()
 	numBulkDataThreads := MinInt(numCPUs, maxNumBulkDataThreads)
@@ -92,8 +97,9 @@ func NewSyncDbDx(
 		numBulkDataThreads: numBulkDataThreads,
 		mutex:              mutex,
 		mdb:                mdb,
-		ops:                NewDxOps(dxEnv, options),
+		ops:                NewDxOps(dxEnv, options, retry),
 		nonce:              NewNonce(),
+		throttle:           throttle,
 	}
 
 	// bunch of background threads to upload bulk file data.
@@ -171,10 +177,12 @@ func (sybx *SyncDbDx) bulkDataWorker() {
 		}
 
 		// upload the data, and report the error if any
+		sybx.throttle.Start(int64(len(chunk.data)))
 		err := sybx.ops.DxFileUploadPart(
 			context.TODO(),
 			client,
 			chunk.fileId, chunk.index, chunk.data)
+		sybx.throttle.Done()
 		if err != nil {
 			sybx.log("failed to upload file %s part %d, error=%s",
 				chunk.fileId, chunk.index, err)
@@ -284,6 +292,8 @@ func (sybx *SyncDbDx) uploadFileData(
 		if err != nil {
 			return err
 		}
+		sybx.throttle.Start(int64(len(data)))
+		defer sybx.throttle.Done()
 		return sybx.ops.DxFileUploadPart(
 			context.TODO(),
 			client,
@@ -397,7 +407,8 @@ func (sybx *SyncDbDx) updateFileData(
 		context.TODO(), client, sybx.nonce.String(),
 		upReq.dfi.ProjId,
 		upReq.dfi.Name,
-		upReq.dfi.ProjFolder)
+		upReq.dfi.ProjFolder,
+		NewFileMetadata{})
 	if err != nil {
 		sybx.mutex.Unlock()
 		// an error could occur here if the directory has been removed
@@ -420,7 +431,7 @@ func (sybx *SyncDbDx) updateFileData(
 		// TODO: erase the local copy.
 		sybx.log("Error during upload of file %s: %s",
 			fileId, err.Error())
-		return "", err
+		return fileId, err
 	}
 
 	// Erase the old file-id.
@@ -437,7 +448,7 @@ func (sybx *SyncDbDx) updateFileData(
 	if err != nil {
 		// TODO: if the file has already been removed on the platform, then
 		// we will get an error here.
-		return "", err
+		return fileId, err
 	}
 	return fileId, nil
 }
@@ -445,7 +456,7 @@ func (sybx *SyncDbDx) updateFileData(
 func (sybx *SyncDbDx) updateFileAttributes(client *http.Client, dfi DirtyFileInfo) error {
 	// describe the object state on the platform. The properties/tags have
 	// changed.
-	fDesc, err := DxDescribe(context.TODO(), client, &sybx.dxEnv, dfi.ProjId, dfi.Id)
+	fDesc, err := DxDescribe(context.TODO(), client, &sybx.dxEnv, sybx.ops.retry, dfi.ProjId, dfi.Id)
 	if err != nil {
 		sybx.log(err.Error())
 		sybx.log("Failed ot describe file %v", dfi)
@@ -558,35 +569,59 @@ func (sybx *SyncDbDx) updateFileWorker() {
 
 		// note: the file-id may be empty ("") if the file
 		// has just been created on the local machine.
-		var err error
 		crntFileId := upReq.dfi.Id
 		if upReq.dfi.dirtyData {
-			crntFileId, err = sybx.updateFileData(client, upReq)
+			fileId, err := sybx.updateFileData(client, upReq)
 			if err != nil {
 				sybx.log("Error in update-data: %s", err.Error())
+				sybx.journalFailure(fileId, upReq.dfi, err)
 				continue
 			}
+			crntFileId = fileId
 		}
 		if upReq.dfi.dirtyMetadata {
 			if crntFileId == "" {
 				// create an empty file
 				check(upReq.dfi.FileSize == 0)
-				crntFileId, err = sybx.updateFileData(client, upReq)
+				fileId, err := sybx.updateFileData(client, upReq)
 				if err != nil {
 					sybx.log("Error when creating a metadata-only file %s",
 						err.Error())
+					sybx.journalFailure(fileId, upReq.dfi, err)
 					continue
 				}
+				crntFileId = fileId
 			}
 			// file exists, figure out what needs to be
 			// updated
 			dfi := upReq.dfi
 			dfi.Id = crntFileId
-			sybx.updateFileAttributes(client, dfi)
+			if err := sybx.updateFileAttributes(client, dfi); err != nil {
+				sybx.log("Error in update-metadata of %s: %s", crntFileId, err.Error())
+				sybx.journalFailure(crntFileId, upReq.dfi, err)
+			}
 		}
 	}
 }
 
+// Record a file that could not be synchronized in the upload journal, so
+// that the status command shows it. The file is known by its new file-id,
+// or by the old one, if the new file could not be created. A file that was
+// never created on the platform has nothing to track, it is only logged.
+func (sybx *SyncDbDx) journalFailure(fileId string, dfi DirtyFileInfo, err error) {
+	if fileId == "" {
+		fileId = dfi.Id
+	}
+	if fileId == "" {
+		return
+	}
+	sybx.mutex.Lock()
+	defer sybx.mutex.Unlock()
+	oph := sybx.mdb.opOpen()
+	defer sybx.mdb.opClose(oph)
+	sybx.mdb.JournalSyncFailed(oph, fileId, dfi.ProjId, filepath.Join(dfi.Directory, dfi.Name), err)
+}
+
 // enqueue a request to upload the file. This will happen in the background. Since
 // we don't erase the local file, there is no rush.
 func (sybx *SyncDbDx) enqueueUpdateFileReq(dfi DirtyFileInfo) error {
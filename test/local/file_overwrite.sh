@@ -83,6 +83,86 @@ function check_overwrite_fails {
     cat $write_dir/A.txt
 }
 
+# writing through a descriptor opened for reading and writing does not
+# replace the file
+function check_rdwr_keeps_file {
+    local top_dir=$1
+    local target_dir=$2
+    local write_dir=$top_dir/$target_dir
+
+    local before=$(cat $write_dir/A.txt)
+    set +e
+    printf "X" 1<> $write_dir/A.txt
+    rc=$?
+    set -e
+    if [[ $rc == 0 ]]; then
+        echo "Error, writing a closed file opened for reading and writing should fail"
+        exit 1
+    fi
+    local after=$(cat $write_dir/A.txt)
+    if [[ "$before" != "$after" ]]; then
+        echo "Error, the file changed after a failed write"
+        echo "found: $after"
+        exit 1
+    fi
+}
+
+# rewriting a file replaces it with a new version on the platform
+function check_rewrite {
+    local top_dir=$1
+    local target_dir=$2
+    local write_dir=$top_dir/$target_dir
+
+    echo $line2 > $write_dir/A.txt
+
+    dx wait $projName:/$target_dir/A.txt
+    local content=$(dx cat $projName:/$target_dir/A.txt)
+    if [[ "$content" != "$line2" ]]; then
+        echo "bad content after rewrite"
+        echo "should be: $line2"
+        echo "found: $content"
+        exit 1
+    fi
+
+    # the old version should have been removed
+    local num_versions=$(dx ls $projName:/$target_dir/A.txt | wc -l)
+    if [[ $num_versions != 1 ]]; then
+        echo "Error, found $num_versions versions of A.txt after rewrite"
+        exit 1
+    fi
+}
+
+# while a file is rewritten, readers see the old version
+function check_rewrite_atomic {
+    local top_dir=$1
+    local target_dir=$2
+    local write_dir=$top_dir/$target_dir
+
+    # start rewriting, and keep the file open
+    exec 3> $write_dir/A.txt
+    local content=$(cat $write_dir/A.txt)
+    if [[ "$content" != "$line2" ]]; then
+        echo "Error, the old version is not shown while the file is rewritten"
+        echo "found: $content"
+        exit 1
+    fi
+    local num_versions=$(dx ls $projName:/$target_dir/A.txt | wc -l)
+    if [[ $num_versions != 1 ]]; then
+        echo "Error, found $num_versions versions of A.txt while it is rewritten"
+        exit 1
+    fi
+
+    echo $line1 >&3
+    exec 3>&-
+
+    content=$(cat $write_dir/A.txt)
+    if [[ "$content" != "$line1" ]]; then
+        echo "Error, the new version is not shown after the rewrite"
+        echo "found: $content"
+        exit 1
+    fi
+}
+
 function file_overwrite {
     # Get all the DX environment variables, so that dxfuse can use them
     echo "loading the dx environment"
@@ -123,8 +203,17 @@ function file_overwrite {
     # now we are ready for an overwrite experiment
     $dxfuse $flags $mountpoint dxfuse_test_data
 
-    echo "Rewriting a file is not allowed"
+    echo "Appending to a file is not allowed"
     check_overwrite_fails $mountpoint/$projName $base_dir
 
+    echo "Rewriting a file replaces it"
+    check_rewrite $mountpoint/$projName $base_dir
+
+    echo "Writes through a read-write descriptor do not replace the file"
+    check_rdwr_keeps_file $mountpoint/$projName $base_dir
+
+    echo "Readers see the old version until a rewrite is closed"
+    check_rewrite_atomic $mountpoint/$projName $base_dir
+
     teardown
 }
@@ -9,6 +9,10 @@ mountpoint=${baseDir}/MNT
 
 # Directories created during the test
 writeable_dirs=()
+
+# A second project, for moves and copies between projects
+xprojName=""
+xprojId=""
 ######################################################################
 
 teardown_complete=0
@@ -31,6 +35,9 @@ function teardown {
     for d in ${writeable_dirs[@]}; do
         dx rm -r $projName:/$d >& /dev/null || true
     done
+    if [[ $xprojId != "" ]]; then
+        dx rmproject -y $xprojId >& /dev/null || true
+    fi
 }
 
 # trap any errors and cleanup
@@ -179,13 +186,23 @@ function file_create_existing {
 
     echo "happy days" > hello.txt
 
+    # rewriting an existing file replaces it with a new version
+    echo "nothing much" > hello.txt
+    local content=$(cat hello.txt)
+    if [[ "$content" != "nothing much" ]]; then
+        echo "Error, rewriting hello.txt did not replace its content"
+        echo "found: $content"
+        exit 1
+    fi
+
+    # appending to an existing file is not allowed
     set +e
-    (echo "nothing much" > hello.txt) >& /tmp/cmd_results.txt
+    (echo "more" >> hello.txt) >& /tmp/cmd_results.txt
     rc=$?
     set -e
 
     if [[ $rc == 0 ]]; then
-        echo "Error, could modify an existing file"
+        echo "Error, could append to an existing file"
         exit 1
     fi
     result=$(cat /tmp/cmd_results.txt)
@@ -255,6 +272,173 @@ function move_file2 {
     rm -rf B
 }
 
+# rename over an existing file replaces it
+function move_file_over_existing {
+    local write_dir=$1
+    cd $write_dir
+
+    rm -f XX.txt YY.txt
+    echo "the jaberwoky is on the loose" > XX.txt
+    echo "the cheshire cat" > YY.txt
+    mv XX.txt YY.txt
+
+    if [[ -f XX.txt ]]; then
+        echo "Error, source still exists after rename over an existing file"
+        exit 1
+    fi
+    local content=$(cat YY.txt)
+    if [[ "$content" != "the jaberwoky is on the loose" ]]; then
+        echo "Error, rename did not replace the target"
+        echo "found: $content"
+        exit 1
+    fi
+    rm -f YY.txt
+}
+
+# if the target cannot be removed, the rename is undone
+function move_file_over_existing_fails {
+    local write_dir=$1
+    local dx_dir=$2
+    cd $write_dir
+
+    rm -f XX.txt YY.txt
+    echo "the jaberwoky is on the loose" > XX.txt
+    echo "the cheshire cat" > YY.txt
+    dx wait $projName:/$dx_dir/XX.txt $projName:/$dx_dir/YY.txt
+
+    # remove the target behind the back of dxfuse
+    dx rm $projName:/$dx_dir/YY.txt
+
+    if mv XX.txt YY.txt >& /tmp/cmd_results.txt; then
+        echo "Error, rename succeeded although the target could not be removed"
+        exit 1
+    fi
+    local names=$(dx ls $projName:/$dx_dir/ | grep -c "^XX.txt$" || true)
+    if [[ $names != 1 ]]; then
+        echo "Error, the source was not renamed back on the platform"
+        dx ls $projName:/$dx_dir/
+        exit 1
+    fi
+    local content=$(cat XX.txt)
+    if [[ "$content" != "the jaberwoky is on the loose" ]]; then
+        echo "Error, the source was lost in a failed rename"
+        echo "found: $content"
+        exit 1
+    fi
+    rm -f XX.txt
+    rm -f YY.txt >& /dev/null || true
+}
+
+function hard_link {
+    local write_dir=$1
+    cd $write_dir
+
+    rm -f XX.txt YY.txt
+    echo "the walrus and the carpenter" > XX.txt
+    ln XX.txt YY.txt
+
+    local nlink=$(stat -c %h XX.txt)
+    if [[ $nlink != 2 ]]; then
+        echo "Error, expected a link count of 2, found $nlink"
+        exit 1
+    fi
+    local content=$(cat YY.txt)
+    if [[ "$content" != "the walrus and the carpenter" ]]; then
+        echo "Error, hard link does not have the content of the file"
+        echo "found: $content"
+        exit 1
+    fi
+
+    # removing the first name keeps the file
+    rm -f XX.txt
+    content=$(cat YY.txt)
+    if [[ "$content" != "the walrus and the carpenter" ]]; then
+        echo "Error, file lost when one of its names was removed"
+        exit 1
+    fi
+    nlink=$(stat -c %h YY.txt)
+    if [[ $nlink != 1 ]]; then
+        echo "Error, expected a link count of 1, found $nlink"
+        exit 1
+    fi
+    rm -f YY.txt
+}
+
+function symbolic_link {
+    local write_dir=$1
+    cd $write_dir
+
+    rm -f XX.txt YY.txt
+    echo "the owl and the pussycat" > XX.txt
+    ln -s XX.txt YY.txt
+
+    if [[ ! -L YY.txt ]]; then
+        echo "Error, YY.txt is not a symbolic link"
+        exit 1
+    fi
+    local target=$(readlink YY.txt)
+    if [[ "$target" != "XX.txt" ]]; then
+        echo "Error, symbolic link points to $target instead of XX.txt"
+        exit 1
+    fi
+    local content=$(cat YY.txt)
+    if [[ "$content" != "the owl and the pussycat" ]]; then
+        echo "Error, reading through the symbolic link returned ($content)"
+        exit 1
+    fi
+    rm -f XX.txt YY.txt
+}
+
+# move files and folders to a different project, and copy them back
+function cross_project_move_copy {
+    local write_dir=$1
+    local dx_dir=$2
+    local other_dir=$3
+    cd $write_dir
+
+    rm -rf XX.txt A
+    echo "the owl and the pussycat" > XX.txt
+    mkdir A
+    echo "Monroe doctrine" > A/X.txt
+    echo "Ted Rosevelt" > A/Y.txt
+    dx wait $projName:/$dx_dir/XX.txt $projName:/$dx_dir/A/X.txt $projName:/$dx_dir/A/Y.txt
+
+    mv XX.txt $other_dir/XX.txt
+    if [[ -f XX.txt ]]; then
+        echo "Error, source still exists after a move to a different project"
+        exit 1
+    fi
+    if dx describe $projName:/$dx_dir/XX.txt >& /dev/null; then
+        echo "Error, the file was not removed from the source project"
+        exit 1
+    fi
+    dx describe $xprojId:/XX.txt > /dev/null
+    local content=$(cat $other_dir/XX.txt)
+    if [[ "$content" != "the owl and the pussycat" ]]; then
+        echo "Error, a file moved to a different project has the wrong content"
+        echo "found: $content"
+        exit 1
+    fi
+
+    mv A $other_dir/
+    if [[ -d A ]]; then
+        echo "Error, source directory still exists after a move to a different project"
+        exit 1
+    fi
+    dx describe $xprojId:/A/X.txt > /dev/null
+    dx describe $xprojId:/A/Y.txt > /dev/null
+
+    # copy back, the copies in the other project stay
+    $dxfuse cp $other_dir/XX.txt $write_dir/
+    $dxfuse cp $other_dir/A $write_dir/A
+    diff XX.txt $other_dir/XX.txt
+    diff -r A $other_dir/A
+    dx describe $projName:/$dx_dir/XX.txt > /dev/null
+    dx describe $projName:/$dx_dir/A/X.txt > /dev/null
+
+    rm -rf XX.txt A $other_dir/XX.txt $other_dir/A
+}
+
 function rename_dir {
     local write_dir=$1
     cd $write_dir
@@ -312,6 +496,26 @@ function move_dir_deep {
     tree D > /tmp/results_$expNum.txt
 }
 
+# Commit a task directory the way Spark does: move it out of a
+# deep temporary directory, with a new name, onto an empty directory.
+function commit_dir {
+    local write_dir=$1
+    local expNum=$2
+    cd $write_dir
+
+    rm -rf out
+    mkdir -p out/_temporary/0/task_01/sub
+    echo "alpha" > out/_temporary/0/task_01/part-00000
+    echo "beta" > out/_temporary/0/task_01/part-00001
+    echo "gamma" > out/_temporary/0/task_01/sub/part-00002
+    mkdir out/result
+
+    mv -T out/_temporary/0/task_01 out/result
+    rm -rf out/_temporary
+
+    tree out > /tmp/results_$expNum.txt
+}
+
 function move_non_existent_dir {
     local write_dir=$1
     cd $write_dir
@@ -406,13 +610,16 @@ function fs_test_cases {
     dx mkdir $projName:/$base_dir
     dx mkdir $projName:/$expr_dir
 
+    xprojName="xproj_$base_dir"
+    xprojId=$(dx new project --brief $xprojName)
+
     # Start the dxfuse daemon in the background, and wait for it to initilize.
     echo "Mounting dxfuse"
     flags="-limitedWrite"
     if [[ $verbose != "" ]]; then
         flags="$flags -verbose 2"
     fi
-    $dxfuse $flags $mountpoint dxfuse_test_data dxfuse_test_read_only ArchivedStuff
+    $dxfuse $flags $mountpoint dxfuse_test_data dxfuse_test_read_only ArchivedStuff $xprojId
     sleep 1
 
     echo "can't write to read-only project"
@@ -443,6 +650,19 @@ function fs_test_cases {
     echo "move file II"
     move_file2 $mountpoint/$projName/$expr_dir
 
+    echo "move file over an existing file"
+    move_file_over_existing $mountpoint/$projName/$expr_dir
+    move_file_over_existing_fails $mountpoint/$projName/$expr_dir $expr_dir
+
+    echo "hard links"
+    hard_link $mountpoint/$projName/$expr_dir
+
+    echo "symbolic links"
+    symbolic_link $mountpoint/$projName/$expr_dir
+
+    echo "move and copy between projects"
+    cross_project_move_copy $mountpoint/$projName/$expr_dir $expr_dir $mountpoint/$xprojName
+
     echo "rename directory"
     rename_dir $mountpoint/$projName/$expr_dir
     rename_dir /tmp
@@ -462,6 +682,16 @@ function fs_test_cases {
     rm -rf $mountpoint/$projName/$expr_dir/D
     rm -rf /tmp/D
 
+    echo "commit a directory over an empty directory"
+    commit_dir $mountpoint/$projName/$expr_dir 3
+    commit_dir /tmp 4
+    cd $HOME
+
+    diff /tmp/results_3.txt /tmp/results_4.txt
+    diff -r $mountpoint/$projName/$expr_dir/out /tmp/out
+    rm -rf $mountpoint/$projName/$expr_dir/out
+    rm -rf /tmp/out
+
     echo "checking illegal directory moves"
     move_non_existent_dir "$mountpoint/$projName"
     move_dir_to_file "$mountpoint/$projName"
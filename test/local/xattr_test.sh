@@ -172,6 +172,89 @@ function check_new {
     fi
 }
 
+# New files get the defaults of the directories above them
+function check_dir_defaults {
+    set -x
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+    local dnaxF=$projName:/$base_dir/sub/Rivers.txt
+
+    mkdir $test_dir/sub
+    xattr -w default.tag.water X $test_dir
+    xattr -w default.prop.family geography $test_dir
+    xattr -w default.prop.family hydrology $test_dir/sub
+
+    local dir_attrs=$(xattr $test_dir | sort | tr '\n' ' ')
+    local dir_expected="default.prop.family default.tag.water "
+    if [[ $dir_attrs != $dir_expected ]]; then
+        echo "$test_dir attributes are incorrect"
+        echo "   got:       $dir_attrs"
+        echo "   expecting: $dir_expected"
+        exit 1
+    fi
+
+    echo "Nile Amazon" > $test_dir/sub/Rivers.txt
+
+    local props=$(dx describe $dnaxF --json | jq -cMS .properties)
+    local props_expected='{"family":"hydrology"}'
+    if [[ $props != $props_expected ]]; then
+        echo "$dnaxF properties mismatch"
+        echo "   got:        $props"
+        echo "   expecting:  $props_expected"
+        exit 1
+    fi
+
+    local tags=$(dx describe $dnaxF --json | jq -cMS .tags)
+    local tags_expected='["water"]'
+    if [[ $tags != $tags_expected ]]; then
+        echo "$dnaxF tags mismatch"
+        echo "   got:        $tags"
+        echo "   expecting:  $tags_expected"
+        exit 1
+    fi
+
+    xattr -d default.tag.water $test_dir
+    xattr -d default.prop.family $test_dir
+}
+# Tags and properties set while a file is written are applied when it is closed
+function check_while_writing {
+    set -x
+    local base_dir=$1
+    local test_dir=$mountpoint/$projName/$base_dir
+    local f=$test_dir/Lakes.txt
+    local dnaxF=$projName:/$base_dir/Lakes.txt
+
+    exec 3> $f
+    echo "Victoria Baikal" >&3
+    xattr -w tag.water X $f
+    xattr -w prop.family limnology $f
+
+    local family=$(xattr -p prop.family $f)
+    if [[ $family != "limnology" ]]; then
+        echo "$f family property is wrong while writing"
+        echo "   got:       $family"
+        exit 1
+    fi
+    exec 3>&-
+
+    local props=$(dx describe $dnaxF --json | jq -cMS .properties)
+    local props_expected='{"family":"limnology"}'
+    if [[ $props != $props_expected ]]; then
+        echo "$dnaxF properties mismatch"
+        echo "   got:        $props"
+        echo "   expecting:  $props_expected"
+        exit 1
+    fi
+
+    local tags=$(dx describe $dnaxF --json | jq -cMS .tags)
+    local tags_expected='["water"]'
+    if [[ $tags != $tags_expected ]]; then
+        echo "$dnaxF tags mismatch"
+        echo "   got:        $tags"
+        echo "   expecting:  $tags_expected"
+        exit 1
+    fi
+}
 
 function xattr_test {
     # Get all the DX environment variables, so that dxfuse can use them
@@ -211,6 +294,8 @@ function xattr_test {
     check_bat $base_dir
     check_whale $base_dir
     check_new $base_dir
+    check_dir_defaults $base_dir
+    check_while_writing $base_dir
 
     teardown
 }
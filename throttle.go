@@ -0,0 +1,193 @@
+package dxfuse
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest bandwidth limit that can be set, in MiB per second. Larger
+// values are as good as no limit, and could overflow when converted to bytes.
+const MaxBandwidthMiB = 1024 * 1024
+
+// Limits the number of concurrent transfers in one direction, and their
+// bandwidth. Bandwidth is controlled with a token bucket, holding up to one
+// second worth of bytes. A transfer takes all the bytes it needs before it
+// starts. If the bucket does not have enough, it goes into debt, and later
+// transfers wait until the debt is repaid. Parts and prefetch IOs are
+// megabytes long, so the rate is kept over a few seconds, not per packet.
+//
+// Zero means no limit, for both the concurrency and the bandwidth. The
+// limits may be changed while transfers are in progress.
+type Throttle struct {
+	name string
+
+	mutex         sync.Mutex
+	cond          *sync.Cond // signaled when a transfer completes, or the limits change
+	maxConcurrent int
+	active        int
+	bytesPerSec   int64
+	tokens        float64
+	lastRefill    time.Time
+}
+
+func NewThrottle(name string, maxConcurrent int, bytesPerSec int64) *Throttle {
+	t := &Throttle{
+		name:          name,
+		maxConcurrent: maxConcurrent,
+		bytesPerSec:   bytesPerSec,
+		tokens:        float64(bytesPerSec),
+		lastRefill:    time.Now(),
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+// add the tokens accumulated since the last refill
+//
+// Note: the lock must be held
+func (t *Throttle) refill(now time.Time) {
+	if t.bytesPerSec > 0 {
+		t.tokens += now.Sub(t.lastRefill).Seconds() * float64(t.bytesPerSec)
+		if t.tokens > float64(t.bytesPerSec) {
+			t.tokens = float64(t.bytesPerSec)
+		}
+	}
+	t.lastRefill = now
+}
+
+// Wait for a free slot, and for bandwidth to transfer [size] bytes. Every
+// call must be followed by a call to Done.
+func (t *Throttle) Start(size int64) {
+	t.mutex.Lock()
+	for t.maxConcurrent > 0 && t.active >= t.maxConcurrent {
+		t.cond.Wait()
+	}
+	t.active++
+
+	for t.bytesPerSec > 0 {
+		t.refill(time.Now())
+		if t.tokens >= 0 {
+			t.tokens -= float64(size)
+			break
+		}
+		// wait until the debt is repaid, or the limits change
+		delay := time.Duration(-t.tokens / float64(t.bytesPerSec) * float64(time.Second))
+		timer := time.AfterFunc(delay, func() {
+			t.mutex.Lock()
+			t.cond.Broadcast()
+			t.mutex.Unlock()
+		})
+		t.cond.Wait()
+		timer.Stop()
+	}
+	t.mutex.Unlock()
+}
+
+// A transfer has completed
+func (t *Throttle) Done() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active--
+	t.cond.Broadcast()
+}
+
+// Change the limits. Transfers already in progress are not affected.
+func (t *Throttle) Set(maxConcurrent int, bytesPerSec int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.refill(time.Now())
+	if bytesPerSec != t.bytesPerSec {
+		// start over with a full bucket
+		t.tokens = float64(bytesPerSec)
+	}
+	t.maxConcurrent = maxConcurrent
+	t.bytesPerSec = bytesPerSec
+	t.cond.Broadcast()
+}
+
+func (t *Throttle) Limits() (int, int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.maxConcurrent, t.bytesPerSec
+}
+
+// A description of the limits, for the user
+func (t *Throttle) String() string {
+	maxConcurrent, bytesPerSec := t.Limits()
+	concurrency := "unlimited"
+	if maxConcurrent > 0 {
+		concurrency = fmt.Sprintf("%d", maxConcurrent)
+	}
+	bandwidth := "unlimited"
+	if bytesPerSec > 0 {
+		bandwidth = fmt.Sprintf("%d MiB/s", bytesPerSec/MiB)
+	}
+	return fmt.Sprintf("%s concurrency %s, bandwidth %s", t.name, concurrency, bandwidth)
+}
+
+// Show the transfer limits, or change one of them. Concurrency is a
+// number of transfers, bandwidth is in MiB per second, up to
+// MaxBandwidthMiB. Zero means the default for concurrency, and no limit
+// for bandwidth.
+func (fsys *Filesys) CmdSet(args []string) (string, error) {
+	var throttles []*Throttle
+	if fsys.uploader != nil {
+		throttles = append(throttles, fsys.uploader.throttle)
+	}
+	throttles = append(throttles, fsys.pgs.throttle)
+	if len(args) == 0 {
+		var lines []string
+		for _, t := range throttles {
+			lines = append(lines, t.String())
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	if len(args) != 2 {
+		return "", errors.New("set takes a limit and a value")
+	}
+	value, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || value < 0 {
+		return "", fmt.Errorf("invalid value %s, expected a non-negative number", args[1])
+	}
+
+	var t *Throttle
+	switch args[0] {
+	case "uploadConcurrency", "uploadBandwidth":
+		if fsys.uploader == nil {
+			return "", errors.New("the filesystem is mounted read-only")
+		}
+		t = fsys.uploader.throttle
+	case "downloadConcurrency", "downloadBandwidth":
+		t = fsys.pgs.throttle
+	default:
+		return "", fmt.Errorf("unknown limit %s", args[0])
+	}
+	maxConcurrent, bytesPerSec := t.Limits()
+	switch args[0] {
+	case "uploadConcurrency":
+		if value > MaxUploadConcurrency {
+			return "", fmt.Errorf("upload concurrency is at most %d", MaxUploadConcurrency)
+		}
+		if value == 0 {
+			value = defaultUploadConcurrency
+		}
+		maxConcurrent = int(value)
+	case "downloadConcurrency":
+		if value > maxNumPrefetchThreads {
+			return "", fmt.Errorf("download concurrency is at most %d", maxNumPrefetchThreads)
+		}
+		maxConcurrent = int(value)
+	default:
+		if value > MaxBandwidthMiB {
+			return "", fmt.Errorf("bandwidth is at most %d MiB/s", MaxBandwidthMiB)
+		}
+		bytesPerSec = value * MiB
+	}
+	t.Set(maxConcurrent, bytesPerSec)
+	fsys.log("Transfer limits changed: %s", t.String())
+	return t.String(), nil
+}
@@ -0,0 +1,469 @@
+package dxfuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnanexus/dxda"
+)
+
+// With the -trash flag, removed files and folders are not deleted. They
+// are moved into the trash folder of their project, where they can be
+// restored from, or purged after a retention period.
+//
+// Each removal goes into a batch folder, named by the time of removal. The
+// batch keeps the original folder structure. For example, removing
+// /results/part-0001.txt places it in:
+//
+//    /.dxfuse_trash/20201019-150405/results/part-0001.txt
+//
+const (
+	TrashFolder        = "/.dxfuse_trash"
+	TrashRetentionDays = 7
+
+	trashBatchFormat = "20060102-150405"
+)
+
+// An object in the trash
+type TrashEntry struct {
+	Batch  string // batch folder name
+	Folder string // the original folder
+	Name   string
+	Id     string
+}
+
+// The folder in the trash, where objects removed now from a project folder
+// are placed.
+func trashFolderFor(folder string, now time.Time) string {
+	return filepath.Join(TrashFolder, now.UTC().Format(trashBatchFormat), folder)
+}
+
+// Move data objects in a project folder to the trash
+func (fsys *Filesys) trashObjects(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	folder string,
+	objIds []string) error {
+	trashDir := trashFolderFor(folder, time.Now())
+	if err := fsys.ops.DxFolderNew(ctx, httpClient, projId, trashDir); err != nil {
+		return err
+	}
+	if err := fsys.ops.DxMove(ctx, httpClient, projId, objIds, nil, trashDir); err != nil {
+		return err
+	}
+	if fsys.options.Verbose {
+		fsys.log("Moved %v to the trash %s:%s", objIds, projId, trashDir)
+	}
+	return nil
+}
+
+// Move a project folder, with all its contents, to the trash
+func (fsys *Filesys) trashFolder(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	folder string) error {
+	trashDir := trashFolderFor(filepath.Dir(folder), time.Now())
+	if err := fsys.ops.DxFolderNew(ctx, httpClient, projId, trashDir); err != nil {
+		return err
+	}
+	if err := fsys.ops.DxMove(ctx, httpClient, projId, nil, []string{folder}, trashDir); err != nil {
+		return err
+	}
+	if fsys.options.Verbose {
+		fsys.log("Moved folder %s to the trash %s:%s", folder, projId, trashDir)
+	}
+	return nil
+}
+
+// Remove data objects from a project folder. With the -trash flag, they are
+// moved to the trash instead.
+func (fsys *Filesys) removeObjects(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	folder string,
+	objIds []string) error {
+	if fsys.options.Trash {
+		return fsys.trashObjects(ctx, httpClient, projId, folder, objIds)
+	}
+	return fsys.ops.DxRemoveObjects(ctx, httpClient, projId, objIds)
+}
+
+// Remove a single data object, wherever it is located. With the -trash flag,
+// it is described, to find the folder it is moved from.
+func (fsys *Filesys) removeObject(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	objId string) error {
+	folder := ""
+	if fsys.options.Trash {
+		oDesc, err := DxDescribe(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, objId)
+		if err != nil {
+			return err
+		}
+		folder = oDesc.Folder
+	}
+	return fsys.removeObjects(ctx, httpClient, projId, folder, []string{objId})
+}
+
+// The project folder a file is located in. Files in faux directories
+// are located in the parent folder, but we ask the platform to be sure.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) platformFolder(ctx context.Context, oph *OpHandle, dir Dir, file File) (string, error) {
+	if !dir.faux {
+		return dir.ProjFolder, nil
+	}
+	oDesc, err := DxDescribe(ctx, oph.httpClient, &fsys.dxEnv, fsys.ops.retry, file.ProjId, file.Id)
+	if err != nil {
+		return "", err
+	}
+	return oDesc.Folder, nil
+}
+
+// Recursively describe the contents of a folder. Returns the folders, in
+// sorted order, and the objects in each folder.
+func (fsys *Filesys) describeTree(
+	ctx context.Context,
+	httpClient *http.Client,
+	projId string,
+	folder string) ([]string, map[string][]DxDescribeDataObject, error) {
+	var folders []string
+	objects := make(map[string][]DxDescribeDataObject)
+
+	pending := []string{folder}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+
+		dxDir, err := DxDescribeFolder(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, current)
+		if err != nil {
+			return nil, nil, err
+		}
+		folders = append(folders, current)
+		for _, oDesc := range dxDir.dataObjects {
+			objects[current] = append(objects[current], oDesc)
+		}
+		pending = append(pending, dxDir.subdirs...)
+	}
+	sort.Strings(folders)
+	return folders, objects, nil
+}
+
+// Find the project of a path in the filesystem
+//
+// Note: the global lock must be held
+func (fsys *Filesys) projectOfPath(ctx context.Context, oph *OpHandle, path string) (string, error) {
+	node, ok, err := fsys.lookupPath(ctx, oph, path)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%s does not exist", path)
+	}
+	projId := ""
+	switch node.(type) {
+	case Dir:
+		projId = node.(Dir).ProjId
+	case File:
+		projId = node.(File).ProjId
+	}
+	if projId == "" {
+		return "", fmt.Errorf("%s is not inside a project", path)
+	}
+	return projId, nil
+}
+
+func isNotFound(err error) bool {
+	dxErr, ok := err.(*dxda.DxError)
+	return ok && dxErr.EType == "ResourceNotFound"
+}
+
+// List the trash of a project
+func (fsys *Filesys) TrashList(ctx context.Context, httpClient *http.Client, projId string) ([]TrashEntry, error) {
+	folders, objects, err := fsys.describeTree(ctx, httpClient, projId, TrashFolder)
+	if err != nil {
+		if isNotFound(err) {
+			// the project has no trash
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, folder := range folders {
+		batch, origFolder := splitTrashPath(folder)
+		for _, oDesc := range objects[folder] {
+			entries = append(entries, TrashEntry{
+				Batch:  batch,
+				Folder: origFolder,
+				Name:   oDesc.Name,
+				Id:     oDesc.Id,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// Split a folder in the trash into the batch name, and the original folder.
+//   /.dxfuse_trash/20201019-150405/results  ->  20201019-150405, /results
+func splitTrashPath(folder string) (string, string) {
+	rel := strings.TrimPrefix(folder, TrashFolder+"/")
+	if rel == folder {
+		// this is the trash folder itself
+		return "", ""
+	}
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], "/"
+	}
+	return parts[0], "/" + parts[1]
+}
+
+// Move the contents of a trash batch back to their original folders. Objects
+// restored into directories that have already been read by the filesystem are
+// added to them.
+func (fsys *Filesys) TrashRestore(ctx context.Context, httpClient *http.Client, projId string, batch string) (int, error) {
+	if _, err := time.Parse(trashBatchFormat, batch); err != nil {
+		return 0, fmt.Errorf("%s is not a trash batch", batch)
+	}
+	batchFolder := filepath.Join(TrashFolder, batch)
+	folders, objects, err := fsys.describeTree(ctx, httpClient, projId, batchFolder)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, fmt.Errorf("there is no batch %s in the trash", batch)
+		}
+		return 0, err
+	}
+
+	numRestored := 0
+	var restoredFolders []string
+	restoredObjects := make(map[string][]DxDescribeDataObject)
+	for _, folder := range folders {
+		_, origFolder := splitTrashPath(folder)
+		if origFolder != "/" {
+			if err := fsys.ops.DxFolderNew(ctx, httpClient, projId, origFolder); err != nil {
+				return numRestored, err
+			}
+		}
+		restoredFolders = append(restoredFolders, origFolder)
+
+		var objIds []string
+		for _, oDesc := range objects[folder] {
+			objIds = append(objIds, oDesc.Id)
+		}
+		if len(objIds) == 0 {
+			continue
+		}
+		if err := fsys.ops.DxMove(ctx, httpClient, projId, objIds, nil, origFolder); err != nil {
+			return numRestored, err
+		}
+		numRestored += len(objIds)
+		restoredObjects[origFolder] = objects[folder]
+	}
+
+	// the batch is now empty
+	if err := fsys.ops.DxFolderRemove(ctx, httpClient, projId, batchFolder, true); err != nil {
+		fsys.log("Error removing restored trash batch %s:%s: %s", projId, batchFolder, err.Error())
+	}
+	fsys.log("Restored %d objects from trash batch %s:%s", numRestored, projId, batchFolder)
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+	oph := fsys.opOpenNoHttpClient()
+	defer fsys.opClose(oph)
+	if err := fsys.attachRestored(ctx, oph, projId, restoredFolders, restoredObjects); err != nil {
+		return numRestored, err
+	}
+	return numRestored, nil
+}
+
+// Add restored folders and objects to the directories that have already
+// been read from the platform. Directories that have not been read will
+// find them when they are.
+//
+// Note: the global lock must be held
+func (fsys *Filesys) attachRestored(
+	ctx context.Context,
+	oph *OpHandle,
+	projId string,
+	folders []string,
+	objects map[string][]DxDescribeDataObject) error {
+	nowSeconds := time.Now().Unix()
+
+	// folders are sorted, parents are handled before their children
+	for _, folder := range folders {
+		if folder == "/" {
+			continue
+		}
+		dirs, err := fsys.mdb.LookupDirsByProjFolder(ctx, oph, projId, folder)
+		if err != nil {
+			return err
+		}
+		if len(dirs) > 0 {
+			continue
+		}
+		parents, err := fsys.mdb.LookupDirsByProjFolder(ctx, oph, projId, filepath.Dir(folder))
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			if !parent.Populated {
+				continue
+			}
+			_, err := fsys.mdb.CreateDir(oph, projId, folder, nowSeconds, nowSeconds,
+				dirReadWriteMode, filepath.Join(parent.FullPath, filepath.Base(folder)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for folder, oDescs := range objects {
+		dirs, err := fsys.mdb.LookupDirsByProjFolder(ctx, oph, projId, folder)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			if !dir.Populated {
+				continue
+			}
+			for _, oDesc := range oDescs {
+				_, exists, err := fsys.mdb.LookupInDir(ctx, oph, &dir, oDesc.Name)
+				if err != nil {
+					return err
+				}
+				if exists {
+					fsys.log("%s/%s already exists, restored object %s will appear after a remount",
+						dir.FullPath, oDesc.Name, oDesc.Id)
+					continue
+				}
+				if _, err := fsys.mdb.AddDataObject(oph, &dir, oDesc.Name, oDesc); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Permanently remove trash batches older than the retention period
+func (fsys *Filesys) TrashPurge(ctx context.Context, httpClient *http.Client, projId string, days int) ([]string, error) {
+	dxDir, err := DxDescribeFolder(ctx, httpClient, &fsys.dxEnv, fsys.ops.retry, projId, TrashFolder)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	var purged []string
+	for _, batchFolder := range dxDir.subdirs {
+		batch := filepath.Base(batchFolder)
+		batchTime, err := time.Parse(trashBatchFormat, batch)
+		if err != nil {
+			fsys.log("Skipping unknown folder %s in the trash of %s", batchFolder, projId)
+			continue
+		}
+		if batchTime.After(cutoff) {
+			continue
+		}
+		if err := fsys.ops.DxFolderRemove(ctx, httpClient, projId, batchFolder, true); err != nil {
+			return purged, err
+		}
+		purged = append(purged, batch)
+	}
+	if len(purged) > 0 {
+		fsys.log("Purged trash batches %v from project %s", purged, projId)
+	}
+	return purged, nil
+}
+
+// Execute a trash command. The path is any file or directory in the
+// mounted project.
+func (fsys *Filesys) CmdTrash(ctx context.Context, verb string, path string, args []string) (string, error) {
+	if fsys.remover != nil {
+		// the trash should include everything removed so far
+		if err := fsys.remover.Flush(); err != nil {
+			return "", err
+		}
+	}
+
+	fsys.mutex.Lock()
+	oph := fsys.opOpenNoHttpClient()
+	projId, err := fsys.projectOfPath(ctx, oph, path)
+	fsys.opClose(oph)
+	fsys.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if verb != "list" && !fsys.checkProjectPermissions(projId, PERM_CONTRIBUTE) {
+		return "", fmt.Errorf("insufficient permissions to modify the trash of project %s", projId)
+	}
+
+	httpClient := <-fsys.httpClientPool
+	defer func() {
+		fsys.httpClientPool <- httpClient
+	}()
+
+	switch verb {
+	case "list":
+		if len(args) != 0 {
+			return "", errors.New("trash list takes a single path")
+		}
+		entries, err := fsys.TrashList(ctx, httpClient, projId)
+		if err != nil {
+			return "", err
+		}
+		if len(entries) == 0 {
+			return "The trash is empty", nil
+		}
+		var lines []string
+		for _, e := range entries {
+			lines = append(lines, fmt.Sprintf("%s  %s  %s",
+				e.Batch, filepath.Join(e.Folder, e.Name), e.Id))
+		}
+		return strings.Join(lines, "\n"), nil
+
+	case "restore":
+		if len(args) != 1 {
+			return "", errors.New("trash restore requires a batch name")
+		}
+		numRestored, err := fsys.TrashRestore(ctx, httpClient, projId, args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Restored %d objects", numRestored), nil
+
+	case "purge":
+		days := TrashRetentionDays
+		if len(args) > 1 {
+			return "", errors.New("trash purge takes an optional number of days")
+		}
+		if len(args) == 1 {
+			days, err = strconv.Atoi(args[0])
+			if err != nil || days < 0 {
+				return "", fmt.Errorf("invalid number of days %s", args[0])
+			}
+		}
+		purged, err := fsys.TrashPurge(ctx, httpClient, projId, days)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Purged %d batches older than %d days", len(purged), days), nil
+
+	default:
+		return "", fmt.Errorf("unknown trash command %s, expecting one of {list, restore, purge}", verb)
+	}
+}
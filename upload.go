@@ -2,31 +2,112 @@ package dxfuse
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"math"
-	"runtime"
 	"sync"
 
 	"github.com/dnanexus/dxda"
 )
 
 const (
-	// Upload up to 4 parts concurrently
-	maxUploadRoutines = 4
+	// Upload up to 4 parts concurrently, unless the user asks otherwise
+	defaultUploadConcurrency = 4
+
+	// One upload worker is started for each part that may be uploaded
+	// concurrently, up to this limit.
+	MaxUploadConcurrency = 32
 )
 
-// TODO replace this with a more reasonble buffer pool for managing memory use
-func (uploader *FileUploader) AllocateWriteBuffer(partId int, block bool) []byte {
-	if partId < 1 {
-		partId = 1
+// The size of part [partId] if parts only grow geometrically
+func growthPartSize(partId int) int64 {
+	size := math.Min(InitialUploadPartSize*math.Pow(1.1, float64(partId)), MaxUploadPartSize)
+	return int64(math.Round(size))
+}
+
+// The largest part we upload to a project. A single part may take up to a
+// quarter of the memory budget, leaving room for parts of other files. If
+// the project requires larger parts, it may take up to the entire budget.
+func (uploader *FileUploader) maxPartSize(params FileUploadParameters) int64 {
+	size := MinInt64(MaxUploadPartSize, uploader.pool.Budget()/4)
+	if params.MaximumPartSize > 0 {
+		size = MinInt64(size, params.MaximumPartSize)
+	}
+	if params.MinimumPartSize > size {
+		size = MinInt64(params.MinimumPartSize, uploader.pool.Budget())
 	}
-	// Wait for available buffer
-	if block {
-		uploader.writeBufferChan <- struct{}{}
+	return size
+}
+
+// How many bytes parts [partId] to [numParts] hold, when they grow
+// geometrically up to [maxPartSize].
+func growthCapacity(partId int, numParts int64, maxPartSize int64) int64 {
+	var total int64
+	for k := int64(partId); k <= numParts; k++ {
+		size := growthPartSize(int(k))
+		if size >= maxPartSize {
+			return total + (numParts-k+1)*maxPartSize
+		}
+		total += size
 	}
-	writeBufferCapacity := math.Min(InitialUploadPartSize*math.Pow(1.1, float64(partId)), MaxUploadPartSize)
-	writeBufferCapacity = math.Round(writeBufferCapacity)
-	writeBuffer := make([]byte, 0, int64(writeBufferCapacity))
-	return writeBuffer
+	return total
+}
+
+// The largest file that can be written to a project as a stream. This is the
+// maximal file size of the project, unless the memory budget does not allow
+// parts large enough to reach it. Zero if the budget cannot hold a single
+// part of the minimal size.
+func (uploader *FileUploader) FileSizeLimit(params FileUploadParameters) int64 {
+	if params.MinimumPartSize > uploader.pool.Budget() {
+		return 0
+	}
+	if params.MaximumNumParts <= 0 || params.MaximumFileSize <= 0 {
+		// no limits known for this project
+		return math.MaxInt64
+	}
+	maxPartSize := uploader.maxPartSize(params)
+	if params.MaximumNumParts*maxPartSize >= params.MaximumFileSize {
+		return params.MaximumFileSize
+	}
+	return growthCapacity(1, params.MaximumNumParts, maxPartSize)
+}
+
+// Plan the size of part [partId] of a file written as a stream, after [written]
+// bytes went into the earlier parts. The final size of the file is not known, so
+// parts grow, and small files do not need large buffers. If the remaining parts
+// cannot reach the maximal file size of the project by growing, they are made
+// large enough to do so. A part is never larger than the memory budget allows,
+// files that would need larger parts are limited by FileSizeLimit. Returns false
+// if the project does not allow another part.
+func (uploader *FileUploader) PartSize(params FileUploadParameters, partId int, written int64) (int64, bool) {
+	maxPartSize := uploader.maxPartSize(params)
+	size := MinInt64(growthPartSize(partId), maxPartSize)
+
+	numParts := params.MaximumNumParts
+	if numParts > 0 {
+		if int64(partId) > numParts {
+			return 0, false
+		}
+		remainingParts := numParts - int64(partId) + 1
+		remaining := params.MaximumFileSize - written
+		if remaining > 0 &&
+			remainingParts*maxPartSize >= remaining &&
+			growthCapacity(partId, numParts, maxPartSize) < remaining {
+			size = MaxInt64(size, divideRoundUp(remaining, remainingParts))
+		}
+	}
+	size = MaxInt64(size, params.MinimumPartSize)
+	return MinInt64(size, maxPartSize), true
+}
+
+// Allocate a buffer for a part, with the size planned by PartSize
+func (uploader *FileUploader) AllocateWriteBuffer(size int64) ([]byte, error) {
+	return uploader.pool.Get(int(size))
+}
+
+// Return a buffer that will not be uploaded
+func (uploader *FileUploader) FreeWriteBuffer(buf []byte) {
+	uploader.pool.Put(buf)
 }
 
 type UploadRequest struct {
@@ -41,10 +122,14 @@ type FileUploader struct {
 	uploadQueue       chan UploadRequest
 	wg                sync.WaitGroup
 	numUploadRoutines int
-	// Max concurrent write buffers to reduce memory consumption
-	writeBufferChan chan struct{}
+	// Write buffers, limited by a global memory budget
+	pool *BufferPool
+	// Limits on concurrent uploads, and on their bandwidth
+	throttle *Throttle
 	// API to dx
 	ops *DxOps
+	// uploaded parts are recorded in the upload journal
+	fsys *Filesys
 }
 
 // write a log message, and add a header
@@ -52,21 +137,31 @@ func (uploader *FileUploader) log(a string, args ...interface{}) {
 	LogMsg("uploader", a, args...)
 }
 
-func NewFileUploader(verboseLevel int, options Options, dxEnv dxda.DXEnvironment) *FileUploader {
-	concurrentWriteBufferLimit := 15
-	if runtime.NumCPU()*3 > concurrentWriteBufferLimit {
-		concurrentWriteBufferLimit = runtime.NumCPU() * 3
+func NewFileUploader(verboseLevel int, options Options, dxEnv dxda.DXEnvironment, fsys *Filesys) *FileUploader {
+	budget := options.WriteBufferMemory
+	if budget == 0 {
+		budget = DefaultWriteBufferMemory()
+	}
+	concurrency := options.UploadConcurrency
+	if concurrency == 0 {
+		concurrency = defaultUploadConcurrency
 	}
 	uploader := &FileUploader{
 		verbose:           verboseLevel >= 1,
 		uploadQueue:       make(chan UploadRequest),
-		writeBufferChan:   make(chan struct{}, concurrentWriteBufferLimit),
-		numUploadRoutines: maxUploadRoutines,
-		ops:               NewDxOps(dxEnv, options),
+		pool:              NewBufferPool(budget),
+		throttle:          NewThrottle("upload", concurrency, options.UploadBandwidth),
+		numUploadRoutines: MaxUploadConcurrency,
+		ops:               NewDxOps(dxEnv, options, fsys.ops.retry),
+		fsys:              fsys,
 	}
 
-	uploader.wg.Add(maxUploadRoutines)
-	for i := 0; i < maxUploadRoutines; i++ {
+	uploader.log("write buffer memory budget %d MiB", budget/MiB)
+	uploader.log(uploader.throttle.String())
+
+	// The throttle decides how many of the workers are uploading at a time
+	uploader.wg.Add(uploader.numUploadRoutines)
+	for i := 0; i < uploader.numUploadRoutines; i++ {
 		go uploader.uploadWorker()
 	}
 	return uploader
@@ -75,7 +170,6 @@ func NewFileUploader(verboseLevel int, options Options, dxEnv dxda.DXEnvironment
 func (uploader *FileUploader) Shutdown() {
 	// Close channel and wait for goroutines to complete
 	close(uploader.uploadQueue)
-	close(uploader.writeBufferChan)
 	uploader.wg.Wait()
 }
 
@@ -88,12 +182,26 @@ func (uploader *FileUploader) uploadWorker() {
 			uploader.wg.Done()
 			return
 		}
-		err := uploader.ops.DxFileUploadPart(context.TODO(), httpClient, uploadReq.fileId, uploadReq.partId, uploadReq.writeBuffer)
+		md5Sum := md5.Sum(uploadReq.writeBuffer)
+		part := JournalPart{
+			PartId: uploadReq.partId,
+			Size:   int64(len(uploadReq.writeBuffer)),
+			Md5:    hex.EncodeToString(md5Sum[:]),
+		}
+		uploader.throttle.Start(part.Size)
+		err := uploader.ops.DxFileUploadPartMd5(context.TODO(), httpClient, uploadReq.fileId, part.PartId,
+			uploadReq.writeBuffer, part.Md5)
+		uploader.throttle.Done()
 		if err != nil {
 			// Record upload error in FileHandle
 			uploader.log("Error uploading %s, part %d, %s", uploadReq.fileId, uploadReq.partId, err.Error())
 			uploadReq.fh.writeError = err
+			uploader.fsys.journalUploadFailed(uploadReq.fileId, err)
+		} else {
+			uploader.fsys.journalPart(uploadReq.fileId, part)
+			uploadReq.fh.checksum.addPart(part)
 		}
-		uploadReq.fh.wg.Done()
+		uploader.pool.Put(uploadReq.writeBuffer)
+		uploadReq.fh.partDone()
 	}
 }
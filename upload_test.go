@@ -0,0 +1,77 @@
+package dxfuse
+
+import (
+	"math"
+	"testing"
+)
+
+// Limits of a project in an AWS region
+var awsUploadParams = FileUploadParameters{
+	MinimumPartSize:      5 * MiB,
+	MaximumPartSize:      5 * GiB,
+	EmptyLastPartAllowed: true,
+	MaximumNumParts:      10000,
+	MaximumFileSize:      5 * 1024 * GiB,
+}
+
+func TestPartSizeWithinBudget(t *testing.T) {
+	for _, budget := range []int64{16 * MiB, 256 * MiB, 4 * GiB, 64 * GiB} {
+		uploader := &FileUploader{pool: NewBufferPool(budget)}
+		params := awsUploadParams
+		limit := uploader.FileSizeLimit(params)
+		if limit <= 0 || limit > params.MaximumFileSize {
+			t.Fatalf("budget %d: file size limit %d out of range", budget, limit)
+		}
+
+		var written int64
+		partId := 1
+		for ; written < limit; partId++ {
+			size, ok := uploader.PartSize(params, partId, written)
+			if !ok {
+				t.Fatalf("budget %d: ran out of parts after %d bytes, the limit is %d",
+					budget, written, limit)
+			}
+			if size > budget {
+				t.Fatalf("budget %d: part %d of %d bytes does not fit", budget, partId, size)
+			}
+			if size < params.MinimumPartSize || size > params.MaximumPartSize {
+				t.Fatalf("budget %d: part %d of %d bytes violates the project limits",
+					budget, partId, size)
+			}
+			written += size
+		}
+		if int64(partId-1) > params.MaximumNumParts {
+			t.Errorf("budget %d: used %d parts", budget, partId-1)
+		}
+		if _, ok := uploader.PartSize(params, int(params.MaximumNumParts)+1, written); ok {
+			t.Errorf("budget %d: expected no part beyond %d", budget, params.MaximumNumParts)
+		}
+	}
+}
+
+func TestFileSizeLimit(t *testing.T) {
+	// enough memory for the full file size
+	uploader := &FileUploader{pool: NewBufferPool(64 * GiB)}
+	if limit := uploader.FileSizeLimit(awsUploadParams); limit != awsUploadParams.MaximumFileSize {
+		t.Errorf("expected the limit of the project, %d, got %d", awsUploadParams.MaximumFileSize, limit)
+	}
+
+	// small budgets limit the part size, and with it the file size
+	uploader = &FileUploader{pool: NewBufferPool(16 * MiB)}
+	limit := uploader.FileSizeLimit(awsUploadParams)
+	if limit < awsUploadParams.MaximumNumParts*awsUploadParams.MinimumPartSize ||
+		limit >= awsUploadParams.MaximumFileSize {
+		t.Errorf("unexpected limit %d for a budget of 16 MiB", limit)
+	}
+
+	// the budget cannot hold a single part
+	uploader = &FileUploader{pool: NewBufferPool(4 * MiB)}
+	if limit := uploader.FileSizeLimit(awsUploadParams); limit != 0 {
+		t.Errorf("expected no file to fit, got a limit of %d", limit)
+	}
+
+	// no limits known for the project
+	if limit := uploader.FileSizeLimit(FileUploadParameters{}); limit != math.MaxInt64 {
+		t.Errorf("expected no limit, got %d", limit)
+	}
+}
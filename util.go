@@ -21,6 +21,7 @@ const (
 const (
 	DatabaseFile = "metadata.db"
 	LogFile      = "dxfuse.log"
+	CmdPortFile  = "cmd_port"
 )
 const (
 	MinHttpClientPoolSize     = 30
@@ -43,6 +44,7 @@ const (
 	dirReadWriteMode  = 0777 | os.ModeDir
 	fileReadOnlyMode  = 0444
 	fileWriteOnlyMode = 0222
+	symlinkMode       = 0777 | os.ModeSymlink
 )
 const (
 	// flags for writing files to disk
@@ -71,6 +73,73 @@ type Options struct {
 	VerboseLevel int
 	Uid          uint32
 	Gid          uint32
+
+	// When an existing file is rewritten, keep the old version on
+	// the platform instead of removing it.
+	KeepReplacedFiles bool
+
+	// Move removed files and folders to the trash folder of the
+	// project, instead of deleting them.
+	Trash bool
+
+	// Keep the mode, mtime, and ownership of files in reserved
+	// properties, and apply them to the file attributes.
+	PosixMetadata bool
+
+	// Return from close once a file is uploaded, and close it on
+	// the platform in the background.
+	AsyncClose bool
+
+	// Remove the files left open on the platform by a previous
+	// mount, that did not shut down cleanly.
+	RemoveOrphans bool
+
+	// Limit on the memory used by write buffers, in bytes. Zero
+	// means a quarter of the physical memory.
+	WriteBufferMemory int64
+
+	// Store the md5 checksum of files written through dxfuse in
+	// a property, for downstream verification.
+	Md5Property bool
+
+	// Replace files that were written with clones of files that have
+	// the same contents in other mounted projects.
+	Dedup bool
+
+	// Compute the md5 of files read from beginning to end, and
+	// compare it with the one the platform has.
+	VerifyReads bool
+
+	// Fail the last read of a file read from beginning to end, if
+	// its md5 does not match the one the platform has.
+	StrictChecksum bool
+
+	// Tags, properties, and types given to every new file. The values
+	// may contain templates, that are expanded when a file is created.
+	DefaultTags       []string
+	DefaultProperties map[string]string
+	DefaultTypes      []string
+
+	// Set the media type of new files from the extension of their name
+	MediaType bool
+
+	// Limits on concurrent transfers, and on their bandwidth in bytes
+	// per second. Zero means the default, no limit on bandwidth. They
+	// can be changed while the filesystem is mounted.
+	UploadConcurrency   int
+	UploadBandwidth     int64
+	DownloadConcurrency int
+	DownloadBandwidth   int64
+
+	// How long reads and metadata operations retry transient errors,
+	// and wait for the platform to recover from an outage, before they
+	// fail. Operations that hold the global lock meanwhile hold up the
+	// others. Zero means the default.
+	RetryTimeout time.Duration
+
+	// Absolute path of the mount point, used to resolve paths
+	// given to external commands.
+	MountPoint string
 }
 
 // A node is a generalization over files and directories
@@ -126,6 +195,25 @@ const (
 	FK_Record   = 14
 	FK_Database = 15
 	FK_Other    = 16
+
+	// A symbolic link created through the filesystem
+	FK_PosixSymlink = 17
+)
+
+// Reserved properties.
+//
+// Symbolic links are stored on the platform as empty files, with
+// a property holding the target path. With the -posixMetadata flag,
+// file attributes that the platform does not have are kept in
+// properties too. With the -md5Property flag, files written through
+// dxfuse carry their md5 checksum.
+const (
+	SymlinkProperty = "dxfuse.symlink"
+	ModeProperty    = "dxfuse.mode"  // permission bits, in octal
+	MtimeProperty   = "dxfuse.mtime" // seconds since the epoch
+	UidProperty     = "dxfuse.uid"
+	GidProperty     = "dxfuse.gid"
+	Md5Property     = "dxfuse.md5" // md5 of the entire file, in hex
 )
 
 // A Unix file can stand for any DNAx data object. For example, it could be a workflow or an applet.
@@ -155,11 +243,15 @@ type File struct {
 	Uid   uint32
 	Gid   uint32
 
+	// Number of names the file has in the filesystem
+	Nlink int
+
 	// tags and properties
 	Tags       []string
 	Properties map[string]string
 
-	// for a symlink, it holds the path.
+	// for a symlink, it holds the path. For a DNAx symlink this is
+	// the remote URL, for a posix symlink it is the link target.
 	Symlink string
 
 	// is the file modified
@@ -170,6 +262,12 @@ type File struct {
 func (f File) GetAttrs() (a fuseops.InodeAttributes) {
 	a.Size = uint64(f.Size)
 	a.Nlink = 1
+	if f.Nlink > 1 {
+		a.Nlink = uint32(f.Nlink)
+	}
+	if f.Kind == FK_PosixSymlink {
+		a.Size = uint64(len(f.Symlink))
+	}
 	a.Atime = f.Mtime
 	a.Mtime = f.Mtime
 	a.Ctime = f.Ctime